@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -28,12 +29,25 @@ func main() {
 		}
 	}
 
+	// gpm ca create|export manages the CA used for TLS interception
+	if len(os.Args) > 1 && os.Args[1] == "ca" {
+		if err := proxy.CACommand(os.Args[2:], os.Stdout); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	list := proxy.NewList()
 	list.Load()
 
 	// get max timeout from env
 	timeout := getMaxTimeout()
 	logger := log.New(os.Stdout, "", log.LstdFlags)
+
+	// proxies of the providers are fetched before the first request and refreshed in the background
+	list.WatchProviders(context.Background(), logger)
+
 	server := proxy.NewServer(logger, list)
 
 	// initialize new router
@@ -48,18 +62,50 @@ func main() {
 	// Check API key first
 	r.Use(server.CheckAPIKey)
 
-	// Set a timeout value on the request context (ctx), that will signal
-	// through ctx.Done() that the request has timed out and all further
-	// processing should be stopped.
-	r.Use(middleware.Timeout(time.Duration(timeout) * time.Second))
-
 	r.Route("/get", func(r chi.Router) {
+		// Set a timeout value on the request context (ctx), that will signal
+		// through ctx.Done() that the request has timed out and all further
+		// processing should be stopped.
+		r.Use(middleware.Timeout(time.Duration(timeout) * time.Second))
+
 		// this middleware will perform multiplexing
 		// and pass response through the context
 		r.Use(server.ProxyGetRequest)
 		r.Get("/", server.ProxyGetResponse)
 	})
 
+	// downloads may take much longer than the timeout, every range request
+	// is limited by the multiplexer timeout instead
+	r.Get("/download", server.ProxyDownload)
+
+	// traffic of the caller's api key and of every proxy
+	r.Get("/usage", server.GetUsage)
+
+	// every request of a batch is limited by the multiplexer timeout
+	// so the batch as a whole is not limited
+	r.Post("/batch", server.ProxyBatch)
+
+	// jobs are processed asynchronously by a pool of workers
+	r.Route("/jobs", func(r chi.Router) {
+		r.Post("/", server.CreateJob)
+		r.Get("/{id}", server.GetJob)
+		r.Get("/{id}/result", server.GetJobResult)
+		r.Delete("/{id}", server.CancelJob)
+	})
+
+	// cookies and pinned proxies of named sessions
+	r.Route("/sessions", func(r chi.Router) {
+		r.Get("/{name}", server.GetSession)
+		r.Get("/{name}/cookies", server.ExportSessionCookies)
+		r.Delete("/{name}", server.DeleteSession)
+	})
+
+	// delivery records of results posted to callback URLs
+	r.Route("/callbacks", func(r chi.Router) {
+		r.Get("/{id}", server.GetDelivery)
+		r.Get("/{id}/body", server.GetDeliveryBody)
+	})
+
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt)
 
@@ -75,6 +121,18 @@ func main() {
 		}
 	}()
 
+	if forwardPort := resolveForwardPort(); forwardPort != "" {
+		go func() {
+			log.Printf("Forward proxy listening on port %s", forwardPort)
+
+			// forward proxy gets requests in absolute-form and CONNECT requests
+			// so it can't go through the router
+			if err := http.ListenAndServe(forwardPort, http.HandlerFunc(server.ProxyForward)); err != nil {
+				logger.Fatal(err)
+			}
+		}()
+	}
+
 	<-stop
 
 	logger.Println("\nShutting down the server...")
@@ -89,6 +147,16 @@ func resolvePort() string {
 	return addr
 }
 
+// resolveForwardPort - port of the forward proxy, empty when it is disabled
+func resolveForwardPort() string {
+	port := os.Getenv("GPM_FORWARD_PORT")
+	if port == "" {
+		return ""
+	}
+
+	return ":" + port
+}
+
 func getMaxTimeout() int {
 	maxTimeout, err := strconv.Atoi(os.Getenv("GPM_MAX_TIMEOUT"))
 	if err != nil {
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// batch requests bigger than that are rejected
+const maxBatchSize = 32 << 20
+
+// ProxyBatch - handle POST /batch with a JSON array of request specs
+// requests are made with bounded parallelism and their results are
+// streamed back as NDJSON in the order of completion
+func (s *Server) ProxyBatch(w http.ResponseWriter, r *http.Request) {
+	var specs []*RequestSpec
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchSize)).Decode(&specs); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid batch: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if maxItems := getBatchMaxItems(); len(specs) > maxItems {
+		http.Error(w, fmt.Sprintf("Batch may contain at most %d requests", maxItems), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	ctx := r.Context()
+	// buffered so nobody blocks when the client goes away
+	results := make(chan *Result, len(specs))
+
+	go func() {
+		semaphore := make(chan struct{}, getBatchConcurrency())
+
+		for i, spec := range specs {
+			// a null item of the array has nothing to run
+			if spec == nil {
+				result := &Result{Index: i}
+				result.setError(errors.New("request spec is missing"))
+				results <- result
+				continue
+			}
+
+			select {
+			case semaphore <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			go func(i int, spec *RequestSpec) {
+				defer func() { <-semaphore }()
+				result := s.runSpecWithBody(r, i, spec)
+
+				if spec.Options.CallbackURL != "" {
+					delivery := s.callbacks.Register(spec.Options.CallbackURL)
+					result.DeliveryID = delivery.ID
+					s.callbacks.Send(delivery.ID, &Envelope{Result: result})
+				}
+
+				results <- result
+			}(i, spec)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	for i := 0; i < len(specs); i++ {
+		select {
+		case result := <-results:
+			if err := encoder.Encode(result); err != nil {
+				s.logger.Printf("Could not write batch result %v", err)
+				return
+			}
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-ctx.Done():
+			s.logger.Printf("Batch cancelled: %v", ctx.Err())
+			return
+		}
+	}
+}
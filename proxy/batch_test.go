@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+func TestProxyBatch(t *testing.T) {
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(500 * time.Millisecond)
+		case "/echo":
+			w.Header().Set("X-Method", r.Method)
+			fmt.Fprint(w, r.Header.Get("X-Test"))
+			return
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer destination.Close()
+
+	list := NewList()
+	list.Filename = "../proxy.list.example"
+	list.Load()
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	server := NewServer(logger, list)
+
+	r := chi.NewRouter()
+	r.Post("/batch", server.ProxyBatch)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	t.Run("results are streamed in completion order", func(t *testing.T) {
+		batch := fmt.Sprintf(`[
+			{"url": "%[1]s/slow"},
+			{"url": "%[1]s/echo", "method": "post", "headers": {"X-Test": "hello"}, "body": "data"},
+			{"url": "%[1]s/missing"},
+			{"url": "wrong"}
+		]`, destination.URL)
+
+		resp, body := testRequest(t, ts, "POST", "/batch", strings.NewReader(batch))
+
+		if resp.Header.Get("Content-Type") != "application/x-ndjson" {
+			t.Fatalf("Expected NDJSON content type, got %s", resp.Header.Get("Content-Type"))
+		}
+
+		var results []*Result
+		scanner := bufio.NewScanner(strings.NewReader(body))
+		for scanner.Scan() {
+			var result Result
+			if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+				t.Fatal(err)
+			}
+			results = append(results, &result)
+		}
+
+		if len(results) != 4 {
+			t.Fatalf("Expected 4 results, got %d", len(results))
+		}
+
+		if results[3].Index != 0 {
+			t.Fatalf("Expected slow request to complete last, got %d", results[3].Index)
+		}
+
+		for _, result := range results {
+			switch result.Index {
+			case 0:
+				if result.StatusCode != http.StatusOK || result.Body != "/slow" {
+					t.Errorf("Unexpected slow result %+v", result)
+				}
+			case 1:
+				if result.Body != "hello" || result.Header.Get("X-Method") != "POST" {
+					t.Errorf("Unexpected echo result %+v", result)
+				}
+			case 2:
+				if !strings.Contains(result.Error, "error status 404") {
+					t.Errorf("Expected 404 error, got %+v", result)
+				}
+			case 3:
+				if result.Error != "passed url value does not match a valid url pattern" {
+					t.Errorf("Expected validation error, got %+v", result)
+				}
+			}
+		}
+	})
+
+	t.Run("invalid items", func(t *testing.T) {
+		batch := fmt.Sprintf(`[null, {"url": "%s/echo", "method": "GE T"}]`, destination.URL)
+		_, body := testRequest(t, ts, "POST", "/batch", strings.NewReader(batch))
+
+		errors := make(map[int]string)
+		scanner := bufio.NewScanner(strings.NewReader(body))
+		for scanner.Scan() {
+			var result Result
+			if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+				t.Fatal(err)
+			}
+			errors[result.Index] = result.Error
+		}
+
+		if errors[0] != "request spec is missing" || !strings.Contains(errors[1], "not a valid HTTP method") {
+			t.Fatalf("Expected an error per invalid item, got %v", errors)
+		}
+	})
+
+	t.Run("invalid batch", func(t *testing.T) {
+		resp, _ := testRequest(t, ts, "POST", "/batch", strings.NewReader(`{"url": "not an array"}`))
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected bad request, got %s", resp.Status)
+		}
+	})
+}
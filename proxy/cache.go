@@ -0,0 +1,411 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheStatusHeader - response header reporting how the cache handled the request
+const CacheStatusHeader = "X-GPM-Cache"
+
+// Cache statuses reported in CacheStatusHeader
+const (
+	CacheHit   = "HIT"
+	CacheMiss  = "MISS"
+	CacheStale = "STALE"
+)
+
+// CachedResponse - response stored in the cache
+type CachedResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// names of the request headers the response varies on
+	// when set on an entry stored under the primary key it points to the variants
+	VaryNames []string
+	StoredAt  time.Time
+	// until then the response can be served without revalidation
+	ExpiresAt time.Time
+	// after that the response can't be served even on error
+	DiscardAt time.Time
+	// the response must be revalidated every time it is served
+	NoCache bool
+}
+
+// IsFresh - checks if response can be served without revalidation
+func (cr *CachedResponse) IsFresh(now time.Time) bool {
+	return !cr.NoCache && now.Before(cr.ExpiresAt)
+}
+
+// IsDiscarded - checks if response is too old to be served at all
+func (cr *CachedResponse) IsDiscarded(now time.Time) bool {
+	return !now.Before(cr.DiscardAt)
+}
+
+// Size - approximate amount of memory taken by the response
+func (cr *CachedResponse) Size() int64 {
+	size := int64(len(cr.Body))
+	for key, values := range cr.Header {
+		size += int64(len(key))
+		for _, value := range values {
+			size += int64(len(value))
+		}
+	}
+
+	return size
+}
+
+// CanRevalidate - checks if response has validators for a conditional request
+func (cr *CachedResponse) CanRevalidate() bool {
+	return cr.Header.Get("ETag") != "" || cr.Header.Get("Last-Modified") != ""
+}
+
+// toFirstResponse - turn the cached response into a valid first response
+func (cr *CachedResponse) toFirstResponse(now time.Time, elapsed time.Duration) *FirstResponse {
+	header := make(http.Header, len(cr.Header)+1)
+	for key, values := range cr.Header {
+		header[key] = append([]string(nil), values...)
+	}
+	header.Set("Age", strconv.Itoa(int(now.Sub(cr.StoredAt).Seconds())))
+
+	return NewValidFirstResponse(&http.Response{
+		StatusCode:    cr.StatusCode,
+		Status:        strconv.Itoa(cr.StatusCode) + " " + http.StatusText(cr.StatusCode),
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(cr.Body)),
+		ContentLength: int64(len(cr.Body)),
+	}, elapsed)
+}
+
+// CacheStore - storage backend of the response cache
+type CacheStore interface {
+	Get(key string) (*CachedResponse, bool)
+	Set(key string, response *CachedResponse)
+	Delete(key string)
+}
+
+// ResponseCache - caches responses in front of the multiplexer
+type ResponseCache struct {
+	store CacheStore
+	// when positive overrides freshness lifetime sent by the destination
+	overrideTTL time.Duration
+	// how long an expired response may be served when all requests fail
+	maxStale time.Duration
+	// responses with bigger bodies are not cached
+	maxEntrySize int64
+}
+
+// Fetch - serve the request from the cache or with the given fetch function
+// fetch receives the headers of a conditional request when a stale response is revalidated
+// returns the response along with the cache status
+func (rc *ResponseCache) Fetch(
+	r *http.Request,
+	spec *RequestSpec,
+	fetch func(header http.Header) *FirstResponse,
+) (*FirstResponse, string) {
+	if spec.Method != http.MethodGet && spec.Method != http.MethodHead {
+		return fetch(nil), CacheMiss
+	}
+
+	// responses vary on the headers sent to the destination
+	header := spec.outgoingHeader(nil)
+
+	// responses shaped by the options must not be served to requests with other ones
+	destinationURL := spec.cacheURL()
+
+	startedAt := time.Now()
+	key, cached := rc.lookup(header, spec.Method, destinationURL)
+	// a response fetched without credentials may not be what the credentials get
+	if cached != nil && !sharedWith(header, parseCacheControl(cached.Header.Get("Cache-Control"))) {
+		cached = nil
+	}
+
+	if cached != nil && cached.IsFresh(startedAt) && !requestsNoCache(r.Header) {
+		return cached.toFirstResponse(startedAt, time.Since(startedAt)), CacheHit
+	}
+
+	var conditional http.Header
+	if cached != nil && cached.CanRevalidate() {
+		conditional = make(http.Header)
+		if etag := cached.Header.Get("ETag"); etag != "" {
+			conditional.Set("If-None-Match", etag)
+		}
+		if lastModified := cached.Header.Get("Last-Modified"); lastModified != "" {
+			conditional.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	response := fetch(conditional)
+	now := time.Now()
+
+	if !response.IsValid() {
+		if cached != nil && !cached.IsDiscarded(now) {
+			return cached.toFirstResponse(now, response.elapsed), CacheStale
+		}
+
+		return response, CacheMiss
+	}
+
+	if response.GetStatusCode() == http.StatusNotModified && cached != nil {
+		response.CloseBody()
+		cached = rc.revalidated(key, cached, response.GetHeader(), now)
+		return cached.toFirstResponse(now, response.elapsed), CacheHit
+	}
+
+	rc.save(header, spec.Method, destinationURL, response, now)
+
+	return response, CacheMiss
+}
+
+// lookup - find cached response for the request
+// returns the key the response was found under
+func (rc *ResponseCache) lookup(header http.Header, method, destinationURL string) (string, *CachedResponse) {
+	now := time.Now()
+	key := primaryCacheKey(method, destinationURL)
+
+	cached, ok := rc.store.Get(key)
+	if !ok {
+		return key, nil
+	}
+
+	if cached.VaryNames != nil {
+		key = variantCacheKey(key, cached.VaryNames, header)
+		cached, ok = rc.store.Get(key)
+		if !ok {
+			return key, nil
+		}
+	}
+
+	if cached.IsDiscarded(now) {
+		rc.store.Delete(key)
+		return key, nil
+	}
+
+	return key, cached
+}
+
+// save - store the response if it is cacheable
+// the body is read into memory and the response body is replaced with it
+func (rc *ResponseCache) save(header http.Header, method, destinationURL string, response *FirstResponse, now time.Time) {
+	if response.GetStatusCode() != http.StatusOK {
+		return
+	}
+
+	directives := parseCacheControl(response.GetHeader().Get("Cache-Control"))
+	if _, ok := directives["no-store"]; ok {
+		return
+	}
+	if _, ok := directives["private"]; ok {
+		return
+	}
+
+	if !sharedWith(header, directives) {
+		return
+	}
+
+	varyNames := parseVary(response.GetHeader().Get("Vary"))
+	if len(varyNames) == 1 && varyNames[0] == "*" {
+		return
+	}
+
+	lifetime := rc.lifetime(response.GetHeader(), directives, now)
+	_, noCache := directives["no-cache"]
+	// a response that is stale right away is still worth keeping
+	// if it can be revalidated or served when all requests fail
+	if lifetime <= 0 && rc.maxStale <= 0 && !hasValidators(response.GetHeader()) {
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(response.GetBody(), rc.maxEntrySize+1))
+	if err != nil || int64(len(body)) > rc.maxEntrySize {
+		// keep streaming whatever was already read followed by the rest of the body
+		response.Response.Body = readCloser{io.MultiReader(bytes.NewReader(body), response.Response.Body), response.Response.Body}
+		return
+	}
+
+	response.CloseBody()
+	response.Response.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	// the entry is shared by the requests it is served to, the header of the response keeps changing
+	cached := &CachedResponse{
+		StatusCode: response.GetStatusCode(),
+		Header:     response.GetHeader().Clone(),
+		Body:       body,
+		StoredAt:   now,
+		ExpiresAt:  now.Add(lifetime),
+		DiscardAt:  now.Add(lifetime + rc.maxStale),
+		NoCache:    noCache,
+	}
+
+	key := primaryCacheKey(method, destinationURL)
+	if len(varyNames) > 0 {
+		rc.store.Set(key, &CachedResponse{VaryNames: varyNames, StoredAt: now, DiscardAt: cached.DiscardAt})
+		key = variantCacheKey(key, varyNames, header)
+	}
+
+	rc.store.Set(key, cached)
+}
+
+// sharedWith - checks if the response may be stored for or served to a request with the headers
+// responses to requests with credentials are private unless the destination shares them (RFC 9111 3.5)
+func sharedWith(header http.Header, directives map[string]string) bool {
+	if header.Get("Authorization") == "" && header.Get("Cookie") == "" {
+		return true
+	}
+
+	_, public := directives["public"]
+	_, shared := directives["s-maxage"]
+	return public || shared
+}
+
+// revalidated - store a refreshed copy of the cached response after the destination replied with 304
+// the cached entry itself is left alone as other requests may be serving it
+func (rc *ResponseCache) revalidated(key string, cached *CachedResponse, header http.Header, now time.Time) *CachedResponse {
+	merged := cached.Header.Clone()
+	for name, values := range header {
+		merged[name] = append([]string(nil), values...)
+	}
+
+	directives := parseCacheControl(merged.Get("Cache-Control"))
+	lifetime := rc.lifetime(merged, directives, now)
+
+	refreshed := *cached
+	refreshed.Header = merged
+	refreshed.StoredAt = now
+	refreshed.ExpiresAt = now.Add(lifetime)
+	refreshed.DiscardAt = now.Add(lifetime + rc.maxStale)
+
+	rc.store.Set(key, &refreshed)
+
+	return &refreshed
+}
+
+// lifetime - freshness lifetime of the response
+// s-maxage is preferred over max-age which is preferred over Expires
+func (rc *ResponseCache) lifetime(header http.Header, directives map[string]string, now time.Time) time.Duration {
+	if rc.overrideTTL > 0 {
+		return rc.overrideTTL
+	}
+
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[directive]; ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil {
+				return 0
+			}
+			return time.Duration(seconds) * time.Second
+		}
+	}
+
+	if expires := header.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+
+		return expiresAt.Sub(date)
+	}
+
+	return 0
+}
+
+func hasValidators(header http.Header) bool {
+	return header.Get("ETag") != "" || header.Get("Last-Modified") != ""
+}
+
+// requestsNoCache - checks if the client asked not to be served from cache
+func requestsNoCache(header http.Header) bool {
+	_, ok := parseCacheControl(header.Get("Cache-Control"))["no-cache"]
+	return ok || header.Get("Pragma") == "no-cache"
+}
+
+// parseCacheControl - parse Cache-Control header into a map of directives
+func parseCacheControl(value string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		kv := strings.SplitN(part, "=", 2)
+		name := strings.ToLower(strings.TrimSpace(kv[0]))
+		if len(kv) == 2 {
+			directives[name] = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+		} else {
+			directives[name] = ""
+		}
+	}
+
+	return directives
+}
+
+// parseVary - get sorted canonical header names from the Vary header
+func parseVary(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "*" {
+			return []string{"*"}
+		}
+		if name != "" {
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func primaryCacheKey(method, destinationURL string) string {
+	return method + " " + destinationURL
+}
+
+func variantCacheKey(primaryKey string, varyNames []string, header http.Header) string {
+	key := primaryKey
+	for _, name := range varyNames {
+		key += "\n" + name + ": " + strings.Join(header[name], ",")
+	}
+
+	return key
+}
+
+// readCloser - combines a reader with the closer of the original body
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// NewResponseCache - creates new response cache with the store chosen in GPM_CACHE
+// returns nil when caching is disabled
+func NewResponseCache() *ResponseCache {
+	var store CacheStore
+
+	switch getCacheBackend() {
+	case "memory":
+		store = NewMemoryCacheStore(getCacheMaxBytes())
+	case "disk":
+		store = NewDiskCacheStore(getCacheDir())
+	default:
+		return nil
+	}
+
+	return &ResponseCache{
+		store:        store,
+		overrideTTL:  getCacheTTL(),
+		maxStale:     getCacheMaxStale(),
+		maxEntrySize: getCacheMaxEntrySize(),
+	}
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// MemoryCacheStore - in memory LRU cache store limited by the total size of responses
+type MemoryCacheStore struct {
+	maxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type memoryCacheEntry struct {
+	key      string
+	response *CachedResponse
+	size     int64
+}
+
+// Get - get response by key and mark it as recently used
+func (ms *MemoryCacheStore) Get(key string) (*CachedResponse, bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	element, ok := ms.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	ms.order.MoveToFront(element)
+
+	return element.Value.(*memoryCacheEntry).response, true
+}
+
+// Set - store the response evicting least recently used ones when out of budget
+func (ms *MemoryCacheStore) Set(key string, response *CachedResponse) {
+	size := response.Size() + int64(len(key))
+	if size > ms.maxBytes {
+		return
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if element, ok := ms.entries[key]; ok {
+		ms.remove(element)
+	}
+
+	ms.entries[key] = ms.order.PushFront(&memoryCacheEntry{key: key, response: response, size: size})
+	ms.size += size
+
+	for ms.size > ms.maxBytes {
+		ms.remove(ms.order.Back())
+	}
+}
+
+// Delete - remove the response from the store
+func (ms *MemoryCacheStore) Delete(key string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if element, ok := ms.entries[key]; ok {
+		ms.remove(element)
+	}
+}
+
+// Size - total size of the stored responses
+func (ms *MemoryCacheStore) Size() int64 {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.size
+}
+
+func (ms *MemoryCacheStore) remove(element *list.Element) {
+	entry := ms.order.Remove(element).(*memoryCacheEntry)
+	delete(ms.entries, entry.key)
+	ms.size -= entry.size
+}
+
+// NewMemoryCacheStore - creates new in memory cache store
+func NewMemoryCacheStore(maxBytes int64) *MemoryCacheStore {
+	return &MemoryCacheStore{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// DiskCacheStore - cache store keeping every response in its own file
+type DiskCacheStore struct {
+	dir string
+	// guards against reading a file while it is being written
+	mu sync.RWMutex
+}
+
+// Get - read the response from disk
+func (ds *DiskCacheStore) Get(key string) (*CachedResponse, bool) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	f, err := os.Open(ds.path(key))
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+
+	var response CachedResponse
+	if err := gob.NewDecoder(f).Decode(&response); err != nil {
+		return nil, false
+	}
+
+	return &response, true
+}
+
+// Set - write the response to disk
+func (ds *DiskCacheStore) Set(key string, response *CachedResponse) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if err := os.MkdirAll(ds.dir, 0755); err != nil {
+		return
+	}
+
+	// write to a temporary file first so a crash never leaves a partial entry
+	tmp, err := ioutil.TempFile(ds.dir, "tmp-")
+	if err != nil {
+		return
+	}
+
+	if err := gob.NewEncoder(tmp).Encode(response); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return
+	}
+
+	tmp.Close()
+	os.Rename(tmp.Name(), ds.path(key))
+}
+
+// Delete - remove the response file
+func (ds *DiskCacheStore) Delete(key string) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	os.Remove(ds.path(key))
+}
+
+// Purge - remove responses that can't be served anymore
+func (ds *DiskCacheStore) Purge() {
+	files, err := filepath.Glob(filepath.Join(ds.dir, "*.gob"))
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	for _, file := range files {
+		ds.mu.Lock()
+		if f, err := os.Open(file); err == nil {
+			var response CachedResponse
+			err := gob.NewDecoder(f).Decode(&response)
+			f.Close()
+
+			if err != nil || response.IsDiscarded(now) {
+				os.Remove(file)
+			}
+		}
+		ds.mu.Unlock()
+	}
+}
+
+func (ds *DiskCacheStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(ds.dir, hex.EncodeToString(sum[:])+".gob")
+}
+
+// NewDiskCacheStore - creates new on disk cache store
+// expired responses are purged once an hour
+func NewDiskCacheStore(dir string) *DiskCacheStore {
+	store := &DiskCacheStore{dir: dir}
+
+	go func() {
+		for range time.Tick(time.Hour) {
+			store.Purge()
+		}
+	}()
+
+	return store
+}
@@ -0,0 +1,253 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+func TestResponseCache(t *testing.T) {
+	var hits int64
+	var failing int32
+
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/etag":
+			w.Header().Set("Cache-Control", "max-age=0")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/credentials":
+			w.Header().Set("Cache-Control", "max-age=60")
+			if r.URL.Query().Get("public") != "" {
+				w.Header().Set("Cache-Control", "public, max-age=60")
+			}
+			fmt.Fprintf(w, "secret of %s", r.Header.Get("Authorization"))
+			return
+		}
+
+		fmt.Fprintf(w, "body of %s", r.URL.Path)
+	}))
+	defer destination.Close()
+
+	list := NewList()
+	list.Filename = "../proxy.list.example"
+	list.Load()
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	server := NewServer(logger, list)
+	server.cache = &ResponseCache{
+		store:        NewMemoryCacheStore(1 << 20),
+		maxStale:     time.Hour,
+		maxEntrySize: 1 << 20,
+	}
+
+	r := chi.NewRouter()
+	r.Use(server.ProxyGetRequest)
+	r.Get("/get", server.ProxyGetResponse)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	get := func(t *testing.T, path string, expectedStatus string) {
+		atomic.StoreInt64(&hits, 0)
+
+		resp, body := testRequest(t, ts, "GET", "/get?url="+uriEncode(destination.URL+path), nil)
+
+		if resp.Header.Get(CacheStatusHeader) != expectedStatus {
+			t.Fatalf("Expected cache status %s for %s, got %s", expectedStatus, path, resp.Header.Get(CacheStatusHeader))
+		}
+
+		if body != "body of "+path {
+			t.Fatalf("Unexpected body %s for %s", body, path)
+		}
+	}
+
+	t.Run("fresh response", func(t *testing.T) {
+		get(t, "/fresh", CacheMiss)
+		get(t, "/fresh", CacheHit)
+
+		if atomic.LoadInt64(&hits) != 0 {
+			t.Fatalf("Expected fresh response to be served without reaching destination")
+		}
+	})
+
+	t.Run("revalidation", func(t *testing.T) {
+		get(t, "/etag", CacheMiss)
+		get(t, "/etag", CacheHit)
+
+		if atomic.LoadInt64(&hits) == 0 {
+			t.Fatalf("Expected stale response to be revalidated")
+		}
+	})
+
+	t.Run("private response", func(t *testing.T) {
+		get(t, "/private", CacheMiss)
+		get(t, "/private", CacheMiss)
+	})
+
+	t.Run("vary", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		english := &RequestSpec{Method: "GET", URL: destination.URL + "/vary", Header: map[string]string{"Accept-Language": "en"}}
+		german := &RequestSpec{Method: "GET", URL: destination.URL + "/vary", Header: map[string]string{"Accept-Language": "de"}}
+
+		for _, c := range []struct {
+			spec   *RequestSpec
+			status string
+		}{
+			{english, CacheMiss},
+			{german, CacheMiss},
+			{english, CacheHit},
+			{german, CacheHit},
+		} {
+			response, status := server.fetch(req, c.spec)
+			response.CloseBody()
+
+			if status != c.status {
+				t.Fatalf("Expected %s for %s variant, got %s", c.status, c.spec.Header["Accept-Language"], status)
+			}
+		}
+	})
+
+	t.Run("credentials", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		fetch := func(path, credentials string) (string, string) {
+			spec := &RequestSpec{Method: "GET", URL: destination.URL + path, Header: map[string]string{"Authorization": credentials}}
+			response, status := server.fetch(req, spec)
+			defer response.CloseBody()
+			body, _ := ioutil.ReadAll(response.GetBody())
+			return string(body), status
+		}
+
+		fetch("/credentials", "alice")
+		if body, status := fetch("/credentials", "bob"); body != "secret of bob" || status != CacheMiss {
+			t.Fatalf("Expected the response of alice not to be served to bob, got %s %s", status, body)
+		}
+
+		if _, status := fetch("/fresh?credentials", ""); status != CacheMiss {
+			t.Fatalf("Expected a fresh entry, got %s", status)
+		}
+		if _, status := fetch("/fresh?credentials", "bob"); status != CacheMiss {
+			t.Fatalf("Expected the anonymous response not to be served to bob, got %s", status)
+		}
+
+		fetch("/credentials?public=1", "alice")
+		if body, status := fetch("/credentials?public=1", "bob"); body != "secret of alice" || status != CacheHit {
+			t.Fatalf("Expected the public response to be shared, got %s %s", status, body)
+		}
+	})
+
+	t.Run("options", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		plain := &RequestSpec{Method: "GET", URL: destination.URL + "/fresh?options"}
+		http1 := &RequestSpec{Method: "GET", URL: destination.URL + "/fresh?options", Options: RequestOptions{Protocol: ProtocolHTTP1}}
+		fingerprinted := &RequestSpec{Method: "GET", URL: destination.URL + "/fresh?options", Options: RequestOptions{TLS: "go"}}
+
+		for _, c := range []struct {
+			spec   *RequestSpec
+			status string
+		}{
+			{plain, CacheMiss},
+			{http1, CacheMiss},
+			{fingerprinted, CacheMiss},
+			{http1, CacheHit},
+		} {
+			response, status := server.fetch(req, c.spec)
+			response.CloseBody()
+
+			if status != c.status {
+				t.Fatalf("Expected %s for %+v, got %s", c.status, c.spec.Options, status)
+			}
+		}
+	})
+
+	t.Run("entries are isolated from the responses", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		spec := &RequestSpec{Method: "GET", URL: destination.URL + "/fresh?isolated"}
+
+		response, _ := server.fetch(req, spec)
+		response.CloseBody()
+		response.GetHeader().Set("Cache-Control", "changed by a client")
+
+		response, status := server.fetch(req, spec)
+		response.CloseBody()
+		if status != CacheHit || response.GetHeader().Get("Cache-Control") != "max-age=60" {
+			t.Fatalf("Expected the header of the cached response, got %s %v", status, response.GetHeader())
+		}
+	})
+
+	t.Run("stale if error", func(t *testing.T) {
+		atomic.StoreInt32(&failing, 1)
+		defer atomic.StoreInt32(&failing, 0)
+
+		get(t, "/etag", CacheStale)
+	})
+}
+
+func TestMemoryCacheStoreEviction(t *testing.T) {
+	store := NewMemoryCacheStore(100)
+
+	store.Set("a", &CachedResponse{Body: make([]byte, 40)})
+	store.Set("b", &CachedResponse{Body: make([]byte, 40)})
+	store.Get("a")
+	store.Set("c", &CachedResponse{Body: make([]byte, 40)})
+
+	if _, ok := store.Get("b"); ok {
+		t.Fatal("Expected least recently used entry to be evicted")
+	}
+
+	if _, ok := store.Get("a"); !ok {
+		t.Fatal("Expected recently used entry to be kept")
+	}
+
+	if store.Size() > 100 {
+		t.Fatalf("Expected store to stay within its budget, got %d", store.Size())
+	}
+}
+
+func TestDiskCacheStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gpm-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &DiskCacheStore{dir: dir}
+	store.Set("key", &CachedResponse{StatusCode: 200, Body: []byte("body"), DiscardAt: time.Now().Add(time.Hour)})
+
+	cached, ok := store.Get("key")
+	if !ok || string(cached.Body) != "body" {
+		t.Fatalf("Expected to read the stored response back")
+	}
+
+	store.Set("old", &CachedResponse{StatusCode: 200, DiscardAt: time.Now().Add(-time.Second)})
+	store.Purge()
+
+	if _, ok := store.Get("old"); ok {
+		t.Fatal("Expected discarded response to be purged")
+	}
+}
@@ -0,0 +1,332 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// Headers sent along with every callback
+const (
+	CallbackDeliveryHeader  = "X-GPM-Delivery"
+	CallbackTimestampHeader = "X-GPM-Timestamp"
+	CallbackSignatureHeader = "X-GPM-Signature"
+)
+
+// Delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Envelope - payload posted to the callback URL
+type Envelope struct {
+	*Result
+	JobID string `json:"job_id,omitempty"`
+	// path the body can be fetched from when it is not inlined
+	BodyRef string `json:"body_ref,omitempty"`
+}
+
+// DeliveryAttempt - a single attempt to post the envelope
+type DeliveryAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Elapsed    float64   `json:"elapsed"`
+}
+
+// Delivery - record of the envelope delivery to the callback URL
+type Delivery struct {
+	ID          string            `json:"id"`
+	CallbackURL string            `json:"callback_url"`
+	Status      string            `json:"status"`
+	CreatedAt   time.Time         `json:"created_at"`
+	Attempts    []DeliveryAttempt `json:"attempts"`
+}
+
+// CallbackSender - posts results to callback URLs retrying with backoff
+type CallbackSender struct {
+	client *http.Client
+	// key the envelopes are signed with, envelopes are not signed when empty
+	secret []byte
+	// maximum number of attempts
+	attempts int
+	// delay before the second attempt, doubled after every attempt
+	backoff time.Duration
+	// bigger bodies are stored on disk and referenced from the envelope
+	maxInlineBody int
+	// directory bodies are stored in
+	dir string
+	// how long deliveries are kept
+	ttl time.Duration
+
+	mu         sync.Mutex
+	deliveries map[string]*Delivery
+}
+
+// Register - create a pending delivery to the callback URL
+func (cs *CallbackSender) Register(callbackURL string) Delivery {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	delivery := &Delivery{
+		ID:          newID(),
+		CallbackURL: callbackURL,
+		Status:      DeliveryPending,
+		CreatedAt:   time.Now(),
+		Attempts:    []DeliveryAttempt{},
+	}
+	cs.deliveries[delivery.ID] = delivery
+
+	return *delivery
+}
+
+// Get - get a snapshot of the delivery
+func (cs *CallbackSender) Get(id string) (Delivery, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	delivery, ok := cs.deliveries[id]
+	if !ok {
+		return Delivery{}, false
+	}
+
+	snapshot := *delivery
+	snapshot.Attempts = append([]DeliveryAttempt(nil), delivery.Attempts...)
+
+	return snapshot, true
+}
+
+// Send - post the envelope of the registered delivery in background
+// bodies too big to be inlined are stored and referenced instead
+func (cs *CallbackSender) Send(id string, envelope *Envelope) {
+	cs.mu.Lock()
+	delivery, ok := cs.deliveries[id]
+	cs.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	result := *envelope.Result
+	result.DeliveryID = id
+	envelope = &Envelope{Result: &result, JobID: envelope.JobID, BodyRef: envelope.BodyRef}
+
+	if len(result.Body) > cs.maxInlineBody {
+		if err := cs.storeBody(id, &result); err != nil {
+			result.Error = fmt.Sprintf("could not store the body: %v", err)
+		} else {
+			envelope.BodyRef = "/callbacks/" + id + "/body"
+		}
+		result.Body, result.BodyEncoding = "", ""
+	}
+
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		cs.record(delivery, DeliveryAttempt{At: time.Now(), Error: err.Error()}, DeliveryFailed)
+		return
+	}
+
+	go cs.deliver(delivery, payload)
+}
+
+// deliver - post the payload until it is accepted or attempts run out
+func (cs *CallbackSender) deliver(delivery *Delivery, payload []byte) {
+	backoff := cs.backoff
+
+	for attempt := 1; attempt <= cs.attempts; attempt++ {
+		startedAt := time.Now()
+		statusCode, err := cs.post(delivery, payload)
+
+		record := DeliveryAttempt{At: startedAt, StatusCode: statusCode, Elapsed: time.Since(startedAt).Seconds()}
+		if err != nil {
+			record.Error = err.Error()
+		}
+
+		if err == nil {
+			cs.record(delivery, record, DeliveryDelivered)
+			return
+		}
+
+		if attempt == cs.attempts {
+			cs.record(delivery, record, DeliveryFailed)
+			return
+		}
+
+		cs.record(delivery, record, DeliveryPending)
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post - make a single signed attempt
+func (cs *CallbackSender) post(delivery *Delivery, payload []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, delivery.CallbackURL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(CallbackDeliveryHeader, delivery.ID)
+	req.Header.Set(CallbackTimestampHeader, timestamp)
+	if len(cs.secret) > 0 {
+		req.Header.Set(CallbackSignatureHeader, SignCallback(cs.secret, timestamp, payload))
+	}
+
+	response, err := cs.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return response.StatusCode, &StatusError{StatusCode: response.StatusCode, URL: delivery.CallbackURL}
+	}
+
+	return response.StatusCode, nil
+}
+
+func (cs *CallbackSender) record(delivery *Delivery, attempt DeliveryAttempt, status string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	delivery.Attempts = append(delivery.Attempts, attempt)
+	delivery.Status = status
+}
+
+// storeBody - write the decoded body of the result to disk
+func (cs *CallbackSender) storeBody(id string, result *Result) error {
+	body := []byte(result.Body)
+	if result.BodyEncoding == "base64" {
+		var err error
+		if body, err = base64.StdEncoding.DecodeString(result.Body); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(cs.dir, 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(cs.bodyPath(id), body, 0644)
+}
+
+func (cs *CallbackSender) bodyPath(id string) string {
+	return filepath.Join(cs.dir, id+".body")
+}
+
+// purge - forget deliveries older than TTL
+func (cs *CallbackSender) purge() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	now := time.Now()
+	for id, delivery := range cs.deliveries {
+		if delivery.Status != DeliveryPending && now.Sub(delivery.CreatedAt) > cs.ttl {
+			delete(cs.deliveries, id)
+			os.Remove(cs.bodyPath(id))
+		}
+	}
+}
+
+// SignCallback - signature of the payload sent in CallbackSignatureHeader
+// it is the hex encoded HMAC-SHA256 of the timestamp and the payload joined with a dot
+func SignCallback(secret []byte, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// ValidateCallbackURL - checks that callback URL is an absolute http(s) URL
+func ValidateCallbackURL(callbackURL string) error {
+	u, err := url.Parse(callbackURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("callback url must be an absolute http(s) url")
+	}
+
+	return nil
+}
+
+// NewCallbackSender - creates new callback sender configured from env
+func NewCallbackSender() *CallbackSender {
+	cs := &CallbackSender{
+		client:        &http.Client{Timeout: 10 * time.Second},
+		secret:        []byte(os.Getenv("GPM_CALLBACK_SECRET")),
+		attempts:      getCallbackAttempts(),
+		backoff:       getCallbackBackoff(),
+		maxInlineBody: getCallbackMaxInlineBody(),
+		dir:           getCallbackDir(),
+		ttl:           getCallbackTTL(),
+		deliveries:    make(map[string]*Delivery),
+	}
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			cs.purge()
+		}
+	}()
+
+	return cs
+}
+
+// GetDelivery - handle GET /callbacks/{id} with the delivery record
+func (s *Server) GetDelivery(w http.ResponseWriter, r *http.Request) {
+	delivery, ok := s.callbacks.Get(chi.URLParam(r, "id"))
+	if !ok {
+		http.Error(w, "Delivery not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, delivery)
+}
+
+// GetDeliveryBody - handle GET /callbacks/{id}/body with the body referenced from the envelope
+func (s *Server) GetDeliveryBody(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if _, ok := s.callbacks.Get(id); !ok {
+		http.Error(w, "Delivery not found", http.StatusNotFound)
+		return
+	}
+
+	http.ServeFile(w, r, s.callbacks.bodyPath(id))
+}
+
+// deliverLater - run the spec in background and post the result to its callback URL
+// returns the pending delivery right away
+func (s *Server) deliverLater(r *http.Request, spec *RequestSpec) Delivery {
+	delivery := s.callbacks.Register(spec.Options.CallbackURL)
+
+	// the request must outlive the one of the client
+	detached := r.WithContext(context.WithoutCancel(r.Context()))
+
+	go func() {
+		result := s.runSpecWithBody(detached, 0, spec)
+		s.callbacks.Send(delivery.ID, &Envelope{Result: result})
+	}()
+
+	return delivery
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+func TestCallbacks(t *testing.T) {
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/big" {
+			fmt.Fprint(w, "a callback body that is too big to be inlined")
+			return
+		}
+
+		fmt.Fprint(w, "callback body")
+	}))
+	defer destination.Close()
+
+	secret := []byte("callback-secret")
+	envelopes := make(chan *Envelope, 10)
+	failures := 1
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		payload, _ := ioutil.ReadAll(r.Body)
+		expected := SignCallback(secret, r.Header.Get(CallbackTimestampHeader), payload)
+		if r.Header.Get(CallbackSignatureHeader) != expected {
+			t.Errorf("Invalid signature %s", r.Header.Get(CallbackSignatureHeader))
+		}
+
+		var envelope Envelope
+		if err := json.Unmarshal(payload, &envelope); err != nil {
+			t.Error(err)
+		}
+		envelopes <- &envelope
+	}))
+	defer receiver.Close()
+
+	dir, err := ioutil.TempDir("", "gpm-callbacks-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	list := NewList()
+	list.Filename = "../proxy.list.example"
+	list.Load()
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	server := NewServer(logger, list)
+	server.callbacks = &CallbackSender{
+		client:        &http.Client{Timeout: time.Second},
+		secret:        secret,
+		attempts:      3,
+		backoff:       10 * time.Millisecond,
+		maxInlineBody: 20,
+		dir:           dir,
+		ttl:           time.Hour,
+		deliveries:    make(map[string]*Delivery),
+	}
+
+	r := chi.NewRouter()
+	r.With(server.ProxyGetRequest).Get("/get", server.ProxyGetResponse)
+	r.Get("/callbacks/{id}", server.GetDelivery)
+	r.Get("/callbacks/{id}/body", server.GetDeliveryBody)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	t.Run("result is posted after a retry", func(t *testing.T) {
+		uri := "/get?url=" + uriEncode(destination.URL+"/page") + "&callback_url=" + uriEncode(receiver.URL)
+		resp, body := testRequest(t, ts, "GET", uri, nil)
+
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("Expected request to be accepted, got %s", resp.Status)
+		}
+
+		var delivery Delivery
+		json.Unmarshal([]byte(body), &delivery)
+
+		var envelope *Envelope
+		select {
+		case envelope = <-envelopes:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Callback was never received")
+		}
+
+		if envelope.DeliveryID != delivery.ID || envelope.Body != "callback body" || envelope.StatusCode != http.StatusOK {
+			t.Fatalf("Unexpected envelope %+v", envelope.Result)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+		recorded, _ := server.callbacks.Get(delivery.ID)
+		if recorded.Status != DeliveryDelivered || len(recorded.Attempts) != 2 {
+			t.Fatalf("Expected delivery after 2 attempts, got %s after %d", recorded.Status, len(recorded.Attempts))
+		}
+	})
+
+	t.Run("big bodies are referenced", func(t *testing.T) {
+		uri := "/get?url=" + uriEncode(destination.URL+"/big") + "&callback_url=" + uriEncode(receiver.URL)
+		testRequest(t, ts, "GET", uri, nil)
+
+		var envelope *Envelope
+		select {
+		case envelope = <-envelopes:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Callback was never received")
+		}
+
+		if envelope.Body != "" || envelope.BodyRef == "" {
+			t.Fatalf("Expected body to be referenced, got %+v", envelope)
+		}
+
+		_, body := testRequest(t, ts, "GET", envelope.BodyRef, nil)
+		if body != "a callback body that is too big to be inlined" {
+			t.Fatalf("Unexpected referenced body %s", body)
+		}
+	})
+
+	t.Run("invalid callback url", func(t *testing.T) {
+		uri := "/get?url=" + uriEncode(destination.URL) + "&callback_url=" + uriEncode("/relative")
+		resp, _ := testRequest(t, ts, "GET", uri, nil)
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected bad request, got %s", resp.Status)
+		}
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"net/http"
 	"net/url"
+	"time"
 )
 
 // NewClient - creates new http client
@@ -12,9 +13,14 @@ func NewClient(transport *http.Transport) *http.Client {
 }
 
 // NewTransport - creates new transport
+// HTTP/2 is negotiated with TLS destinations unless GPM_HTTP2 disables it
 func NewTransport() *http.Transport {
 	tlsClientSkipVerify := &tls.Config{InsecureSkipVerify: true}
-	return &http.Transport{TLSClientConfig: tlsClientSkipVerify}
+	return &http.Transport{
+		TLSClientConfig:   tlsClientSkipVerify,
+		ForceAttemptHTTP2: http2Enabled(),
+		IdleConnTimeout:   90 * time.Second,
+	}
 }
 
 // NewProxiedTransport - creates new proxied transport
@@ -27,6 +33,7 @@ func NewProxiedTransport(proxy string) (*http.Transport, error) {
 	}
 
 	transport.Proxy = http.ProxyURL(proxyURL)
+	transport.ProxyConnectHeader = proxyHeader(proxyURL)
 
 	return transport, nil
 }
@@ -0,0 +1,297 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// SessionCookie - a cookie kept by a session jar
+type SessionCookie struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Domain string `json:"domain"`
+	Path   string `json:"path"`
+	// nil for session cookies
+	Expires  *time.Time `json:"expires,omitempty"`
+	Secure   bool       `json:"secure,omitempty"`
+	HttpOnly bool       `json:"http_only,omitempty"`
+	// the cookie is sent to its domain only, not to the subdomains
+	HostOnly bool `json:"host_only,omitempty"`
+
+	createdAt time.Time
+}
+
+func (c *SessionCookie) key() string {
+	return c.Domain + ";" + c.Path + ";" + c.Name
+}
+
+func (c *SessionCookie) expired(now time.Time) bool {
+	return c.Expires != nil && !c.Expires.After(now)
+}
+
+// matches - checks if the cookie must be sent with a request to the URL
+func (c *SessionCookie) matches(u *url.URL, now time.Time) bool {
+	if c.expired(now) || (c.Secure && u.Scheme != "https") {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if c.HostOnly && host != c.Domain {
+		return false
+	}
+	if !c.HostOnly && !domainMatch(host, c.Domain) {
+		return false
+	}
+
+	requestPath := u.EscapedPath()
+	if requestPath == "" {
+		requestPath = "/"
+	}
+
+	return requestPath == c.Path ||
+		(strings.HasPrefix(requestPath, c.Path) && (strings.HasSuffix(c.Path, "/") || requestPath[len(c.Path)] == '/'))
+}
+
+// CookieJar - cookie jar that can be inspected and exported
+// cookies beyond the limit push out the oldest ones
+type CookieJar struct {
+	mu         sync.Mutex
+	cookies    map[string]*SessionCookie
+	maxCookies int
+}
+
+// SetCookies - implements http.CookieJar
+func (j *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	for _, cookie := range cookies {
+		stored, ok := newSessionCookie(u, cookie, now)
+		if !ok {
+			continue
+		}
+
+		if stored.expired(now) {
+			delete(j.cookies, stored.key())
+			continue
+		}
+
+		if existing, ok := j.cookies[stored.key()]; ok {
+			stored.createdAt = existing.createdAt
+		}
+		j.cookies[stored.key()] = stored
+	}
+
+	j.trim()
+}
+
+// Cookies - implements http.CookieJar, longer paths go first
+func (j *CookieJar) Cookies(u *url.URL) []*http.Cookie {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	matching := make([]*SessionCookie, 0)
+	for key, cookie := range j.cookies {
+		if cookie.expired(now) {
+			delete(j.cookies, key)
+			continue
+		}
+
+		if cookie.matches(u, now) {
+			matching = append(matching, cookie)
+		}
+	}
+
+	sort.Slice(matching, func(i, k int) bool {
+		if len(matching[i].Path) != len(matching[k].Path) {
+			return len(matching[i].Path) > len(matching[k].Path)
+		}
+		return matching[i].createdAt.Before(matching[k].createdAt)
+	})
+
+	cookies := make([]*http.Cookie, len(matching))
+	for i, cookie := range matching {
+		cookies[i] = &http.Cookie{Name: cookie.Name, Value: cookie.Value}
+	}
+
+	return cookies
+}
+
+// List - the cookies of the jar ordered by domain, path and name
+func (j *CookieJar) List() []SessionCookie {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	cookies := make([]SessionCookie, 0, len(j.cookies))
+	for _, cookie := range j.cookies {
+		if !cookie.expired(now) {
+			cookies = append(cookies, *cookie)
+		}
+	}
+
+	sort.Slice(cookies, func(i, k int) bool {
+		return cookies[i].key() < cookies[k].key()
+	})
+
+	return cookies
+}
+
+// Len - number of cookies in the jar
+func (j *CookieJar) Len() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return len(j.cookies)
+}
+
+// WriteNetscape - export the cookies in the cookies.txt format understood by curl and wget
+func (j *CookieJar) WriteNetscape(w io.Writer) error {
+	if _, err := io.WriteString(w, "# Netscape HTTP Cookie File\n"); err != nil {
+		return err
+	}
+
+	for _, cookie := range j.List() {
+		domain := cookie.Domain
+		if !cookie.HostOnly {
+			domain = "." + domain
+		}
+		if cookie.HttpOnly {
+			domain = "#HttpOnly_" + domain
+		}
+
+		var expires int64
+		if cookie.Expires != nil {
+			expires = cookie.Expires.Unix()
+		}
+
+		_, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			domain, netscapeBool(!cookie.HostOnly), cookie.Path, netscapeBool(cookie.Secure), expires, cookie.Name, cookie.Value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// clone - a jar with copies of the cookies
+func (j *CookieJar) clone() *CookieJar {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	clone := NewCookieJar(j.maxCookies)
+	for key, cookie := range j.cookies {
+		copied := *cookie
+		clone.cookies[key] = &copied
+	}
+
+	return clone
+}
+
+// trim - drop the oldest cookies beyond the limit
+func (j *CookieJar) trim() {
+	if j.maxCookies <= 0 || len(j.cookies) <= j.maxCookies {
+		return
+	}
+
+	cookies := make([]*SessionCookie, 0, len(j.cookies))
+	for _, cookie := range j.cookies {
+		cookies = append(cookies, cookie)
+	}
+
+	sort.Slice(cookies, func(i, k int) bool {
+		return cookies[i].createdAt.Before(cookies[k].createdAt)
+	})
+
+	for _, cookie := range cookies[:len(cookies)-j.maxCookies] {
+		delete(j.cookies, cookie.key())
+	}
+}
+
+// NewCookieJar - creates an empty cookie jar, maxCookies <= 0 means no limit
+func NewCookieJar(maxCookies int) *CookieJar {
+	return &CookieJar{cookies: make(map[string]*SessionCookie), maxCookies: maxCookies}
+}
+
+// newSessionCookie - the cookie as it is stored for the URL that set it
+// cookies for other domains or for public suffixes are rejected
+func newSessionCookie(u *url.URL, cookie *http.Cookie, now time.Time) (*SessionCookie, bool) {
+	host := strings.ToLower(u.Hostname())
+	stored := &SessionCookie{
+		Name:      cookie.Name,
+		Value:     cookie.Value,
+		Domain:    host,
+		Path:      cookie.Path,
+		Secure:    cookie.Secure,
+		HttpOnly:  cookie.HttpOnly,
+		HostOnly:  true,
+		createdAt: now,
+	}
+
+	// a domain attribute equal to the host makes the cookie a domain cookie as well,
+	// except for addresses and public suffixes which only keep cookies of their own (RFC 6265 5.3)
+	if domain := strings.TrimPrefix(strings.ToLower(cookie.Domain), "."); domain != "" {
+		if !domainMatch(host, domain) || (net.ParseIP(host) != nil && domain != host) {
+			return nil, false
+		}
+
+		suffix, _ := publicsuffix.PublicSuffix(domain)
+		if suffix == domain && domain != host {
+			return nil, false
+		}
+
+		if net.ParseIP(host) == nil && suffix != domain {
+			stored.Domain = domain
+			stored.HostOnly = false
+		}
+	}
+
+	if stored.Path == "" || stored.Path[0] != '/' {
+		stored.Path = defaultCookiePath(u.EscapedPath())
+	}
+
+	switch {
+	case cookie.MaxAge < 0:
+		stored.Expires = &now
+	case cookie.MaxAge > 0:
+		expires := now.Add(time.Duration(cookie.MaxAge) * time.Second)
+		stored.Expires = &expires
+	case !cookie.Expires.IsZero():
+		expires := cookie.Expires
+		stored.Expires = &expires
+	}
+
+	return stored, true
+}
+
+// defaultCookiePath - directory of the request path as defined by RFC 6265
+func defaultCookiePath(requestPath string) string {
+	i := strings.LastIndex(requestPath, "/")
+	if i <= 0 {
+		return "/"
+	}
+
+	return requestPath[:i]
+}
+
+func domainMatch(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+func netscapeBool(b bool) string {
+	if b {
+		return "TRUE"
+	}
+	return "FALSE"
+}
@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/transform"
+)
+
+// acceptedEncodings - content encodings requested when bodies are decoded
+const acceptedEncodings = "gzip, deflate, br, zstd"
+
+// CharsetHeader - original charset of a body transcoded to UTF-8
+const CharsetHeader = "X-GPM-Charset"
+
+// decodedBody - decoded body closing every reader it was built from
+type decodedBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (db *decodedBody) Close() error {
+	var err error
+	for i := len(db.closers) - 1; i >= 0; i-- {
+		if closeErr := db.closers[i].Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// decodeResponse - decompress the body and transcode text to UTF-8
+// headers are rewritten to describe the decoded body
+// the decoded body is limited as well, so a small compressed body can't blow up
+func decodeResponse(response *http.Response, limit int64) error {
+	body := &decodedBody{Reader: response.Body, closers: []io.Closer{response.Body}}
+
+	encodings := strings.Split(response.Header.Get("Content-Encoding"), ",")
+	// encodings are listed in the order they were applied
+	for i := len(encodings) - 1; i >= 0; i-- {
+		encoding := strings.ToLower(strings.TrimSpace(encodings[i]))
+		if encoding == "" || encoding == "identity" {
+			continue
+		}
+
+		reader, err := decompress(encoding, body.Reader)
+		if err != nil {
+			body.Close()
+			return fmt.Errorf("could not decode %s body from %s: %v", encoding, response.Request.URL, err)
+		}
+
+		body.Reader = reader
+		if closer, ok := reader.(io.Closer); ok {
+			body.closers = append(body.closers, closer)
+		}
+	}
+
+	response.Header.Del("Content-Encoding")
+	response.Header.Del("Content-Length")
+	response.ContentLength = -1
+
+	contentType := response.Header.Get("Content-Type")
+	if isText(contentType) {
+		buffered := bufio.NewReader(body.Reader)
+		// BOM and <meta> tags are looked for at the beginning of the body
+		prefix, _ := buffered.Peek(1024)
+		encoding, name, certain := charset.DetermineEncoding(prefix, contentType)
+
+		body.Reader = buffered
+		if !certain {
+			// without a declared charset the guess made from the prefix must not garble
+			// UTF-8 text further in the body, JSON is UTF-8 by definition
+			if isJSON(contentType) {
+				name = "utf-8"
+			} else {
+				text, err := ioutil.ReadAll(limitReader(buffered, limit))
+				if err != nil {
+					body.Close()
+					return fmt.Errorf("could not read body from %s: %v", response.Request.URL, err)
+				}
+				if limit > 0 && int64(len(text)) > limit {
+					body.Close()
+					return &BodyTooLargeError{URL: response.Request.URL.String(), Limit: limit}
+				}
+
+				body.Reader = bytes.NewReader(text)
+				if utf8.Valid(text) {
+					name = "utf-8"
+				}
+			}
+		}
+
+		if name != "utf-8" {
+			body.Reader = transform.NewReader(body.Reader, encoding.NewDecoder())
+			response.Header.Set(CharsetHeader, name)
+		}
+
+		response.Header.Set("Content-Type", withCharset(contentType, "utf-8"))
+	}
+
+	response.Body = body
+	if limit > 0 {
+		response.Body = newLimitedBody(body, response.Request.URL.String(), limit)
+	}
+
+	return nil
+}
+
+// decompress - reader decoding the content encoding
+func decompress(encoding string, r io.Reader) (io.Reader, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		// deflate is supposed to be zlib wrapped, some servers send it raw
+		buffered := bufio.NewReader(r)
+		header, err := buffered.Peek(2)
+		if err == nil && isZlibHeader(header) {
+			return zlib.NewReader(buffered)
+		}
+		return flate.NewReader(buffered), nil
+	case "br":
+		return brotli.NewReader(r), nil
+	case "zstd":
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+
+	return nil, fmt.Errorf("unsupported content encoding")
+}
+
+func isZlibHeader(header []byte) bool {
+	return header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0
+}
+
+// isText - checks whether the media type carries text that has a charset
+func isText(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		mediaType == "application/json",
+		mediaType == "application/javascript",
+		mediaType == "application/xml",
+		strings.HasSuffix(mediaType, "+xml"),
+		strings.HasSuffix(mediaType, "+json"):
+		return true
+	}
+
+	return false
+}
+
+// isJSON - checks whether the media type is JSON
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// limitReader - reader stopping a byte past the limit, so going over it can be noticed
+func limitReader(r io.Reader, limit int64) io.Reader {
+	if limit <= 0 {
+		return r
+	}
+
+	return io.LimitReader(r, limit+1)
+}
+
+// withCharset - content type with the charset parameter replaced
+func withCharset(contentType, name string) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+
+	params["charset"] = name
+
+	return mime.FormatMediaType(mediaType, params)
+}
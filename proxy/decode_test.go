@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/go-chi/chi"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/text/encoding/charmap"
+)
+
+func TestDecodedResponses(t *testing.T) {
+	const text = "Привет, мир"
+
+	compress := func(encoding string, body []byte) []byte {
+		var buf bytes.Buffer
+		var w io.WriteCloser
+
+		switch encoding {
+		case "gzip":
+			w = gzip.NewWriter(&buf)
+		case "deflate":
+			w = zlib.NewWriter(&buf)
+		case "br":
+			w = brotli.NewWriter(&buf)
+		case "zstd":
+			w, _ = zstd.NewWriter(&buf)
+		}
+
+		w.Write(body)
+		w.Close()
+
+		return buf.Bytes()
+	}
+
+	windows1251, _ := charmap.Windows1251.NewEncoder().String(text)
+
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/header-charset":
+			w.Header().Set("Content-Type", "text/plain; charset=windows-1251")
+			w.Write([]byte(windows1251))
+		case "/meta-charset":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<html><head><meta charset="windows-1251"></head><body>` + windows1251 + `</body></html>`))
+		case "/late-utf8":
+			// the first kilobyte is ASCII and nothing declares the charset
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(strings.Repeat("a", 2048) + text))
+		case "/json":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"text": "` + text + `"}`))
+		case "/binary":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(compress("gzip", []byte{0xff, 0xfe, 0x00}))
+		default:
+			encoding := r.URL.Path[1:]
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Content-Encoding", encoding)
+			w.Write(compress(encoding, []byte(text)))
+		}
+	}))
+	defer destination.Close()
+
+	list := NewList()
+	list.Filename = "../proxy.list.example"
+	list.Load()
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	server := NewServer(logger, list)
+
+	r := chi.NewRouter()
+	r.Use(server.ProxyGetRequest)
+	r.Get("/get", server.ProxyGetResponse)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	t.Run("content encodings", func(t *testing.T) {
+		for _, encoding := range []string{"gzip", "deflate", "br", "zstd"} {
+			req, _ := http.NewRequest("GET", ts.URL+"/get?decode=1&url="+uriEncode(destination.URL+"/"+encoding), nil)
+			// the client must get the decoded body even though it accepts encoded ones
+			req.Header.Set("Accept-Encoding", "identity")
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if string(body) != text {
+				t.Fatalf("%s: expected decoded body, got %q", encoding, body)
+			}
+
+			if resp.Header.Get("Content-Encoding") != "" {
+				t.Fatalf("%s: expected Content-Encoding to be removed", encoding)
+			}
+		}
+	})
+
+	t.Run("charsets", func(t *testing.T) {
+		resp, body := testRequest(t, ts, "GET", "/get?decode=1&url="+uriEncode(destination.URL+"/header-charset"), nil)
+		if body != text {
+			t.Fatalf("Expected transcoded body, got %q", body)
+		}
+
+		if resp.Header.Get("Content-Type") != "text/plain; charset=utf-8" || resp.Header.Get(CharsetHeader) != "windows-1251" {
+			t.Fatalf("Unexpected headers %v", resp.Header)
+		}
+
+		_, body = testRequest(t, ts, "GET", "/get?decode=1&url="+uriEncode(destination.URL+"/meta-charset"), nil)
+		if !bytes.Contains([]byte(body), []byte(text)) {
+			t.Fatalf("Expected charset from meta tag to be used, got %q", body)
+		}
+	})
+
+	t.Run("undeclared charsets default to utf-8", func(t *testing.T) {
+		for _, path := range []string{"/late-utf8", "/json"} {
+			resp, body := testRequest(t, ts, "GET", "/get?decode=1&url="+uriEncode(destination.URL+path), nil)
+			if !strings.Contains(body, text) || resp.Header.Get(CharsetHeader) != "" {
+				t.Fatalf("%s: expected the body to be left as UTF-8, got %q %v", path, body, resp.Header)
+			}
+		}
+	})
+
+	t.Run("binary bodies are only decompressed", func(t *testing.T) {
+		_, body := testRequest(t, ts, "GET", "/get?decode=1&url="+uriEncode(destination.URL+"/binary"), nil)
+		if body != string([]byte{0xff, 0xfe, 0x00}) {
+			t.Fatalf("Expected binary body as is, got %q", body)
+		}
+	})
+
+	t.Run("bodies are left alone without the option", func(t *testing.T) {
+		_, body := testRequest(t, ts, "GET", "/get?url="+uriEncode(destination.URL+"/header-charset"), nil)
+		if body != windows1251 {
+			t.Fatalf("Expected original body, got %q", body)
+		}
+	})
+}
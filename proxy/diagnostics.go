@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptrace"
+	"sort"
+	"time"
+)
+
+// DiagnosticsHeader - response header carrying the diagnostics as JSON
+const DiagnosticsHeader = "X-GPM-Diagnostics"
+
+// FinalURLHeader - response header carrying the URL the response came from after redirects
+const FinalURLHeader = "X-GPM-Final-URL"
+
+// Redirect - a redirect followed by an attempt
+type Redirect struct {
+	URL      string `json:"url"`
+	Status   int    `json:"status"`
+	Location string `json:"location"`
+	// seconds since the attempt started
+	Elapsed float64 `json:"elapsed"`
+	// proxy the next hop went through when proxies rotate along the chain
+	Proxy string `json:"proxy,omitempty"`
+}
+
+// Attempt - one of the concurrent requests of a multiplexer session
+type Attempt struct {
+	Index int `json:"index"`
+	// proxy with credentials removed, `direct` for the request made without one
+	Proxy string `json:"proxy"`
+	// header profile the request was made with
+	Profile string `json:"profile,omitempty"`
+	// tag of the proxy the geo targeted request picked it by, e.g. `us`
+	Tag string `json:"tag,omitempty"`
+	// ClientHello profile of TLS connections
+	TLS string `json:"tls,omitempty"`
+	// protocol of the response, e.g. `HTTP/2.0`
+	Protocol string `json:"protocol,omitempty"`
+	// seconds spent resolving hosts, 0 when the connection was reused
+	DNS float64 `json:"dns,omitempty"`
+	// address the connection was made to, the proxy for proxied attempts
+	Address string `json:"address,omitempty"`
+	Status  int    `json:"status,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// seconds until the response headers or the error arrived
+	Elapsed   float64    `json:"elapsed,omitempty"`
+	Redirects []Redirect `json:"redirects,omitempty"`
+	// hops of the proxy chain of the attempt's connection, none when the connection was reused
+	Hops []Hop `json:"hops,omitempty"`
+
+	proxy     string
+	startedAt time.Time
+	// cookies set during the attempt when it belongs to a session
+	jar *attemptJar
+}
+
+// Diagnostics - what happened during a multiplexer session
+type Diagnostics struct {
+	Session int64 `json:"session"`
+	// index of the attempt whose response won, 0 if none did
+	Winner int `json:"winner,omitempty"`
+	// tag of the winner's proxy when the request is geo targeted
+	Tag      string    `json:"tag,omitempty"`
+	Elapsed  float64   `json:"elapsed"`
+	FinalURL string    `json:"final_url,omitempty"`
+	Attempts []Attempt `json:"attempts"`
+}
+
+// Header - diagnostics encoded for DiagnosticsHeader
+func (d *Diagnostics) Header() string {
+	encoded, _ := json.Marshal(d)
+	return string(encoded)
+}
+
+// startAttempt - register the attempt along with the proxy it goes through
+func (m *Multiplexer) startAttempt(index int, proxy string) {
+	m.doneMu.Lock()
+	defer m.doneMu.Unlock()
+
+	m.attempts[index] = &Attempt{
+		Index:     index,
+		Proxy:     redactProxy(proxy),
+		proxy:     proxy,
+		startedAt: time.Now(),
+	}
+}
+
+// recordAttempt - update the attempt with the index
+func (m *Multiplexer) recordAttempt(index int, record func(attempt *Attempt)) {
+	m.doneMu.Lock()
+	defer m.doneMu.Unlock()
+
+	if attempt, ok := m.attempts[index]; ok {
+		record(attempt)
+	}
+}
+
+// attemptTrace - records the DNS timing and the address of the connections of the attempt
+func (m *Multiplexer) attemptTrace(index int) *httptrace.ClientTrace {
+	var dnsStartedAt time.Time
+
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			dnsStartedAt = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			elapsed := time.Since(dnsStartedAt).Seconds()
+			m.recordAttempt(index, func(attempt *Attempt) {
+				attempt.DNS += elapsed
+			})
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			address := info.Conn.RemoteAddr().String()
+			m.recordAttempt(index, func(attempt *Attempt) {
+				attempt.Address = address
+			})
+		},
+	}
+}
+
+// hopTrace - records the hops of the proxy chain the connections of the attempt are dialled through
+func (m *Multiplexer) hopTrace(ctx context.Context, index int) context.Context {
+	return withHopTrace(ctx, func(hop Hop) {
+		m.recordAttempt(index, func(attempt *Attempt) {
+			attempt.Hops = append(attempt.Hops, hop)
+		})
+	})
+}
+
+// attemptFailed - record the error of the attempt and report it
+func (m *Multiplexer) attemptFailed(index int, err error) {
+	m.recordAttempt(index, func(attempt *Attempt) {
+		attempt.Error = err.Error()
+		if attempt.Elapsed == 0 {
+			attempt.Elapsed = time.Since(attempt.startedAt).Seconds()
+		}
+	})
+
+	m.errorOccurred(err)
+}
+
+// Diagnostics - snapshot of the attempts made so far
+func (m *Multiplexer) Diagnostics() *Diagnostics {
+	m.doneMu.Lock()
+	defer m.doneMu.Unlock()
+
+	diagnostics := &Diagnostics{
+		Session:  m.session,
+		Winner:   m.winner,
+		Elapsed:  m.GetElapsedTime().Seconds(),
+		Attempts: make([]Attempt, 0, len(m.attempts)),
+	}
+
+	if winner, ok := m.attempts[m.winner]; ok {
+		diagnostics.Tag = winner.Tag
+	}
+
+	for _, attempt := range m.attempts {
+		snapshot := *attempt
+		snapshot.jar = nil
+		snapshot.Redirects = append([]Redirect(nil), attempt.Redirects...)
+		diagnostics.Attempts = append(diagnostics.Attempts, snapshot)
+	}
+
+	sort.Slice(diagnostics.Attempts, func(i, j int) bool {
+		return diagnostics.Attempts[i].Index < diagnostics.Attempts[j].Index
+	})
+
+	return diagnostics
+}
@@ -0,0 +1,388 @@
+package proxy
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DigestTrailer - trailer carrying the digest of the downloaded body
+const DigestTrailer = "X-GPM-Digest"
+
+// minChunkSize - files are not split into chunks smaller than this
+const minChunkSize = 1 << 20
+
+// download - a file fetched with range requests
+type download struct {
+	spec *RequestSpec
+	// size of the file
+	total int64
+	// ETag or Last-Modified sent with If-Range so a changed file is not resumed
+	validator string
+}
+
+// ProxyDownload - download a file streaming it to the client
+// a broken transfer is resumed from the last received byte through another proxy
+// and the file may be fetched in parallel chunks when the destination supports ranges
+func (s *Server) ProxyDownload(w http.ResponseWriter, r *http.Request) {
+	destinationURL, err := ParseURLParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	options, err := ParseRequestOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if options.CallbackURL != "" {
+		http.Error(w, "[callback_url] is not supported for downloads", http.StatusBadRequest)
+		return
+	}
+
+	chunks, err := parseIntParam(r, "chunks")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	checksumParam, _ := ExtractQueryParam(r, "checksum")
+	sum, err := parseChecksum(checksumParam)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	spec := &RequestSpec{Method: http.MethodGet, URL: destinationURL, Options: *options}
+	// bodies are streamed so a stalled transfer is detected and resumed
+	spec.Options.Stream = true
+
+	if err := s.checkRobots(r, spec.URL); err != nil {
+		writeCodedError(w, err)
+		return
+	}
+
+	probe := s.multiplex(r, spec, http.Header{"Range": {"bytes=0-"}})
+	if !probe.IsValid() {
+		s.proxyResponse(w, probe)
+		return
+	}
+
+	start, _, total, ranged := parseContentRange(probe)
+
+	copyHeaders(w.Header(), probe.GetHeader())
+	w.Header().Del("Content-Range")
+	w.Header().Set("Trailer", DigestTrailer)
+	w.WriteHeader(http.StatusOK)
+
+	out := &downloadWriter{w: w, hash: sum.hash}
+
+	if !ranged || start != 0 || total < 0 {
+		// the destination can't resume the download, the body is passed as is
+		_, err = io.Copy(out, probe.GetBody())
+		probe.CloseBody()
+	} else {
+		dl := &download{spec: spec, total: total, validator: rangeValidator(probe.GetHeader())}
+		err = s.downloadChunks(r, dl, probe, chunks, out)
+		if err == nil && out.written != total {
+			err = fmt.Errorf("expected %d bytes from %s, received %d", total, spec.URL, out.written)
+		}
+	}
+
+	if err == nil {
+		err = sum.verify()
+	}
+
+	w.Header().Set(DigestTrailer, sum.digest())
+
+	if err != nil {
+		s.logger.Printf("Download of %s failed after %d bytes %v", spec.URL, out.written, err)
+		// the client must not mistake a broken download for a complete one
+		panic(http.ErrAbortHandler)
+	}
+
+	s.logger.Printf("Downloaded %d bytes of %s", out.written, spec.URL)
+}
+
+// downloadChunks - split the file into chunks fetched in parallel, the first chunk
+// is read from the probe response and streamed right away, the rest are kept
+// in temporary files until it is their turn
+func (s *Server) downloadChunks(r *http.Request, dl *download, probe *FirstResponse, chunks int, w io.Writer) error {
+	if chunks > getDownloadMaxChunks() {
+		chunks = getDownloadMaxChunks()
+	}
+
+	if max := int(dl.total / minChunkSize); chunks > max {
+		chunks = max
+	}
+
+	if chunks <= 1 {
+		return s.copyRange(r, dl, probe, 0, dl.total-1, w)
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	size := dl.total / int64(chunks)
+	files := make([]*os.File, chunks)
+	done := make([]chan error, chunks)
+
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+				os.Remove(f.Name())
+			}
+		}
+	}()
+
+	for i := 1; i < chunks; i++ {
+		f, err := ioutil.TempFile("", "gpm-chunk")
+		if err != nil {
+			probe.CloseBody()
+			return err
+		}
+
+		start, end := int64(i)*size, int64(i+1)*size-1
+		if i == chunks-1 {
+			end = dl.total - 1
+		}
+
+		files[i] = f
+		done[i] = make(chan error, 1)
+
+		wg.Add(1)
+		go func(i int, start, end int64) {
+			defer wg.Done()
+			done[i] <- s.copyRange(r, dl, nil, start, end, files[i])
+		}(i, start, end)
+	}
+
+	if err := s.copyRange(r, dl, probe, 0, size-1, w); err != nil {
+		return err
+	}
+
+	for i := 1; i < chunks; i++ {
+		if err := <-done[i]; err != nil {
+			return err
+		}
+
+		if _, err := files[i].Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(w, files[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyRange - copy the bytes from start to end inclusive into w
+// response is an already open response starting at start, may be nil
+// every time the transfer breaks it is resumed through a proxy that was not used yet
+func (s *Server) copyRange(r *http.Request, dl *download, response *FirstResponse, start, end int64, w io.Writer) error {
+	offset := start
+	exclude := make(map[string]bool)
+
+	for resumes := 0; ; resumes++ {
+		if response == nil {
+			response = s.requestRange(r, dl, offset, end, exclude)
+		}
+
+		var err error
+		if response.IsValid() {
+			var n int64
+			n, err = io.Copy(w, io.LimitReader(response.GetBody(), end-offset+1))
+			response.CloseBody()
+			offset += n
+
+			if offset > end {
+				return nil
+			}
+
+			if err == nil {
+				err = fmt.Errorf("body of %s ended at byte %d instead of %d", dl.spec.URL, offset, end+1)
+			}
+
+			exclude[response.proxy] = true
+		} else {
+			err = response.GetError()
+		}
+
+		if _, ok := err.(*rangeError); ok || resumes >= getDownloadResumes() || r.Context().Err() != nil {
+			return err
+		}
+
+		s.logger.Printf("Resuming download of %s from byte %d after %v", dl.spec.URL, offset, err)
+		response = nil
+	}
+}
+
+// requestRange - multiplex a range request avoiding the excluded proxies
+func (s *Server) requestRange(r *http.Request, dl *download, start, end int64, exclude map[string]bool) *FirstResponse {
+	spec := *dl.spec
+	spec.exclude = exclude
+
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", start, end)}}
+	if dl.validator != "" {
+		header.Set("If-Range", dl.validator)
+	}
+
+	response := s.multiplex(r, &spec, header)
+	if !response.IsValid() {
+		return response
+	}
+
+	if rangeStart, _, _, ok := parseContentRange(response); !ok || rangeStart != start {
+		response.CloseBody()
+		// the destination ignored the range, most likely the file has changed
+		return NewInvalidFirstResponse(
+			&rangeError{fmt.Sprintf("%s did not resume the download from byte %d", dl.spec.URL, start)},
+			false, response.elapsed)
+	}
+
+	return response
+}
+
+// rangeError - the destination can't continue the download
+type rangeError struct {
+	msg string
+}
+
+func (e *rangeError) Error() string {
+	return e.msg
+}
+
+// parseContentRange - parse Content-Range of a partial response
+// total is -1 when the size of the file is unknown
+func parseContentRange(response *FirstResponse) (start, end, total int64, ok bool) {
+	if response.GetStatusCode() != http.StatusPartialContent {
+		return 0, 0, 0, false
+	}
+
+	value := strings.TrimPrefix(response.GetHeader().Get("Content-Range"), "bytes ")
+	slash := strings.Index(value, "/")
+	dash := strings.Index(value, "-")
+	if slash < 0 || dash < 0 || dash > slash {
+		return 0, 0, 0, false
+	}
+
+	start, err := strconv.ParseInt(value[:dash], 10, 64)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+
+	end, err = strconv.ParseInt(value[dash+1:slash], 10, 64)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+
+	total = -1
+	if value[slash+1:] != "*" {
+		if total, err = strconv.ParseInt(value[slash+1:], 10, 64); err != nil {
+			return 0, 0, 0, false
+		}
+	}
+
+	return start, end, total, true
+}
+
+// rangeValidator - validator for If-Range, weak ETags can't be used
+func rangeValidator(header http.Header) string {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+
+	return header.Get("Last-Modified")
+}
+
+// downloadWriter - counts and hashes the bytes sent to the client
+type downloadWriter struct {
+	w       http.ResponseWriter
+	hash    hash.Hash
+	written int64
+}
+
+func (dw *downloadWriter) Write(p []byte) (int, error) {
+	n, err := dw.w.Write(p)
+	dw.hash.Write(p[:n])
+	dw.written += int64(n)
+
+	if flusher, ok := dw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	return n, err
+}
+
+// checksum - digest of the downloaded body and the one it is expected to match
+type checksum struct {
+	algorithm string
+	expected  string
+	hash      hash.Hash
+}
+
+// parseChecksum - parse the expected checksum in the algorithm:hex form
+// sha256 digest is computed when none is expected
+func parseChecksum(value string) (*checksum, error) {
+	if value == "" {
+		return &checksum{algorithm: "sha256", hash: sha256.New()}, nil
+	}
+
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("[checksum] query param must be in the algorithm:hex form")
+	}
+
+	sum := &checksum{algorithm: strings.ToLower(parts[0]), expected: strings.ToLower(parts[1])}
+
+	switch sum.algorithm {
+	case "md5":
+		sum.hash = md5.New()
+	case "sha1":
+		sum.hash = sha1.New()
+	case "sha256":
+		sum.hash = sha256.New()
+	default:
+		return nil, fmt.Errorf("[checksum] algorithm must be one of md5, sha1 or sha256")
+	}
+
+	return sum, nil
+}
+
+func (c *checksum) digest() string {
+	return c.algorithm + "=" + hex.EncodeToString(c.hash.Sum(nil))
+}
+
+// verify - checks the body matches the expected checksum if there is one
+func (c *checksum) verify() error {
+	if c.expected == "" {
+		return nil
+	}
+
+	if actual := hex.EncodeToString(c.hash.Sum(nil)); actual != c.expected {
+		return fmt.Errorf("%s checksum mismatch: expected %s, got %s", c.algorithm, c.expected, actual)
+	}
+
+	return nil
+}
@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+func TestProxyDownload(t *testing.T) {
+	data := make([]byte, 3*minChunkSize+123)
+	rand.Read(data)
+
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+
+	var mu sync.Mutex
+	var ranges []string
+
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+
+		if r.URL.Path == "/plain" {
+			w.Write(data)
+			return
+		}
+
+		// a transfer from the very beginning breaks in the middle
+		if r.URL.Path == "/broken" && strings.HasPrefix(r.Header.Get("Range"), "bytes=0-") {
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(data)-1, len(data)))
+			w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[:len(data)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(data))
+	}))
+	defer destination.Close()
+
+	// forwards requests so a resumed transfer can go through it
+	fakeProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.RequestURI = ""
+		resp, err := http.DefaultTransport.RoundTrip(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		copyHeaders(w.Header(), resp.Header)
+		w.Header().Set("Content-Length", resp.Header.Get("Content-Length"))
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	defer fakeProxy.Close()
+
+	list := NewList()
+	list.Add(fakeProxy.URL)
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	server := NewServer(logger, list)
+
+	r := chi.NewRouter()
+	r.Get("/download", server.ProxyDownload)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	download := func(t *testing.T, query string) (*http.Response, []byte, error) {
+		resp, err := http.Get(ts.URL + "/download?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		return resp, body, err
+	}
+
+	reset := func() {
+		mu.Lock()
+		ranges = nil
+		mu.Unlock()
+	}
+
+	t.Run("broken transfer is resumed", func(t *testing.T) {
+		reset()
+		resp, body, err := download(t, "checksum=sha256:"+digest+"&url="+uriEncode(destination.URL+"/broken"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(body, data) {
+			t.Fatalf("Expected %d bytes of data, got %d", len(data), len(body))
+		}
+
+		if resp.Trailer.Get(DigestTrailer) != "sha256="+digest {
+			t.Fatalf("Unexpected digest %s", resp.Trailer.Get(DigestTrailer))
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		resumed := false
+		for _, r := range ranges {
+			resumed = resumed || r == fmt.Sprintf("bytes=%d-%d", len(data)/2, len(data)-1)
+		}
+
+		if !resumed {
+			t.Fatalf("Expected the download to be resumed from the middle, got ranges %v", ranges)
+		}
+	})
+
+	t.Run("file is split into chunks", func(t *testing.T) {
+		reset()
+		_, body, err := download(t, "chunks=3&url="+uriEncode(destination.URL+"/chunked"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(body, data) {
+			t.Fatalf("Expected %d bytes of data, got %d", len(data), len(body))
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		for _, expected := range []string{
+			fmt.Sprintf("bytes=%d-%d", len(data)/3, 2*(len(data)/3)-1),
+			fmt.Sprintf("bytes=%d-%d", 2*(len(data)/3), len(data)-1),
+		} {
+			found := false
+			for _, r := range ranges {
+				found = found || r == expected
+			}
+
+			if !found {
+				t.Fatalf("Expected chunk %s to be requested, got %v", expected, ranges)
+			}
+		}
+	})
+
+	t.Run("destination without ranges", func(t *testing.T) {
+		_, body, err := download(t, "url="+uriEncode(destination.URL+"/plain"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(body, data) {
+			t.Fatalf("Expected %d bytes of data, got %d", len(data), len(body))
+		}
+	})
+
+	t.Run("checksum mismatch breaks the download", func(t *testing.T) {
+		_, _, err := download(t, "checksum=md5:00&url="+uriEncode(destination.URL+"/chunked"))
+		if err == nil {
+			t.Fatal("Expected download with wrong checksum to fail")
+		}
+	})
+
+	t.Run("invalid checksum", func(t *testing.T) {
+		resp, _ := testRequest(t, ts, "GET", "/download?checksum=crc:00&url="+uriEncode(destination.URL), nil)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400, got %d", resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrorCodeHeader - response header carrying a machine readable error code
+const ErrorCodeHeader = "X-GPM-Error"
+
+// Error codes sent back to the client in ErrorCodeHeader
+const (
+	// destination URL is disallowed by the robots.txt of the host
+	ErrorCodeRobotsDisallowed = "robots_disallowed"
+	// robots.txt of the host could not be retrieved
+	ErrorCodeRobotsUnreachable = "robots_unreachable"
+	// response bodies stopped sending data for longer than the idle timeout
+	ErrorCodeStreamStalled = "stream_stalled"
+	// response body exceeds the size limit
+	ErrorCodeBodyTooLarge = "body_too_large"
+	// content type of the response is not allowed
+	ErrorCodeContentType = "content_type_not_allowed"
+	// a required value could not be extracted from the response
+	ErrorCodeExtraction = "extraction_failed"
+	// the redirect chain is longer than allowed
+	ErrorCodeTooManyRedirects = "too_many_redirects"
+	// the host of the destination could not be resolved
+	ErrorCodeDNS = "dns_failed"
+	// no proxy of the requested country or region is available
+	ErrorCodeGeo = "geo_unavailable"
+	// the proxy list is empty
+	ErrorCodeNoProxies = "no_proxies"
+)
+
+// StatusError - an error status received from the destination
+type StatusError struct {
+	StatusCode int
+	URL        string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("error status %d received from %s", e.StatusCode, e.URL)
+}
+
+// CodedError - an error along with its code and the status it is reported with
+type CodedError struct {
+	// one of the error codes, may be empty
+	Code   string
+	Status int
+	Err    error
+}
+
+func (e *CodedError) Error() string {
+	return e.Err.Error()
+}
+
+// noProxiesError - attempts need a proxy but the list is empty
+func noProxiesError() *CodedError {
+	return &CodedError{
+		Code:   ErrorCodeNoProxies,
+		Status: http.StatusBadGateway,
+		Err:    errors.New("no proxy is available"),
+	}
+}
+
+// errorCode - code of the error if it has one
+// errors wrapped along the way keep their code
+func errorCode(err error) string {
+	var codedErr *CodedError
+	var stallErr *StallError
+	var tooLargeErr *BodyTooLargeError
+	var contentTypeErr *ContentTypeError
+	var extractionErr *ExtractionError
+	var redirectsErr *TooManyRedirectsError
+	var dnsErr *DNSError
+
+	switch {
+	case errors.As(err, &codedErr):
+		return codedErr.Code
+	case errors.As(err, &stallErr):
+		return ErrorCodeStreamStalled
+	case errors.As(err, &tooLargeErr):
+		return ErrorCodeBodyTooLarge
+	case errors.As(err, &contentTypeErr):
+		return ErrorCodeContentType
+	case errors.As(err, &extractionErr):
+		return ErrorCodeExtraction
+	case errors.As(err, &redirectsErr):
+		return ErrorCodeTooManyRedirects
+	case errors.As(err, &dnsErr):
+		return ErrorCodeDNS
+	}
+
+	return ""
+}
+
+// writeCodedError - writes an error response along with the error code header
+func writeCodedError(w http.ResponseWriter, err *CodedError) {
+	if err.Code != "" {
+		w.Header().Set(ErrorCodeHeader, err.Code)
+	}
+	http.Error(w, err.Error(), err.Status)
+}
@@ -0,0 +1,301 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+	"github.com/antchfx/htmlquery"
+	"github.com/antchfx/xpath"
+	"github.com/ohler55/ojg/jp"
+	"github.com/ohler55/ojg/oj"
+	"golang.org/x/net/html"
+)
+
+// Extractor types
+const (
+	ExtractCSS   = "css"
+	ExtractXPath = "xpath"
+	ExtractJSON  = "json"
+)
+
+// ExtractionError - a required value is missing from the response
+type ExtractionError struct {
+	URL  string
+	Name string
+}
+
+func (e *ExtractionError) Error() string {
+	return fmt.Sprintf("required value %s was not found in the response from %s", e.Name, e.URL)
+}
+
+// Extractor - extracts a value from a response body
+// `"css:.price"` is a shorthand for `{"type": "css", "expr": ".price"}`
+type Extractor struct {
+	// css, xpath or json
+	Type string `json:"type"`
+	// CSS selector, XPath or JSONPath expression
+	Expr string `json:"expr"`
+	// attribute of the matched element instead of its text, css and xpath only
+	Attr string `json:"attr,omitempty"`
+	// every match as a list instead of the first one
+	All bool `json:"all,omitempty"`
+	// an attempt whose response lacks the value fails and the race goes on
+	Required bool `json:"required,omitempty"`
+
+	css   cascadia.Selector
+	xpath *xpath.Expr
+	json  jp.Expr
+}
+
+// UnmarshalJSON - decode the extractor from its shorthand or full form
+func (e *Extractor) UnmarshalJSON(data []byte) error {
+	var shorthand string
+	if err := json.Unmarshal(data, &shorthand); err == nil {
+		parts := strings.SplitN(shorthand, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("extractor %q must be in the type:expression form", shorthand)
+		}
+		e.Type, e.Expr = parts[0], parts[1]
+
+		return e.compile()
+	}
+
+	// an alias type prevents recursion
+	type extractor Extractor
+	if err := json.Unmarshal(data, (*extractor)(e)); err != nil {
+		return err
+	}
+
+	return e.compile()
+}
+
+// compile - validate the expression and keep it ready for use
+func (e *Extractor) compile() error {
+	var err error
+
+	switch e.Type {
+	case ExtractCSS:
+		e.css, err = cascadia.Compile(e.Expr)
+	case ExtractXPath:
+		e.xpath, err = xpath.Compile(e.Expr)
+	case ExtractJSON:
+		e.json, err = jp.ParseString(e.Expr)
+	default:
+		return fmt.Errorf("extractor type must be one of css, xpath or json, got %q", e.Type)
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid %s expression %q: %v", e.Type, e.Expr, err)
+	}
+
+	return nil
+}
+
+// Extractors - named extractors, the extracted values are reported under the same names
+type Extractors map[string]*Extractor
+
+// ParseExtractors - parse extractors from their JSON form
+func ParseExtractors(value string) (Extractors, error) {
+	var extractors Extractors
+	if err := json.Unmarshal([]byte(value), &extractors); err != nil {
+		return nil, fmt.Errorf("[extract] must be a JSON object of extractors: %v", err)
+	}
+
+	return extractors, nil
+}
+
+// Required - checks whether any of the extractors is required
+func (ex Extractors) Required() bool {
+	for _, e := range ex {
+		if e.Required {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Apply - extract the values from the body
+// HTML is parsed for css and xpath extractors, JSON for json extractors
+func (ex Extractors) Apply(contentType string, body []byte) (map[string]interface{}, error) {
+	var document *html.Node
+	var data interface{}
+	var dataErr error
+
+	values := make(map[string]interface{}, len(ex))
+
+	for name, e := range ex {
+		if e.css == nil && e.xpath == nil && e.json == nil {
+			if err := e.compile(); err != nil {
+				return nil, err
+			}
+		}
+
+		var matches []interface{}
+
+		switch e.Type {
+		case ExtractCSS, ExtractXPath:
+			if document == nil {
+				var err error
+				if document, err = html.Parse(bytes.NewReader(body)); err != nil {
+					return nil, err
+				}
+			}
+
+			if e.Type == ExtractCSS {
+				matches = e.matchCSS(document)
+			} else {
+				matches = e.matchXPath(document)
+			}
+		case ExtractJSON:
+			if data == nil && dataErr == nil {
+				data, dataErr = oj.Parse(body)
+			}
+
+			if dataErr != nil {
+				return nil, fmt.Errorf("%s can't be extracted from %s body: %v", name, mediaType(contentType), dataErr)
+			}
+
+			matches = e.json.Get(data)
+		}
+
+		switch {
+		case e.All:
+			if matches == nil {
+				matches = []interface{}{}
+			}
+			values[name] = matches
+		case len(matches) > 0:
+			values[name] = matches[0]
+		default:
+			values[name] = nil
+		}
+	}
+
+	return values, nil
+}
+
+// Missing - name of a required extractor without any match, empty if none is missing
+func (ex Extractors) Missing(values map[string]interface{}) string {
+	for name, e := range ex {
+		if !e.Required {
+			continue
+		}
+
+		if list, ok := values[name].([]interface{}); values[name] == nil || ok && len(list) == 0 {
+			return name
+		}
+	}
+
+	return ""
+}
+
+func (e *Extractor) matchCSS(document *html.Node) []interface{} {
+	var matches []interface{}
+
+	goquery.NewDocumentFromNode(document).FindMatcher(e.css).Each(func(_ int, s *goquery.Selection) {
+		if e.Attr == "" {
+			matches = append(matches, strings.TrimSpace(s.Text()))
+		} else if value, ok := s.Attr(e.Attr); ok {
+			matches = append(matches, value)
+		}
+	})
+
+	return matches
+}
+
+func (e *Extractor) matchXPath(document *html.Node) []interface{} {
+	var matches []interface{}
+
+	for _, node := range htmlquery.QuerySelectorAll(document, e.xpath) {
+		if e.Attr == "" {
+			matches = append(matches, strings.TrimSpace(htmlquery.InnerText(node)))
+		} else if htmlquery.ExistsAttr(node, e.Attr) {
+			matches = append(matches, htmlquery.SelectAttr(node, e.Attr))
+		}
+	}
+
+	return matches
+}
+
+// checkExtractors - read the body and fail the response if a required value is missing
+// the body is buffered, so it can be read again
+func checkExtractors(response *http.Response, extractors Extractors) error {
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return err
+	}
+	response.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	values, err := extractors.Apply(response.Header.Get("Content-Type"), body)
+	if err != nil {
+		return err
+	}
+
+	if name := extractors.Missing(values); name != "" {
+		return &ExtractionError{URL: response.Request.URL.String(), Name: name}
+	}
+
+	return nil
+}
+
+// extractable - checks if responses of the status have a body values are extracted from,
+// 304 revalidations and redirects that are not followed have none
+func extractable(statusCode int) bool {
+	return statusCode < 300 || statusCode >= 400
+}
+
+// extractResponse - replace the response body with the JSON object of extracted values
+// cached and shared responses are checked for the required values here as they skip the race
+func extractResponse(response *FirstResponse, extractors Extractors, destinationURL string) *FirstResponse {
+	if !response.IsValid() {
+		return response
+	}
+
+	body, err := ioutil.ReadAll(response.GetBody())
+	response.CloseBody()
+	if err != nil {
+		return NewInvalidFirstResponse(err, false, response.elapsed)
+	}
+
+	values, err := extractors.Apply(response.GetHeader().Get("Content-Type"), body)
+	if err != nil {
+		return NewInvalidFirstResponse(err, false, response.elapsed)
+	}
+
+	if name := extractors.Missing(values); name != "" && extractable(response.GetStatusCode()) {
+		return NewInvalidFirstResponse(&ExtractionError{URL: destinationURL, Name: name}, false, response.elapsed)
+	}
+
+	extracted, _ := json.Marshal(values)
+
+	extractedResponse := *response.Response
+	extractedResponse.Header = response.GetHeader().Clone()
+	extractedResponse.Header.Set("Content-Type", "application/json")
+	extractedResponse.Header.Del("Content-Encoding")
+	extractedResponse.Header.Del("Content-Length")
+	extractedResponse.ContentLength = int64(len(extracted))
+	extractedResponse.Body = ioutil.NopCloser(bytes.NewReader(extracted))
+
+	extractedFirstResponse := *response
+	extractedFirstResponse.Response = &extractedResponse
+
+	return &extractedFirstResponse
+}
+
+func mediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "unknown"
+	}
+
+	return mediaType
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+const extractPage = `<html><head><title>Catalog</title></head><body>
+<h1>Widgets</h1>
+<ul>
+  <li class="item"><a href="/a">First</a> <span class="price">10</span></li>
+  <li class="item"><a href="/b">Second</a> <span class="price">20</span></li>
+</ul>
+</body></html>`
+
+func TestExtractorsApply(t *testing.T) {
+	extractors, err := ParseExtractors(`{
+		"title": "css:h1",
+		"prices": {"type": "css", "expr": ".price", "all": true},
+		"link": {"type": "xpath", "expr": "//li[2]/a", "attr": "href"},
+		"names": {"type": "xpath", "expr": "//li/a", "all": true},
+		"missing": "css:.discount"
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := extractors.Apply("text/html", []byte(extractPage))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"title":   "Widgets",
+		"prices":  []interface{}{"10", "20"},
+		"link":    "/b",
+		"names":   []interface{}{"First", "Second"},
+		"missing": nil,
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Fatalf("Expected %v, got %v", expected, values)
+	}
+
+	extractors, _ = ParseExtractors(`{"name": "json:$.items[0].name", "ids": {"type": "json", "expr": "$.items[*].id", "all": true}}`)
+	values, err = extractors.Apply("application/json", []byte(`{"items": [{"id": 1, "name": "a"}, {"id": 2, "name": "b"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if values["name"] != "a" || !reflect.DeepEqual(values["ids"], []interface{}{int64(1), int64(2)}) {
+		t.Fatalf("Unexpected JSON values %v", values)
+	}
+
+	for _, invalid := range []string{`{"a": "regex:.*"}`, `{"a": "css:[["}`, `{"a": "xpath://["}`, `{"a": "css"}`} {
+		if _, err := ParseExtractors(invalid); err == nil {
+			t.Fatalf("Expected %s to be invalid", invalid)
+		}
+	}
+}
+
+func TestExtractedResponses(t *testing.T) {
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/json":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"price": 42}`)
+		case "/etag":
+			w.Header().Set("Cache-Control", "max-age=0")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, extractPage)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, extractPage)
+		}
+	}))
+	defer destination.Close()
+
+	list := NewList()
+	list.Filename = "../proxy.list.example"
+	list.Load()
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	server := NewServer(logger, list)
+
+	r := chi.NewRouter()
+	r.With(server.ProxyGetRequest).Get("/get", server.ProxyGetResponse)
+	r.Post("/batch", server.ProxyBatch)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	t.Run("values are returned instead of the body", func(t *testing.T) {
+		resp, body := testRequest(t, ts, "GET", "/get?extract="+uriEncode(`{"title":"css:h1"}`)+"&url="+uriEncode(destination.URL), nil)
+
+		if resp.Header.Get("Content-Type") != "application/json" || body != `{"title":"Widgets"}` {
+			t.Fatalf("Unexpected response %s %s", resp.Header.Get("Content-Type"), body)
+		}
+	})
+
+	t.Run("missing required value fails the attempt", func(t *testing.T) {
+		resp, _ := testRequest(t, ts, "GET", "/get?extract="+uriEncode(`{"d":{"type":"css","expr":".discount","required":true}}`)+"&url="+uriEncode(destination.URL), nil)
+
+		if resp.StatusCode != http.StatusBadGateway || resp.Header.Get(ErrorCodeHeader) != ErrorCodeExtraction {
+			t.Fatalf("Expected 502 with %s, got %d %q", ErrorCodeExtraction, resp.StatusCode, resp.Header.Get(ErrorCodeHeader))
+		}
+	})
+
+	t.Run("cached responses", func(t *testing.T) {
+		server.cache = &ResponseCache{store: NewMemoryCacheStore(1 << 20), maxStale: time.Hour, maxEntrySize: 1 << 20}
+		defer func() { server.cache = nil }()
+
+		title, _ := ParseExtractors(`{"title":{"type":"css","expr":"h1","required":true}}`)
+		discount, _ := ParseExtractors(`{"d":{"type":"css","expr":".discount","required":true}}`)
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+
+		// the second request revalidates the entry with a 304 that has no body
+		for _, status := range []string{CacheMiss, CacheHit} {
+			response, cacheStatus := server.fetch(req, &RequestSpec{Method: "GET", URL: destination.URL + "/etag", Options: RequestOptions{Extract: title}})
+			if !response.IsValid() || cacheStatus != status {
+				t.Fatalf("Expected %s with the values, got %s %v", status, cacheStatus, response.GetError())
+			}
+			response.CloseBody()
+		}
+
+		response, cacheStatus := server.fetch(req, &RequestSpec{Method: "GET", URL: destination.URL + "/etag", Options: RequestOptions{Extract: discount}})
+		if cacheStatus != CacheHit || errorCode(response.GetError()) != ErrorCodeExtraction {
+			t.Fatalf("Expected the cached response to miss the required value, got %s %v", cacheStatus, response.GetError())
+		}
+	})
+
+	t.Run("invalid extractors", func(t *testing.T) {
+		resp, _ := testRequest(t, ts, "GET", "/get?extract="+uriEncode(`{"a":"css:[["}`)+"&url="+uriEncode(destination.URL), nil)
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("batch results", func(t *testing.T) {
+		batch := fmt.Sprintf(`[{"url": %q, "options": {"extract": {"price": "json:$.price"}}}]`, destination.URL+"/json")
+		_, body := testRequest(t, ts, "POST", "/batch", strings.NewReader(batch))
+
+		var result Result
+		if err := json.Unmarshal([]byte(body), &result); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(result.Extracted) != `{"price":42}` || result.Body != "" {
+			t.Fatalf("Unexpected result %s", body)
+		}
+	})
+}
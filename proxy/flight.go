@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FlightGroup - lets identical concurrent requests share a single multiplexer session
+type FlightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+	// shared responses with bigger bodies fail instead of being buffered
+	maxBody int64
+}
+
+// flight - a multiplexer session in progress
+type flight struct {
+	// closed when the winning response has been buffered
+	done chan struct{}
+	// cancels the session once every waiter has gone
+	cancel context.CancelFunc
+	// number of requests waiting for the session
+	waiters int
+
+	response *FirstResponse
+	body     []byte
+}
+
+// Do - run fn unless an identical request is already in flight and wait for its result
+// fn receives a context with the values of the first caller that lives as long as anyone is waiting for the result
+// every waiter gets its own copy of the response and gives up on its own deadline
+func (fg *FlightGroup) Do(
+	ctx context.Context,
+	key string,
+	fn func(ctx context.Context) *FirstResponse,
+) *FirstResponse {
+	startedAt := time.Now()
+
+	fg.mu.Lock()
+	f, ok := fg.flights[key]
+	if !ok {
+		flightCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		fg.flights[key] = f
+
+		go fg.run(flightCtx, key, f, fn)
+	}
+	f.waiters++
+	fg.mu.Unlock()
+
+	select {
+	case <-f.done:
+		fg.leave(key, f)
+		return f.copyResponse()
+	case <-ctx.Done():
+		fg.leave(key, f)
+		return NewInvalidFirstResponse(
+			fmt.Errorf("gave up waiting for a shared response: %v", ctx.Err()),
+			ctx.Err() == context.DeadlineExceeded,
+			time.Since(startedAt))
+	}
+}
+
+// run - run the session and buffer the winning body so it can be fanned out
+func (fg *FlightGroup) run(ctx context.Context, key string, f *flight, fn func(ctx context.Context) *FirstResponse) {
+	defer close(f.done)
+
+	response := fn(ctx)
+
+	// no new waiters may join once the response is ready
+	fg.mu.Lock()
+	if fg.flights[key] == f {
+		delete(fg.flights, key)
+	}
+	fg.mu.Unlock()
+
+	if response.IsValid() {
+		body, err := ioutil.ReadAll(io.LimitReader(response.GetBody(), fg.maxBody+1))
+		response.CloseBody()
+
+		if err == nil && int64(len(body)) > fg.maxBody {
+			err = &BodyTooLargeError{URL: response.GetFinalURL(), Limit: fg.maxBody}
+		}
+
+		if err != nil {
+			response = NewInvalidFirstResponse(
+				fmt.Errorf("could not read shared response body: %w", err), false, response.elapsed)
+			body = nil
+		}
+
+		f.body = body
+	}
+
+	f.response = response
+}
+
+// leave - stop waiting for the flight, the last waiter cancels it
+func (fg *FlightGroup) leave(key string, f *flight) {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+
+	f.waiters--
+	if f.waiters > 0 {
+		return
+	}
+
+	f.cancel()
+	if fg.flights[key] == f {
+		delete(fg.flights, key)
+	}
+}
+
+// copyResponse - a copy of the shared response with a body of its own
+func (f *flight) copyResponse() *FirstResponse {
+	if !f.response.IsValid() {
+		return f.response
+	}
+
+	original := f.response.Response
+	response := *original
+	response.Header = make(http.Header, len(original.Header))
+	for key, values := range original.Header {
+		response.Header[key] = append([]string(nil), values...)
+	}
+	response.Body = ioutil.NopCloser(bytes.NewReader(f.body))
+	response.ContentLength = int64(len(f.body))
+
+	copied := NewValidFirstResponse(&response, f.response.elapsed)
+	copied.diagnostics = f.response.diagnostics
+
+	return copied
+}
+
+// flightKey - identifies identical requests, bodies are compared by their hash
+func flightKey(method, destinationURL, body string, header http.Header) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	key := method + " " + destinationURL
+	if body != "" {
+		key += fmt.Sprintf(" body=%x", sha256.Sum256([]byte(body)))
+	}
+	for _, name := range names {
+		key += "\n" + name + ": " + strings.Join(header[name], ",")
+	}
+
+	return key
+}
+
+// NewFlightGroup - creates new group of in flight requests buffering up to maxBody bytes of every response
+func NewFlightGroup(maxBody int64) *FlightGroup {
+	return &FlightGroup{flights: make(map[string]*flight), maxBody: maxBody}
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+func TestCoalescedRequests(t *testing.T) {
+	var hits int64
+
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, "shared body")
+	}))
+	defer destination.Close()
+
+	list := NewList()
+	list.Filename = "../proxy.list.example"
+	list.Load()
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	server := NewServer(logger, list)
+
+	r := chi.NewRouter()
+	r.Use(server.ProxyGetRequest)
+	r.Get("/get", server.ProxyGetResponse)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	t.Run("identical requests share a session", func(t *testing.T) {
+		atomic.StoreInt64(&hits, 0)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				_, body := testRequest(t, ts, "GET", "/get?coalesce=1&url="+uriEncode(destination.URL+"/same"), nil)
+				if body != "shared body" {
+					t.Errorf("Expected shared body, got %s", body)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if atomic.LoadInt64(&hits) != 1 {
+			t.Fatalf("Expected a single request to reach destination, got %d", hits)
+		}
+	})
+
+	t.Run("requests without opt in are not coalesced", func(t *testing.T) {
+		atomic.StoreInt64(&hits, 0)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				testRequest(t, ts, "GET", "/get?url="+uriEncode(destination.URL+"/same"), nil)
+			}()
+		}
+		wg.Wait()
+
+		if atomic.LoadInt64(&hits) != 3 {
+			t.Fatalf("Expected every request to reach destination, got %d", hits)
+		}
+	})
+
+	t.Run("requests with different bodies are not coalesced", func(t *testing.T) {
+		atomic.StoreInt64(&hits, 0)
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+
+		var wg sync.WaitGroup
+		for _, body := range []string{"first", "second"} {
+			wg.Add(1)
+			go func(body string) {
+				defer wg.Done()
+
+				spec := &RequestSpec{Method: "POST", URL: destination.URL + "/same", Body: body, Options: RequestOptions{Coalesce: true}}
+				response, _ := server.fetch(req, spec)
+				response.CloseBody()
+			}(body)
+		}
+		wg.Wait()
+
+		if atomic.LoadInt64(&hits) != 2 {
+			t.Fatalf("Expected every body to reach destination, got %d", hits)
+		}
+	})
+
+	t.Run("coalesced requests keep the api key", func(t *testing.T) {
+		key := &Key{Value: "coalesced", Limits: BodyLimits{MaxBodySize: 5}}
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		req = req.WithContext(context.WithValue(req.Context(), apiKeyKey, key))
+
+		spec := &RequestSpec{Method: "GET", URL: destination.URL + "/keyed", Options: RequestOptions{Coalesce: true}}
+		response, _ := server.fetch(req, spec)
+		if response.IsValid() {
+			response.CloseBody()
+		}
+
+		if errorCode(response.GetError()) != ErrorCodeBodyTooLarge {
+			t.Fatalf("Expected the limits of the key, got %v", response.GetError())
+		}
+
+		if server.usage.Key("coalesced").Requests == 0 {
+			t.Fatalf("Expected the usage to be recorded for the key")
+		}
+	})
+
+	t.Run("shared bodies are capped", func(t *testing.T) {
+		flights := server.flights
+		server.flights = NewFlightGroup(5)
+		defer func() { server.flights = flights }()
+
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		spec := &RequestSpec{Method: "GET", URL: destination.URL + "/capped", Options: RequestOptions{Coalesce: true}}
+		response, _ := server.fetch(req, spec)
+		if response.IsValid() {
+			response.CloseBody()
+		}
+
+		if errorCode(response.GetError()) != ErrorCodeBodyTooLarge {
+			t.Fatalf("Expected the shared body to be capped, got %v", response.GetError())
+		}
+	})
+
+	t.Run("streamed requests are not coalesced", func(t *testing.T) {
+		atomic.StoreInt64(&hits, 0)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				testRequest(t, ts, "GET", "/get?coalesce=1&stream=1&url="+uriEncode(destination.URL+"/same"), nil)
+			}()
+		}
+		wg.Wait()
+
+		if atomic.LoadInt64(&hits) != 3 {
+			t.Fatalf("Expected every streamed request to reach destination, got %d", hits)
+		}
+	})
+
+	t.Run("invalid coalesce param", func(t *testing.T) {
+		resp, _ := testRequest(t, ts, "GET", "/get?coalesce=maybe&url="+uriEncode(destination.URL+"/same"), nil)
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected bad request, got %s", resp.Status)
+		}
+	})
+}
@@ -0,0 +1,261 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// headers that only make sense for a single connection and are never forwarded
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// ProxyForward - handle requests of clients using gpm as an HTTP(S) proxy
+// absolute-form requests are multiplexed, CONNECT tunnels race at the tunnel establishment
+func (s *Server) ProxyForward(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+
+			msg := fmt.Sprintf("Internal server error occurred. Recovered from %v", rec)
+			http.Error(w, msg, http.StatusInternalServerError)
+		}
+	}()
+
+	r, ok := s.authorizeForward(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		s.proxyConnect(w, r)
+		return
+	}
+
+	if !r.URL.IsAbs() {
+		http.Error(w, "Forward proxy expects requests in absolute-form", http.StatusBadRequest)
+		return
+	}
+
+	s.proxyAbsolute(w, r)
+}
+
+// authorizeForward - authenticate the client with the api key passed in Proxy-Authorization
+// the key may be passed either as the user name or as the password
+func (s *Server) authorizeForward(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	if !s.keysRequired() {
+		return r, true
+	}
+
+	// reuse basic auth parsing of the standard library
+	auth := &http.Request{Header: http.Header{"Authorization": r.Header["Proxy-Authorization"]}}
+	user, password, ok := auth.BasicAuth()
+
+	apiKey := password
+	if apiKey == "" {
+		apiKey = user
+	}
+
+	key := s.lookupKey(apiKey)
+	if !ok || key == nil {
+		s.logger.Println("Forward proxy API key is missing or invalid")
+		w.Header().Set("Proxy-Authenticate", `Basic realm="gpm"`)
+		http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+		return r, false
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), apiKeyKey, key)), true
+}
+
+// proxyAbsolute - multiplex the absolute-form request and relay the first response as is
+func (s *Server) proxyAbsolute(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBatchSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	spec := &RequestSpec{
+		Method: r.Method,
+		URL:    r.URL.String(),
+		Header: forwardedHeader(r.Header),
+		Body:   string(body),
+		// destination statuses are relayed to the client, only server errors keep the race going
+		acceptStatus: func(statusCode int) bool { return statusCode < 500 },
+		noRedirects:  true,
+	}
+
+	if err := s.checkRobots(r, spec.URL); err != nil {
+		writeCodedError(w, err)
+		return
+	}
+
+	response := s.multiplex(r, spec, nil)
+	if !response.IsValid() {
+		s.logger.Println(response.GetError())
+		http.Error(w, response.GetError().Error(), http.StatusBadGateway)
+		return
+	}
+	defer response.CloseBody()
+
+	header := response.GetHeader()
+	removeHopByHopHeaders(header)
+	for key, values := range header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(response.GetStatusCode())
+
+	if _, err := s.copyBody(w, response); err != nil {
+		s.logger.Printf("Could not copy forwarded response %v", err)
+	}
+}
+
+// proxyConnect - open a tunnel to the target racing direct and proxied connections
+// the first established tunnel is used, the payload is opaque so it can't be multiplexed
+// unless TLS interception is enabled
+func (s *Server) proxyConnect(w http.ResponseWriter, r *http.Request) {
+	target := r.Host
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		http.Error(w, "CONNECT target must be host:port", http.StatusBadRequest)
+		return
+	}
+
+	if s.mitm != nil {
+		s.interceptConnect(w, r, target)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Tunnels are not supported", http.StatusInternalServerError)
+		return
+	}
+
+	conn, err := s.raceTunnel(r.Context(), target)
+	if err != nil {
+		s.logger.Println(err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	clientConn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		conn.Close()
+		s.logger.Printf("Could not hijack connection %v", err)
+		return
+	}
+
+	if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		clientConn.Close()
+		conn.Close()
+		return
+	}
+
+	// the client may have sent some data right after CONNECT
+	if n := buffered.Reader.Buffered(); n > 0 {
+		data, _ := buffered.Reader.Peek(n)
+		if _, err := conn.Write(data); err != nil {
+			clientConn.Close()
+			conn.Close()
+			return
+		}
+	}
+
+	pipe(clientConn, conn)
+}
+
+// raceTunnel - dial the target directly and through random proxies at the same time
+// returns the first established connection, the others are closed
+func (s *Server) raceTunnel(ctx context.Context, target string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(GetMaxTimeout())*time.Second)
+	defer cancel()
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+
+	tries := getConcurrentTries()
+	results := make(chan dialResult, tries)
+
+	for i := 1; i <= tries; i++ {
+		go func(index int) {
+			if index == firstRequest || s.proxyList.Count() == 0 {
+				dial := s.resolver.DialContext
+				if local := localAddress(s.proxyList.RandLocal(nil)); local != nil {
+					dial = localDial(local, s.resolver)
+				}
+
+				conn, err := dial(ctx, "tcp", target)
+				results <- dialResult{conn, err}
+				return
+			}
+
+			conn, err := dialProxy(ctx, s.resolver.DialContext, fillGateway(s.proxyList.Rand(), ""), target)
+			results <- dialResult{conn, err}
+		}(i)
+	}
+
+	var errs []string
+	for i := 0; i < tries; i++ {
+		result := <-results
+		if result.err != nil {
+			errs = append(errs, result.err.Error())
+			continue
+		}
+
+		// close the tunnels established after the winner
+		go func(remaining int) {
+			for j := 0; j < remaining; j++ {
+				if late := <-results; late.conn != nil {
+					late.conn.Close()
+				}
+			}
+		}(tries - i - 1)
+
+		return result.conn, nil
+	}
+
+	return nil, fmt.Errorf("all tunnels to %s failed: %s", target, strings.Join(errs, "; "))
+}
+
+// forwardedHeader - end to end headers of the client request
+func forwardedHeader(header http.Header) map[string]string {
+	header = header.Clone()
+	removeHopByHopHeaders(header)
+
+	forwarded := make(map[string]string, len(header))
+	for key, values := range header {
+		forwarded[key] = strings.Join(values, ", ")
+	}
+
+	return forwarded
+}
+
+// removeHopByHopHeaders - remove hop-by-hop headers including the ones listed in Connection
+func removeHopByHopHeaders(header http.Header) {
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			header.Del(strings.TrimSpace(name))
+		}
+	}
+
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
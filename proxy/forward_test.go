@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestProxyForward(t *testing.T) {
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+			return
+		}
+
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.Path, r.Header.Get("X-Test"))
+	}))
+	defer destination.Close()
+
+	tlsDestination := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "tunnelled")
+	}))
+	defer tlsDestination.Close()
+
+	list := NewList()
+	list.Filename = "../proxy.list.example"
+	list.Load()
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	server := NewServer(logger, list)
+	key, _ := ParseKey("forward-key", nil)
+	server.keys.Add(key)
+
+	ts := httptest.NewServer(http.HandlerFunc(server.ProxyForward))
+	defer ts.Close()
+
+	client := func(user *url.Userinfo) *http.Client {
+		proxyURL, _ := url.Parse(ts.URL)
+		proxyURL.User = user
+
+		return &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyURL(proxyURL),
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	}
+
+	do := func(t *testing.T, c *http.Client, method, uri string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, uri, nil)
+		req.Header.Set("X-Test", "forwarded")
+
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+
+		return resp, string(body)
+	}
+
+	t.Run("absolute-form request", func(t *testing.T) {
+		resp, body := do(t, client(url.UserPassword("", "forward-key")), "POST", destination.URL+"/page")
+
+		if resp.StatusCode != http.StatusOK || body != "POST /page forwarded" {
+			t.Fatalf("Unexpected response %s %s", resp.Status, body)
+		}
+	})
+
+	t.Run("destination statuses are relayed", func(t *testing.T) {
+		resp, _ := do(t, client(url.User("forward-key")), "GET", destination.URL+"/missing")
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("Expected 404 to be relayed, got %s", resp.Status)
+		}
+
+		resp, _ = do(t, client(url.User("forward-key")), "GET", destination.URL+"/redirect")
+		if resp.StatusCode != http.StatusFound {
+			t.Fatalf("Expected redirect to be relayed, got %s", resp.Status)
+		}
+	})
+
+	t.Run("connect tunnel", func(t *testing.T) {
+		resp, body := do(t, client(url.User("forward-key")), "GET", tlsDestination.URL)
+
+		if resp.StatusCode != http.StatusOK || body != "tunnelled" {
+			t.Fatalf("Unexpected tunnelled response %s %s", resp.Status, body)
+		}
+	})
+
+	t.Run("invalid key", func(t *testing.T) {
+		resp, _ := do(t, client(url.User("wrong")), "GET", destination.URL)
+
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			t.Fatalf("Expected proxy authentication to be required, got %s", resp.Status)
+		}
+
+		_, err := client(nil).Get(tlsDestination.URL)
+		if err == nil {
+			t.Fatal("Expected tunnel without a key to be refused")
+		}
+	})
+}
@@ -0,0 +1,29 @@
+//go:build linux
+
+package proxy
+
+import (
+	"strings"
+	"syscall"
+)
+
+// ipv6Freebind - IPV6_FREEBIND is missing from the syscall package
+const ipv6Freebind = 78
+
+// freebind - lets the socket bind an address not assigned to any interface,
+// addresses sampled from a block routed to the server are not configured one by one
+func freebind(network, _ string, c syscall.RawConn) error {
+	level, option := syscall.SOL_IP, syscall.IP_FREEBIND
+	if strings.HasSuffix(network, "6") {
+		level, option = syscall.SOL_IPV6, ipv6Freebind
+	}
+
+	var err error
+	if controlErr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), level, option, 1)
+	}); controlErr != nil {
+		return controlErr
+	}
+
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package proxy
+
+import "syscall"
+
+// freebind - binding addresses not assigned to any interface is only supported on Linux
+func freebind(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// fallback policies of geo targeting when no proxy has the requested tag
+const (
+	GeoFallbackFail  = "fail"
+	GeoFallbackWiden = "widen"
+)
+
+// GeoTarget - country or region the proxies of a request must be tagged with
+type GeoTarget struct {
+	Country string `json:"country,omitempty"`
+	Region  string `json:"region,omitempty"`
+	// fail (default) or widen to the neighbours
+	Fallback string `json:"fallback,omitempty"`
+	// tags tried in order once no proxy has the country or the region
+	Neighbours []string `json:"-"`
+}
+
+// stages - tags proxies are selected by, the neighbours are only tried with the widen policy
+func (g *GeoTarget) stages() [][]string {
+	var primary []string
+	if g.Country != "" {
+		primary = []string{g.Country}
+	} else {
+		primary = []string{g.Region}
+	}
+
+	stages := [][]string{primary}
+	if g.Fallback != GeoFallbackWiden {
+		return stages
+	}
+
+	// a country widens to its region first
+	if g.Country != "" && g.Region != "" {
+		stages = append(stages, []string{g.Region})
+	}
+	if len(g.Neighbours) > 0 {
+		stages = append(stages, g.Neighbours)
+	}
+
+	return stages
+}
+
+// available - checks if any proxy of the list matches the target
+func (g *GeoTarget) available(list *List) bool {
+	for _, tags := range g.stages() {
+		if proxy, _ := list.RandTagged(nil, tags); proxy != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matches - checks if a proxy with the tags would be picked for the target
+func (g *GeoTarget) matches(tags []string) bool {
+	for _, stage := range g.stages() {
+		for _, tag := range stage {
+			if containsTag(tags, tag) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (g *GeoTarget) String() string {
+	if g.Country != "" {
+		return "country " + g.Country
+	}
+
+	return "region " + g.Region
+}
+
+// unavailable - error of the request when no proxy matches the target
+func (g *GeoTarget) unavailable() *CodedError {
+	return &CodedError{
+		Code:   ErrorCodeGeo,
+		Status: http.StatusBadGateway,
+		Err:    fmt.Errorf("no proxy of %s is available", g),
+	}
+}
+
+// ValidateGeoFallback - checks the fallback policy is known
+func ValidateGeoFallback(fallback string) error {
+	switch fallback {
+	case "", GeoFallbackFail, GeoFallbackWiden:
+		return nil
+	}
+
+	return fmt.Errorf("[geo_fallback] must be either %s or %s", GeoFallbackFail, GeoFallbackWiden)
+}
+
+// GeoRule - geo target of the requests to the domain and its subdomains
+type GeoRule struct {
+	Domain string `json:"domain"`
+	GeoTarget
+}
+
+// GeoRules - per domain geo targets and neighbours of countries and regions
+type GeoRules struct {
+	Filename string
+
+	// tags a country or a region widens to
+	Neighbours map[string][]string `json:"neighbours"`
+	Domains    []GeoRule           `json:"domains"`
+}
+
+// Load - load the rules from the JSON file, nothing is loaded without a file
+func (gr *GeoRules) Load() {
+	if gr.Filename == "" {
+		return
+	}
+
+	data, err := os.ReadFile(gr.Filename)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := json.Unmarshal(data, gr); err != nil {
+		panic(fmt.Errorf("could not parse geo rules %s: %v", gr.Filename, err))
+	}
+
+	for _, rule := range gr.Domains {
+		if rule.Domain == "" || rule.Country == "" && rule.Region == "" {
+			panic(fmt.Errorf("geo rule %+v needs a domain and a country or a region", rule))
+		}
+
+		if err := ValidateGeoFallback(rule.Fallback); err != nil {
+			panic(fmt.Errorf("geo rule of %s: %v", rule.Domain, err))
+		}
+	}
+}
+
+// rule - rule of the most specific domain of the host, nil if there is none
+func (gr *GeoRules) rule(host string) *GeoRule {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	var matched *GeoRule
+	for i, rule := range gr.Domains {
+		domain := strings.ToLower(rule.Domain)
+		if host != domain && !strings.HasSuffix(host, "."+domain) {
+			continue
+		}
+
+		if matched == nil || len(domain) > len(matched.Domain) {
+			matched = &gr.Domains[i]
+		}
+	}
+
+	return matched
+}
+
+// Target - geo target of the request, the options of the request override the rule of the destination
+// nil when the request is not targeted
+func (gr *GeoRules) Target(destinationURL string, options RequestOptions) *GeoTarget {
+	target := &GeoTarget{}
+	if u, err := url.Parse(destinationURL); err == nil {
+		if rule := gr.rule(u.Hostname()); rule != nil {
+			*target = rule.GeoTarget
+		}
+	}
+
+	if options.Country != "" || options.Region != "" {
+		target.Country, target.Region = options.Country, options.Region
+	}
+	if options.GeoFallback != "" {
+		target.Fallback = options.GeoFallback
+	}
+
+	if target.Country == "" && target.Region == "" {
+		return nil
+	}
+
+	target.Country = strings.ToLower(target.Country)
+	target.Region = strings.ToLower(target.Region)
+	if target.Country != "" {
+		target.Neighbours = gr.Neighbours[target.Country]
+	} else {
+		target.Neighbours = gr.Neighbours[target.Region]
+	}
+
+	return target
+}
+
+// NewGeoRules - rules of the GPM_GEO_RULES file
+func NewGeoRules() *GeoRules {
+	return &GeoRules{
+		Filename:   os.Getenv("GPM_GEO_RULES"),
+		Neighbours: make(map[string][]string),
+	}
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+)
+
+// exitServer - proxy answering plain HTTP requests itself with its name
+func exitServer(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, name)
+	}))
+}
+
+func TestGeoRouting(t *testing.T) {
+	rules := filepath.Join(t.TempDir(), "geo.json")
+	err := os.WriteFile(rules, []byte(`{
+		"neighbours": {"ch": ["at", "de"]},
+		"domains": [
+			{"domain": "shop.ch", "country": "ch", "fallback": "widen"},
+			{"domain": "shop.fr", "country": "fr"}
+		]
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("GPM_GEO_RULES", rules)
+	defer os.Unsetenv("GPM_GEO_RULES")
+
+	os.Setenv("GPM_GATEWAY_COUNTRIES", "us,nl")
+	defer os.Unsetenv("GPM_GATEWAY_COUNTRIES")
+
+	list := NewList()
+	for _, exit := range []struct{ name, tags string }{{"us", "us"}, {"de", "de,eu"}, {"at", "AT,eu"}} {
+		ts := exitServer(exit.name)
+		defer ts.Close()
+		list.Add(ts.URL + " tags=" + exit.tags)
+	}
+
+	gateway := newGatewayServer()
+	defer gateway.Close()
+	list.Add("http://user-country-{country}-session-{session}:secret@" + strings.TrimPrefix(gateway.URL, "http://"))
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	server := NewServer(logger, list)
+
+	r := chi.NewRouter()
+	r.With(server.ProxyGetRequest).Get("/get", server.ProxyGetResponse)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	diagnosticsOf := func(t *testing.T, resp *http.Response) Diagnostics {
+		var diagnostics Diagnostics
+		if err := json.Unmarshal([]byte(resp.Header.Get(DiagnosticsHeader)), &diagnostics); err != nil {
+			t.Fatal(err)
+		}
+		return diagnostics
+	}
+
+	t.Run("country", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			resp, body := testRequest(t, ts, "GET", "/get?country=DE&diagnostics=1&url="+uriEncode("http://shop.test/"), nil)
+			if body != "de" {
+				t.Fatalf("Expected the proxy of the country, got %s", body)
+			}
+
+			diagnostics := diagnosticsOf(t, resp)
+			if diagnostics.Tag != "de" {
+				t.Fatalf("Expected the tag of the winner, got %s", resp.Header.Get(DiagnosticsHeader))
+			}
+			for _, attempt := range diagnostics.Attempts {
+				if attempt.Proxy == directProxy {
+					t.Fatalf("Expected no direct attempts, got %s", resp.Header.Get(DiagnosticsHeader))
+				}
+			}
+		}
+	})
+
+	t.Run("region", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			if _, body := testRequest(t, ts, "GET", "/get?region=eu&url="+uriEncode("http://shop.test/"), nil); body != "de" && body != "at" {
+				t.Fatalf("Expected a proxy of the region, got %s", body)
+			}
+		}
+	})
+
+	t.Run("gateway is filled with the country", func(t *testing.T) {
+		resp, body := testRequest(t, ts, "GET", "/get?country=nl&diagnostics=1&url="+uriEncode("http://shop.test/"), nil)
+		if !strings.HasPrefix(body, "user-country-nl-session-") {
+			t.Fatalf("Expected the gateway to exit in the country, got %s", body)
+		}
+
+		if diagnosticsOf(t, resp).Tag != "nl" {
+			t.Fatalf("Expected the tag of the winner, got %s", resp.Header.Get(DiagnosticsHeader))
+		}
+	})
+
+	t.Run("domain rule widens to the neighbours", func(t *testing.T) {
+		resp, body := testRequest(t, ts, "GET", "/get?diagnostics=1&url="+uriEncode("http://www.shop.ch/"), nil)
+		if body != "at" || diagnosticsOf(t, resp).Tag != "at" {
+			t.Fatalf("Expected the first neighbour, got %s %s", body, resp.Header.Get(DiagnosticsHeader))
+		}
+
+		// the request overrides the rule of the domain, the gateway exits in us as well
+		if _, body := testRequest(t, ts, "GET", "/get?country=us&url="+uriEncode("http://shop.ch/"), nil); body != "us" && !strings.HasPrefix(body, "user-country-us-") {
+			t.Fatalf("Expected the country of the request, got %s", body)
+		}
+	})
+
+	t.Run("no proxy of the country", func(t *testing.T) {
+		resp, _ := testRequest(t, ts, "GET", "/get?url="+uriEncode("http://shop.fr/"), nil)
+		if resp.Header.Get(ErrorCodeHeader) != ErrorCodeGeo {
+			t.Fatalf("Expected %s, got %d %q", ErrorCodeGeo, resp.StatusCode, resp.Header.Get(ErrorCodeHeader))
+		}
+
+		// no neighbours of fr are known, so there is nothing to widen to
+		resp, _ = testRequest(t, ts, "GET", "/get?country=fr&geo_fallback=widen&url="+uriEncode("http://shop.test/"), nil)
+		if resp.Header.Get(ErrorCodeHeader) != ErrorCodeGeo {
+			t.Fatalf("Expected %s, got %d %q", ErrorCodeGeo, resp.StatusCode, resp.Header.Get(ErrorCodeHeader))
+		}
+	})
+
+	t.Run("sessions are pinned within the target", func(t *testing.T) {
+		if _, body := testRequest(t, ts, "GET", "/get?session=geo&country=de&url="+uriEncode("http://shop.test/"), nil); body != "de" {
+			t.Fatalf("Expected the proxy of the country, got %s", body)
+		}
+
+		// the proxy of de is pinned, it is tagged with the region as well
+		if _, body := testRequest(t, ts, "GET", "/get?session=geo&region=eu&url="+uriEncode("http://shop.test/"), nil); body != "de" {
+			t.Fatalf("Expected the pinned proxy of the region, got %s", body)
+		}
+
+		if _, body := testRequest(t, ts, "GET", "/get?session=geo&country=us&url="+uriEncode("http://shop.test/"), nil); body != "us" && !strings.HasPrefix(body, "user-country-us-") {
+			t.Fatalf("Expected the pinned proxy of another country to be dropped, got %s", body)
+		}
+	})
+
+	t.Run("geo targets are part of the cache key", func(t *testing.T) {
+		german := &RequestSpec{URL: "http://shop.test/", Options: RequestOptions{Country: "DE"}}
+		american := &RequestSpec{URL: "http://shop.test/", Options: RequestOptions{Country: "us"}}
+		if german.cacheURL() == american.cacheURL() || german.cacheURL() != (&RequestSpec{URL: "http://shop.test/", Options: RequestOptions{Country: "de"}}).cacheURL() {
+			t.Fatalf("Expected responses of the countries to be kept apart, got %s and %s", german.cacheURL(), american.cacheURL())
+		}
+	})
+
+	t.Run("invalid fallback", func(t *testing.T) {
+		resp, _ := testRequest(t, ts, "GET", "/get?country=de&geo_fallback=anywhere&url="+uriEncode("http://shop.test/"), nil)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400, got %d", resp.StatusCode)
+		}
+	})
+}
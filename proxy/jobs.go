@@ -0,0 +1,450 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// seconds a client is asked to wait before retrying when the queue is full
+const jobRetryAfter = 5
+
+// Job statuses
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// Job - a request processed asynchronously by the job queue
+type Job struct {
+	ID         string       `json:"id"`
+	Status     string       `json:"status"`
+	Spec       *RequestSpec `json:"request"`
+	CreatedAt  time.Time    `json:"created_at"`
+	StartedAt  *time.Time   `json:"started_at,omitempty"`
+	FinishedAt *time.Time   `json:"finished_at,omitempty"`
+	// result without the body, the body is kept on disk next to the job
+	Result *Result `json:"result,omitempty"`
+	// delivery of the finished job to the callback URL if one was given
+	DeliveryID string `json:"delivery_id,omitempty"`
+
+	// api key the job was created with
+	key *Key
+	// cancels the running job
+	cancel context.CancelFunc
+}
+
+// IsFinished - checks whether the job won't change anymore
+func (j *Job) IsFinished() bool {
+	return j.Status == JobSucceeded || j.Status == JobFailed || j.Status == JobCancelled
+}
+
+// JobQueue - bounded queue of jobs processed by a pool of workers
+// finished jobs are kept on disk until their TTL runs out
+type JobQueue struct {
+	// runs the request of the job
+	run func(ctx context.Context, job *Job) (*Result, *FirstResponse)
+	// called with every finished job
+	notify func(job Job)
+	// directory finished jobs are kept in
+	dir string
+	// how long finished jobs are kept
+	ttl time.Duration
+	// jobs waiting for a worker
+	queue chan *Job
+
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+// Submit - put the job into the queue
+// submitted is called with the queued job before any worker can pick it up
+// returns false when the queue is full
+func (jq *JobQueue) Submit(job *Job, submitted func(job *Job)) bool {
+	jq.mu.Lock()
+	defer jq.mu.Unlock()
+
+	select {
+	case jq.queue <- job:
+		jq.jobs[job.ID] = job
+		submitted(job)
+		return true
+	default:
+		return false
+	}
+}
+
+// Get - get a snapshot of the job
+func (jq *JobQueue) Get(id string) (Job, bool) {
+	jq.mu.Lock()
+	defer jq.mu.Unlock()
+
+	job, ok := jq.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+
+	return *job, true
+}
+
+// Cancel - cancel the job if it is not finished yet or forget it and its result otherwise
+func (jq *JobQueue) Cancel(id string) bool {
+	jq.mu.Lock()
+	defer jq.mu.Unlock()
+
+	job, ok := jq.jobs[id]
+	if !ok {
+		return false
+	}
+
+	switch {
+	case job.Status == JobQueued:
+		jq.finish(job, JobCancelled, &Result{URL: job.Spec.URL, Method: job.Spec.Method, Error: "job was " + JobCancelled})
+		go jq.notify(*job)
+	case job.Status == JobRunning:
+		job.cancel()
+	case job.IsFinished():
+		jq.remove(job)
+	}
+
+	return true
+}
+
+// ResultBody - open the stored body of the finished job
+func (jq *JobQueue) ResultBody(id string) (*os.File, error) {
+	return os.Open(jq.bodyPath(id))
+}
+
+// work - process jobs from the queue until it is closed
+func (jq *JobQueue) work() {
+	for job := range jq.queue {
+		jq.process(job)
+	}
+}
+
+func (jq *JobQueue) process(job *Job) {
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), apiKeyKey, job.key))
+	defer cancel()
+
+	jq.mu.Lock()
+	if job.Status != JobQueued {
+		jq.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	job.Status = JobRunning
+	job.StartedAt = &now
+	job.cancel = cancel
+	jq.mu.Unlock()
+
+	result, response := jq.run(ctx, job)
+	if response != nil {
+		err := jq.saveBody(job.ID, response)
+		response.CloseBody()
+
+		if err != nil {
+			result.setError(err)
+		}
+	}
+
+	status := JobSucceeded
+	if ctx.Err() != nil {
+		status = JobCancelled
+	} else if result.Error != "" {
+		status = JobFailed
+	}
+
+	jq.mu.Lock()
+	jq.finish(job, status, result)
+	snapshot := *job
+	jq.mu.Unlock()
+
+	jq.notify(snapshot)
+}
+
+// finish - mark job as finished and keep it on disk
+// must be called with the lock held
+func (jq *JobQueue) finish(job *Job, status string, result *Result) {
+	now := time.Now()
+	job.Status = status
+	job.FinishedAt = &now
+	job.Result = result
+
+	data, err := json.Marshal(job)
+	if err == nil {
+		err = ioutil.WriteFile(jq.jobPath(job.ID), data, 0644)
+	}
+
+	if err != nil {
+		job.Status = JobFailed
+		job.Result = &Result{URL: job.Spec.URL, Method: job.Spec.Method, Error: fmt.Sprintf("could not store the job: %v", err)}
+	}
+}
+
+// remove - forget the job and delete its files
+// must be called with the lock held
+func (jq *JobQueue) remove(job *Job) {
+	delete(jq.jobs, job.ID)
+	os.Remove(jq.jobPath(job.ID))
+	os.Remove(jq.bodyPath(job.ID))
+}
+
+// saveBody - write the response body to disk
+func (jq *JobQueue) saveBody(id string, response *FirstResponse) error {
+	f, err := os.Create(jq.bodyPath(id))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, response.GetBody()); err != nil {
+		return fmt.Errorf("could not store the response body: %v", err)
+	}
+
+	return nil
+}
+
+// load - pick up the finished jobs kept on disk
+func (jq *JobQueue) load() {
+	files, err := filepath.Glob(filepath.Join(jq.dir, "*.json"))
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+
+		var job Job
+		if err := json.Unmarshal(data, &job); err != nil || !job.IsFinished() {
+			continue
+		}
+
+		jq.jobs[job.ID] = &job
+	}
+}
+
+// purge - forget the finished jobs older than TTL
+func (jq *JobQueue) purge() {
+	jq.mu.Lock()
+	defer jq.mu.Unlock()
+
+	now := time.Now()
+	for _, job := range jq.jobs {
+		if job.IsFinished() && now.Sub(*job.FinishedAt) > jq.ttl {
+			jq.remove(job)
+		}
+	}
+}
+
+func (jq *JobQueue) jobPath(id string) string {
+	return filepath.Join(jq.dir, id+".json")
+}
+
+func (jq *JobQueue) bodyPath(id string) string {
+	return filepath.Join(jq.dir, id+".body")
+}
+
+// NewJobQueue - creates new job queue and starts its workers
+func NewJobQueue(
+	run func(ctx context.Context, job *Job) (*Result, *FirstResponse),
+	notify func(job Job),
+	dir string,
+	ttl time.Duration,
+	workers, depth int,
+) *JobQueue {
+	jq := &JobQueue{
+		run:    run,
+		notify: notify,
+		dir:    dir,
+		ttl:    ttl,
+		queue:  make(chan *Job, depth),
+		jobs:   make(map[string]*Job),
+	}
+
+	os.MkdirAll(dir, 0755)
+	jq.load()
+
+	for i := 0; i < workers; i++ {
+		go jq.work()
+	}
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			jq.purge()
+		}
+	}()
+
+	return jq
+}
+
+// CreateJob - handle POST /jobs with a request spec
+func (s *Server) CreateJob(w http.ResponseWriter, r *http.Request) {
+	var spec RequestSpec
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchSize)).Decode(&spec); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid job: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	err := spec.Validate()
+	if err == nil {
+		err = s.profiles.ValidateProfile(spec.Options.Profile)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if spec.Options.Timeout == 0 {
+		spec.Options.Timeout = getJobTimeout()
+	}
+
+	key, _ := r.Context().Value(apiKeyKey).(*Key)
+	job := &Job{
+		ID:        newID(),
+		Status:    JobQueued,
+		Spec:      &spec,
+		CreatedAt: time.Now(),
+		key:       key,
+	}
+
+	// the job belongs to the queue once submitted
+	// the delivery is registered only for jobs that made it into the queue
+	var snapshot Job
+	submitted := s.jobs.Submit(job, func(job *Job) {
+		if spec.Options.CallbackURL != "" {
+			job.DeliveryID = s.callbacks.Register(spec.Options.CallbackURL).ID
+		}
+		snapshot = *job
+	})
+
+	if !submitted {
+		w.Header().Set("Retry-After", strconv.Itoa(jobRetryAfter))
+		http.Error(w, "Job queue is full", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+job.ID)
+	writeJSON(w, http.StatusAccepted, snapshot)
+}
+
+// GetJob - handle GET /jobs/{id}
+func (s *Server) GetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.jobs.Get(chi.URLParam(r, "id"))
+	if !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, job)
+}
+
+// GetJobResult - handle GET /jobs/{id}/result with the response of the finished job
+func (s *Server) GetJobResult(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.jobs.Get(chi.URLParam(r, "id"))
+	if !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	if !job.IsFinished() {
+		http.Error(w, fmt.Sprintf("Job is %s", job.Status), http.StatusConflict)
+		return
+	}
+
+	if job.Status != JobSucceeded {
+		message := "job was " + job.Status
+		if job.Result != nil && job.Result.Error != "" {
+			message = job.Result.Error
+		}
+
+		http.Error(w, message, http.StatusBadGateway)
+		return
+	}
+
+	body, err := s.jobs.ResultBody(job.ID)
+	if err != nil {
+		http.Error(w, "Job result is gone", http.StatusGone)
+		return
+	}
+	defer body.Close()
+
+	copyHeaders(w.Header(), job.Result.Header.Clone())
+	w.WriteHeader(job.Result.StatusCode)
+
+	if _, err := io.Copy(w, body); err != nil {
+		s.logger.Printf("Could not copy job result %v", err)
+	}
+}
+
+// CancelJob - handle DELETE /jobs/{id}
+// cancels the job if it has not finished yet or deletes its result otherwise
+func (s *Server) CancelJob(w http.ResponseWriter, r *http.Request) {
+	if !s.jobs.Cancel(chi.URLParam(r, "id")) {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runJob - run the request of the job through the multiplexer
+func (s *Server) runJob(ctx context.Context, job *Job) (*Result, *FirstResponse) {
+	r, _ := http.NewRequest(http.MethodPost, "/jobs/"+job.ID, nil)
+
+	// the spec is shared with the snapshots of the job
+	spec := *job.Spec
+
+	return s.runSpec(r.WithContext(ctx), 0, &spec)
+}
+
+// notifyJob - post the finished job to its callback URL
+// the body is never inlined, it is referenced from the envelope instead
+func (s *Server) notifyJob(job Job) {
+	if job.DeliveryID == "" {
+		return
+	}
+
+	envelope := &Envelope{Result: job.Result, JobID: job.ID}
+	if envelope.Result == nil {
+		envelope.Result = &Result{URL: job.Spec.URL, Method: job.Spec.Method, Error: "job was " + job.Status}
+	}
+
+	if job.Status == JobSucceeded {
+		envelope.BodyRef = "/jobs/" + job.ID + "/result"
+	}
+
+	s.callbacks.Send(job.DeliveryID, envelope)
+}
+
+// newID - random identifier of jobs and deliveries
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// writeJSON - write the value as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+func TestJobs(t *testing.T) {
+	release := make(chan struct{})
+
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/blocked" {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+
+		w.Header().Set("X-Test", "job")
+		fmt.Fprint(w, "job body")
+	}))
+	defer destination.Close()
+	defer close(release)
+
+	dir, err := ioutil.TempDir("", "gpm-jobs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	list := NewList()
+	list.Filename = "../proxy.list.example"
+	list.Load()
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	server := NewServer(logger, list)
+	server.jobs = NewJobQueue(server.runJob, server.notifyJob, dir, time.Hour, 1, 1)
+
+	r := chi.NewRouter()
+	r.Route("/jobs", func(r chi.Router) {
+		r.Post("/", server.CreateJob)
+		r.Get("/{id}", server.GetJob)
+		r.Get("/{id}/result", server.GetJobResult)
+		r.Delete("/{id}", server.CancelJob)
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	create := func(t *testing.T, path string) (*http.Response, *Job) {
+		spec := fmt.Sprintf(`{"url": "%s%s"}`, destination.URL, path)
+		resp, body := testRequest(t, ts, "POST", "/jobs", strings.NewReader(spec))
+
+		var job Job
+		json.Unmarshal([]byte(body), &job)
+
+		return resp, &job
+	}
+
+	waitFor := func(t *testing.T, id, status string) *Job {
+		for i := 0; i < 100; i++ {
+			_, body := testRequest(t, ts, "GET", "/jobs/"+id, nil)
+
+			var job Job
+			if err := json.Unmarshal([]byte(body), &job); err != nil {
+				t.Fatal(err)
+			}
+
+			if job.Status == status {
+				return &job
+			}
+
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		t.Fatalf("Job %s never became %s", id, status)
+		return nil
+	}
+
+	t.Run("job result", func(t *testing.T) {
+		resp, job := create(t, "/done")
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("Expected job to be accepted, got %s", resp.Status)
+		}
+
+		finished := waitFor(t, job.ID, JobSucceeded)
+		if finished.Result.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200 in job result, got %d", finished.Result.StatusCode)
+		}
+
+		resp, body := testRequest(t, ts, "GET", "/jobs/"+job.ID+"/result", nil)
+		if body != "job body" || resp.Header.Get("X-Test") != "job" {
+			t.Fatalf("Unexpected job result %s", body)
+		}
+
+		resp, _ = testRequest(t, ts, "DELETE", "/jobs/"+job.ID, nil)
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("Expected job to be deleted, got %s", resp.Status)
+		}
+
+		resp, _ = testRequest(t, ts, "GET", "/jobs/"+job.ID, nil)
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("Expected deleted job to be gone, got %s", resp.Status)
+		}
+	})
+
+	t.Run("backpressure and cancellation", func(t *testing.T) {
+		_, running := create(t, "/blocked")
+		waitFor(t, running.ID, JobRunning)
+
+		resp, queued := create(t, "/blocked")
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("Expected job to be queued, got %s", resp.Status)
+		}
+
+		spec := fmt.Sprintf(`{"url": "%s/blocked", "options": {"callback_url": "http://callback.test/"}}`, destination.URL)
+		resp, _ = testRequest(t, ts, "POST", "/jobs", strings.NewReader(spec))
+		if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+			t.Fatalf("Expected queue to be full, got %s", resp.Status)
+		}
+
+		server.callbacks.mu.Lock()
+		pending := len(server.callbacks.deliveries)
+		server.callbacks.mu.Unlock()
+		if pending != 0 {
+			t.Fatalf("Expected no delivery of the rejected job, got %d", pending)
+		}
+
+		testRequest(t, ts, "DELETE", "/jobs/"+queued.ID, nil)
+		waitFor(t, queued.ID, JobCancelled)
+
+		resp, body := testRequest(t, ts, "GET", "/jobs/"+queued.ID+"/result", nil)
+		if resp.StatusCode != http.StatusBadGateway || !strings.Contains(body, "job was cancelled") {
+			t.Fatalf("Expected the result of the cancelled job to fail, got %s %s", resp.Status, body)
+		}
+
+		testRequest(t, ts, "DELETE", "/jobs/"+running.ID, nil)
+		waitFor(t, running.ID, JobCancelled)
+	})
+
+	t.Run("invalid job", func(t *testing.T) {
+		resp, _ := testRequest(t, ts, "POST", "/jobs", strings.NewReader(`{"url": "wrong"}`))
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected bad request, got %s", resp.Status)
+		}
+	})
+}
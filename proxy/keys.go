@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Key - API key along with the options enabled for it
+type Key struct {
+	Value string
+	// fetch robots.txt of the destination and reject disallowed URLs
+	Robots bool
+	// restrictions of response bodies for every request made with the key
+	Limits BodyLimits
+}
+
+// KeyList - list of API keys accepted by the server
+type KeyList struct {
+	Filename string
+	keys     map[string]*Key
+}
+
+// Load the contents of the api keys file
+// every line holds a key optionally followed by space separated options
+// e.g. `secret robots max_body=10485760 content_types=text/html,application/json`
+func (kl *KeyList) Load() {
+	if kl.Filename == "" {
+		return
+	}
+
+	f, err := os.Open(kl.Filename)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Split(bufio.ScanLines)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		key, err := ParseKey(fields[0], fields[1:])
+		if err != nil {
+			panic(fmt.Errorf("api key %s: %v", fields[0], err))
+		}
+
+		kl.Add(key)
+	}
+}
+
+// Add key to the list
+func (kl *KeyList) Add(key *Key) {
+	kl.keys[key.Value] = key
+}
+
+// Get key by its value, returns nil if key is unknown
+func (kl *KeyList) Get(value string) *Key {
+	return kl.keys[value]
+}
+
+// Count the keys in the list
+func (kl *KeyList) Count() int {
+	return len(kl.keys)
+}
+
+// ParseKey - create a key from its value and list of options
+func ParseKey(value string, options []string) (*Key, error) {
+	key := &Key{Value: value}
+
+	for _, option := range options {
+		name, value := option, ""
+		if i := strings.Index(option, "="); i >= 0 {
+			name, value = option[:i], option[i+1:]
+		}
+
+		switch name {
+		case "robots":
+			key.Robots = true
+		case "max_body":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return nil, fmt.Errorf("max_body must be a number of bytes, got %q", value)
+			}
+			key.Limits.MaxBodySize = size
+		case "content_types":
+			key.Limits.ContentTypes = parseContentTypes(value)
+		}
+	}
+
+	return key, nil
+}
+
+// NewKeyList make new list of api keys
+func NewKeyList() *KeyList {
+	return &KeyList{
+		Filename: os.Getenv("GPM_API_KEYS"),
+		keys:     make(map[string]*Key),
+	}
+}
@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// BodyTooLargeError - the response body is bigger than allowed
+type BodyTooLargeError struct {
+	URL   string
+	Limit int64
+}
+
+func (e *BodyTooLargeError) Error() string {
+	return fmt.Sprintf("response body from %s exceeds the limit of %d bytes", e.URL, e.Limit)
+}
+
+// ContentTypeError - the response content type is not allowed
+type ContentTypeError struct {
+	URL         string
+	ContentType string
+}
+
+func (e *ContentTypeError) Error() string {
+	return fmt.Sprintf("content type %s received from %s is not allowed", e.ContentType, e.URL)
+}
+
+// BodyLimits - restrictions of the response body
+type BodyLimits struct {
+	// maximum size of the body in bytes, 0 means no limit
+	MaxBodySize int64
+	// allowed media types, `text/*` matches any text, empty list allows everything
+	ContentTypes []string
+}
+
+// Merge - limits satisfying both of the limits
+func (bl BodyLimits) Merge(other BodyLimits) BodyLimits {
+	merged := bl
+	if other.MaxBodySize > 0 && (merged.MaxBodySize == 0 || other.MaxBodySize < merged.MaxBodySize) {
+		merged.MaxBodySize = other.MaxBodySize
+	}
+
+	if len(merged.ContentTypes) == 0 {
+		merged.ContentTypes = other.ContentTypes
+	} else if len(other.ContentTypes) > 0 {
+		// only the types allowed by both lists are allowed
+		var both []string
+		for _, contentType := range merged.ContentTypes {
+			if matchContentType(other.ContentTypes, contentType) {
+				both = append(both, contentType)
+			}
+		}
+
+		for _, contentType := range other.ContentTypes {
+			if matchContentType(merged.ContentTypes, contentType) && !matchContentType(both, contentType) {
+				both = append(both, contentType)
+			}
+		}
+
+		if len(both) == 0 {
+			// nothing can match, keep a type no response has
+			both = []string{"none/none"}
+		}
+		merged.ContentTypes = both
+	}
+
+	return merged
+}
+
+// Check - checks the headers of the response from the URL against the limits
+// Content-Length allows rejecting a big body before reading it
+func (bl BodyLimits) Check(url string, response *http.Response) error {
+	if bl.MaxBodySize > 0 && response.ContentLength > bl.MaxBodySize {
+		return &BodyTooLargeError{URL: url, Limit: bl.MaxBodySize}
+	}
+
+	if len(bl.ContentTypes) > 0 {
+		mediaType, _, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+		if err != nil {
+			mediaType = "application/octet-stream"
+		}
+
+		if !matchContentType(bl.ContentTypes, mediaType) {
+			return &ContentTypeError{URL: url, ContentType: mediaType}
+		}
+	}
+
+	return nil
+}
+
+// limitResponse - enforce the limits on a response served from the cache or shared by a flight,
+// such responses may have been fetched under the limits of other requests
+func limitResponse(response *FirstResponse, limits BodyLimits, destinationURL string) *FirstResponse {
+	if !response.IsValid() {
+		return response
+	}
+
+	if err := limits.Check(destinationURL, response.Response); err != nil {
+		response.CloseBody()
+		return NewInvalidFirstResponse(err, false, response.elapsed)
+	}
+
+	if limits.MaxBodySize > 0 {
+		response.Response.Body = newLimitedBody(response.Response.Body, destinationURL, limits.MaxBodySize)
+	}
+
+	return response
+}
+
+// matchContentType - checks the media type against the allowed ones
+func matchContentType(allowed []string, mediaType string) bool {
+	for _, pattern := range allowed {
+		if pattern == mediaType || pattern == "*/*" {
+			return true
+		}
+
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseContentTypes - parse a comma separated list of media types
+func parseContentTypes(value string) []string {
+	var contentTypes []string
+	for _, contentType := range strings.Split(value, ",") {
+		if contentType = strings.ToLower(strings.TrimSpace(contentType)); contentType != "" {
+			contentTypes = append(contentTypes, contentType)
+		}
+	}
+
+	return contentTypes
+}
+
+// limitedBody - fails reading the body once it exceeds the limit
+type limitedBody struct {
+	io.ReadCloser
+	url       string
+	limit     int64
+	remaining int64
+	err       error
+}
+
+func (lb *limitedBody) Read(p []byte) (int, error) {
+	if lb.err != nil {
+		return 0, lb.err
+	}
+
+	// read a byte more than allowed to find out the body is too large
+	if int64(len(p)) > lb.remaining+1 {
+		p = p[:lb.remaining+1]
+	}
+
+	n, err := lb.ReadCloser.Read(p)
+	if int64(n) > lb.remaining {
+		lb.err = &BodyTooLargeError{URL: lb.url, Limit: lb.limit}
+		return int(lb.remaining), lb.err
+	}
+	lb.remaining -= int64(n)
+
+	return n, err
+}
+
+func newLimitedBody(body io.ReadCloser, url string, limit int64) *limitedBody {
+	return &limitedBody{ReadCloser: body, url: url, limit: limit, remaining: limit}
+}
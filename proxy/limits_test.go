@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+func TestBodyLimits(t *testing.T) {
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/big":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Length", "2048")
+			w.Write([]byte(strings.Repeat("a", 2048)))
+		case "/chunked":
+			// no Content-Length so the size is only known while reading
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(strings.Repeat("a", 512)))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(strings.Repeat("a", 1536)))
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("png"))
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, "small body")
+		}
+	}))
+	defer destination.Close()
+
+	list := NewList()
+	list.Filename = "../proxy.list.example"
+	list.Load()
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	server := NewServer(logger, list)
+	key, _ := ParseKey("limited", []string{"max_body=1024", "content_types=text/*"})
+	server.keys.Add(key)
+
+	r := chi.NewRouter()
+	r.Use(server.CheckAPIKey)
+	r.With(server.ProxyGetRequest).Get("/get", server.ProxyGetResponse)
+	r.Get("/usage", server.GetUsage)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	get := func(path, query string) string {
+		return "/get?api_key=limited&url=" + uriEncode(destination.URL+path) + query
+	}
+
+	t.Run("allowed response", func(t *testing.T) {
+		resp, body := testRequest(t, ts, "GET", get("/small", ""), nil)
+		if resp.StatusCode != http.StatusOK || body != "small body" {
+			t.Fatalf("Expected small body, got %d %q", resp.StatusCode, body)
+		}
+	})
+
+	t.Run("rejected responses", func(t *testing.T) {
+		tests := []struct {
+			path  string
+			query string
+			code  string
+		}{
+			{"/big", "", ErrorCodeBodyTooLarge},
+			{"/small", "&max_body_size=5", ErrorCodeBodyTooLarge},
+			{"/image", "", ErrorCodeContentType},
+			{"/small", "&content_types=application/json", ErrorCodeContentType},
+		}
+
+		for _, tc := range tests {
+			resp, _ := testRequest(t, ts, "GET", get(tc.path, tc.query), nil)
+			if resp.StatusCode != http.StatusBadGateway {
+				t.Fatalf("%s%s: expected 502, got %d", tc.path, tc.query, resp.StatusCode)
+			}
+
+			if code := resp.Header.Get(ErrorCodeHeader); code != tc.code {
+				t.Fatalf("%s%s: expected %s error code, got %q", tc.path, tc.query, tc.code, code)
+			}
+		}
+	})
+
+	t.Run("body without length is cut at the limit", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + get("/chunked", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err == nil {
+			t.Fatalf("Expected body over the limit to fail, got %d bytes", len(body))
+		}
+
+		if len(body) > 1024 {
+			t.Fatalf("Expected at most 1024 bytes, got %d", len(body))
+		}
+	})
+
+	t.Run("cached responses are limited", func(t *testing.T) {
+		cache := server.cache
+		defer func() { server.cache = cache }()
+		server.cache = &ResponseCache{store: NewMemoryCacheStore(1 << 20), overrideTTL: time.Minute, maxEntrySize: 1 << 20}
+
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		response, status := server.fetch(req, &RequestSpec{Method: "GET", URL: destination.URL + "/image"})
+		response.CloseBody()
+		if status != CacheMiss || !response.IsValid() {
+			t.Fatalf("Expected the response to be cached, got %s %v", status, response.GetError())
+		}
+
+		limited := &RequestSpec{Method: "GET", URL: destination.URL + "/image", Options: RequestOptions{ContentTypes: []string{"text/html"}}}
+		response, status = server.fetch(req, limited)
+		if status != CacheHit || errorCode(response.GetError()) != ErrorCodeContentType {
+			t.Fatalf("Expected the cached response to be rejected, got %s %v", status, response.GetError())
+		}
+	})
+
+	t.Run("malformed key", func(t *testing.T) {
+		if _, err := ParseKey("broken", []string{"max_body=10MB"}); err == nil {
+			t.Fatalf("Expected max_body to be rejected")
+		}
+	})
+
+	t.Run("usage", func(t *testing.T) {
+		_, body := testRequest(t, ts, "GET", "/usage?api_key=limited", nil)
+
+		var usage struct {
+			Key     UsageStats            `json:"key"`
+			Proxies map[string]UsageStats `json:"proxies"`
+		}
+		if err := json.Unmarshal([]byte(body), &usage); err != nil {
+			t.Fatal(err)
+		}
+
+		if usage.Key.Requests == 0 || usage.Key.Bytes < int64(len("small body")) {
+			t.Fatalf("Expected key traffic to be accounted, got %+v", usage.Key)
+		}
+
+		if usage.Proxies[directProxy].Bytes < int64(len("small body")) {
+			t.Fatalf("Expected direct traffic to be accounted, got %+v", usage.Proxies)
+		}
+	})
+}
+
+func TestBodyLimitsMerge(t *testing.T) {
+	tests := []struct {
+		a, b     BodyLimits
+		expected BodyLimits
+	}{
+		{BodyLimits{}, BodyLimits{MaxBodySize: 10}, BodyLimits{MaxBodySize: 10}},
+		{BodyLimits{MaxBodySize: 5}, BodyLimits{MaxBodySize: 10}, BodyLimits{MaxBodySize: 5}},
+		{
+			BodyLimits{ContentTypes: []string{"text/html", "application/json"}},
+			BodyLimits{ContentTypes: []string{"text/*"}},
+			BodyLimits{ContentTypes: []string{"text/html"}},
+		},
+		{
+			BodyLimits{ContentTypes: []string{"image/png"}},
+			BodyLimits{ContentTypes: []string{"text/*"}},
+			BodyLimits{ContentTypes: []string{"none/none"}},
+		},
+	}
+
+	for _, tc := range tests {
+		if merged := tc.a.Merge(tc.b); !reflect.DeepEqual(merged, tc.expected) {
+			t.Fatalf("Expected %+v, got %+v", tc.expected, merged)
+		}
+	}
+}
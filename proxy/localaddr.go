@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// localScheme - pseudo-proxies of local addresses look like local://192.0.2.1
+const localScheme = "local://"
+
+// localProxy - pseudo-proxy of the local address
+func localProxy(ip net.IP) string {
+	if ip.To4() != nil {
+		return localScheme + ip.String()
+	}
+
+	return localScheme + "[" + ip.String() + "]"
+}
+
+// localAddress - local address of the pseudo-proxy, nil for anything else
+func localAddress(proxy string) net.IP {
+	if !strings.HasPrefix(proxy, localScheme) {
+		return nil
+	}
+
+	return net.ParseIP(strings.Trim(strings.TrimPrefix(proxy, localScheme), "[]"))
+}
+
+// isDirect - checks if the attempt connects to the destination itself
+// from the default route or from an address of the local pool
+func isDirect(proxy string) bool {
+	return proxy == directProxy || localAddress(proxy) != nil
+}
+
+// parseLocalAddress - a single address or a block the addresses are sampled from
+func parseLocalAddress(address string) (*net.IPNet, error) {
+	if strings.Contains(address, "/") {
+		_, block, err := net.ParseCIDR(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid local address block %s: %v", address, err)
+		}
+		return block, nil
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid local address %s", address)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// sampleAddress - random address of the block, the network and broadcast addresses of IPv4 blocks are skipped
+func sampleAddress(r *rand.Rand, block *net.IPNet) net.IP {
+	ones, bits := block.Mask.Size()
+	if ones == bits {
+		return block.IP
+	}
+
+	for {
+		ip := make(net.IP, len(block.IP))
+		r.Read(ip)
+		for i := range ip {
+			ip[i] = block.IP[i] | (ip[i] &^ block.Mask[i])
+		}
+
+		if bits == 32 && bits-ones > 1 && (ip.Equal(block.IP) || ip.Equal(broadcastAddress(block))) {
+			continue
+		}
+
+		return ip
+	}
+}
+
+func broadcastAddress(block *net.IPNet) net.IP {
+	ip := make(net.IP, len(block.IP))
+	for i := range ip {
+		ip[i] = block.IP[i] | ^block.Mask[i]
+	}
+
+	return ip
+}
+
+// localDial - dial from the local address, the destination is resolved to addresses of the same family
+// the address does not have to be assigned to an interface, see freebind
+func localDial(ip net.IP, resolver *Resolver) dialFunc {
+	network := "tcp6"
+	if ip.To4() != nil {
+		network = "tcp4"
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		LocalAddr: &net.TCPAddr{IP: ip},
+		Control:   freebind,
+	}
+
+	return func(ctx context.Context, _, addr string) (net.Conn, error) {
+		if resolver != nil {
+			return resolver.dialWith(ctx, dialer, network, addr)
+		}
+
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
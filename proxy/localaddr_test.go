@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+func TestLocalAddresses(t *testing.T) {
+	// responds with the address the request came from
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		fmt.Fprint(w, host)
+	}))
+	defer destination.Close()
+
+	list := NewList()
+	list.Filename = "../proxy.list.example"
+	list.Load()
+	for _, address := range []string{"127.0.0.2", "127.0.0.3"} {
+		if err := list.AddLocal(address); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	server := NewServer(logger, list)
+
+	r := chi.NewRouter()
+	r.With(server.ProxyGetRequest).Get("/get", server.ProxyGetResponse)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	t.Run("direct attempts go out from the pool", func(t *testing.T) {
+		used := make(map[string]bool)
+		for i := 0; i < 20; i++ {
+			resp, body := testRequest(t, ts, "GET", "/get?diagnostics=1&url="+uriEncode(destination.URL), nil)
+			if body != "127.0.0.2" && body != "127.0.0.3" {
+				t.Fatalf("Expected an address of the pool, got %s", body)
+			}
+			used[body] = true
+
+			var diagnostics Diagnostics
+			if err := json.Unmarshal([]byte(resp.Header.Get(DiagnosticsHeader)), &diagnostics); err != nil {
+				t.Fatal(err)
+			}
+			if diagnostics.Attempts[0].Proxy != "local://"+body {
+				t.Fatalf("Expected the local address in diagnostics, got %s", resp.Header.Get(DiagnosticsHeader))
+			}
+		}
+
+		if len(used) != 2 {
+			t.Fatalf("Expected both addresses to be used, got %v", used)
+		}
+	})
+
+	t.Run("excluded addresses", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			if proxy := list.RandLocal(map[string]bool{"local://127.0.0.2": true}); proxy != "local://127.0.0.3" {
+				t.Fatalf("Expected the address that is not excluded, got %s", proxy)
+			}
+		}
+
+		if proxy := list.RandLocal(map[string]bool{"local://127.0.0.2": true, "local://127.0.0.3": true}); proxy != "" {
+			t.Fatalf("Expected no address, got %s", proxy)
+		}
+	})
+
+	t.Run("blocks are sampled", func(t *testing.T) {
+		blocks := NewList()
+		if err := blocks.AddLocal("127.0.1.0/24"); err != nil {
+			t.Fatal(err)
+		}
+		if err := blocks.AddLocal("2001:db8::/64"); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 50; i++ {
+			ip := localAddress(blocks.RandLocal(nil))
+			if ip == nil {
+				t.Fatalf("Expected a local address")
+			}
+
+			if ip.To4() != nil {
+				if !strings.HasPrefix(ip.String(), "127.0.1.") || ip.String() == "127.0.1.0" || ip.String() == "127.0.1.255" {
+					t.Fatalf("Unexpected address %s", ip)
+				}
+			} else if !strings.HasPrefix(ip.String(), "2001:db8::") {
+				t.Fatalf("Unexpected address %s", ip)
+			}
+		}
+	})
+
+	t.Run("sampled addresses are not pooled", func(t *testing.T) {
+		blocks := NewList()
+		if err := blocks.AddLocal("127.0.1.0/24"); err != nil {
+			t.Fatal(err)
+		}
+
+		blockServer := NewServer(logger, blocks)
+		r := chi.NewRouter()
+		r.With(blockServer.ProxyGetRequest).Get("/get", blockServer.ProxyGetResponse)
+		ts := httptest.NewServer(r)
+		defer ts.Close()
+
+		for i := 0; i < 5; i++ {
+			if _, body := testRequest(t, ts, "GET", "/get?url="+uriEncode(destination.URL), nil); !strings.HasPrefix(body, "127.0.1.") {
+				t.Fatalf("Expected an address of the block, got %s", body)
+			}
+		}
+
+		if !blocks.IsSampled("local://127.0.1.7") || list.IsSampled("local://127.0.0.2") {
+			t.Fatalf("Expected only addresses of blocks to be sampled")
+		}
+		if blockServer.transports.Len() != 0 {
+			t.Fatalf("Expected no pooled transports, got %d", blockServer.transports.Len())
+		}
+	})
+
+	t.Run("sampled addresses are bound without being assigned", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("binding unassigned addresses needs IP_FREEBIND")
+		}
+
+		ip := sampleAddress(rand.New(rand.NewSource(1)), &net.IPNet{IP: net.ParseIP("192.0.2.0").To4(), Mask: net.CIDRMask(24, 32)})
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+
+		conn, err := localDial(ip, nil)(ctx, "tcp", destination.Listener.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+		if errors.Is(err, syscall.EADDRNOTAVAIL) {
+			t.Fatalf("Expected %s to be bound, got %v", ip, err)
+		}
+	})
+
+	t.Run("invalid addresses", func(t *testing.T) {
+		for _, address := range []string{"nope", "10.0.0.0/33"} {
+			if err := list.AddLocal(address); err == nil {
+				t.Fatalf("Expected %s to be rejected", address)
+			}
+		}
+	})
+}
@@ -0,0 +1,315 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// maximum number of leaf certificates kept in cache
+const maxLeafCertificates = 1024
+
+// CertificateAuthority - local CA issuing leaf certificates for intercepted hosts
+type CertificateAuthority struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+
+	mu     sync.Mutex
+	order  *list.List
+	leaves map[string]*list.Element
+}
+
+type leafEntry struct {
+	host string
+	cert *tls.Certificate
+}
+
+// Leaf - get a certificate for the host signed by the CA
+// certificates are generated on the fly and cached
+func (ca *CertificateAuthority) Leaf(host string) (*tls.Certificate, error) {
+	ca.mu.Lock()
+	if element, ok := ca.leaves[host]; ok {
+		ca.order.MoveToFront(element)
+		ca.mu.Unlock()
+		return element.Value.(*leafEntry).cert, nil
+	}
+	ca.mu.Unlock()
+
+	cert, err := ca.issue(host)
+	if err != nil {
+		return nil, err
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	ca.leaves[host] = ca.order.PushFront(&leafEntry{host: host, cert: cert})
+	for ca.order.Len() > maxLeafCertificates {
+		entry := ca.order.Remove(ca.order.Back()).(*leafEntry)
+		delete(ca.leaves, entry.host)
+	}
+
+	return cert, nil
+}
+
+// issue - generate a leaf certificate for the host
+func (ca *CertificateAuthority) issue(host string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		// browsers reject leaf certificates valid for more than 398 days
+		NotAfter:    now.Add(365 * 24 * time.Hour),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  key,
+	}, nil
+}
+
+// CertificatePEM - CA certificate that clients should trust
+func (ca *CertificateAuthority) CertificatePEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
+
+// CreateCA - generate a new CA and write its certificate and key to the files
+func CreateCA(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "gpm interception CA", Organization: []string{"gpm"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+}
+
+// LoadCA - load the CA from its certificate and key files
+func LoadCA(certFile, keyFile string) (*CertificateAuthority, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if !cert.IsCA {
+		return nil, fmt.Errorf("%s is not a CA certificate", certFile)
+	}
+
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("CA private key can't be used for signing")
+	}
+
+	return &CertificateAuthority{
+		cert:   cert,
+		key:    key,
+		order:  list.New(),
+		leaves: make(map[string]*list.Element),
+	}, nil
+}
+
+// CACommand - create or export the interception CA
+// create writes new CA files, export prints the certificate clients should trust
+func CACommand(args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("usage: gpm ca create|export")
+	}
+
+	certFile, keyFile := getCACertFile(), getCAKeyFile()
+
+	switch args[0] {
+	case "create":
+		if _, err := os.Stat(certFile); err == nil {
+			return fmt.Errorf("%s already exists", certFile)
+		}
+
+		if err := CreateCA(certFile, keyFile); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "CA certificate written to %s, private key to %s\n", certFile, keyFile)
+		return nil
+	case "export":
+		ca, err := LoadCA(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+
+		_, err = out.Write(ca.CertificatePEM())
+		return err
+	default:
+		return fmt.Errorf("unknown ca command %s", args[0])
+	}
+}
+
+func randomSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial
+}
+
+// interceptConnect - terminate TLS of the tunnel with a certificate issued by the local CA
+// and multiplex every decrypted request like a plain forward proxy request
+func (s *Server) interceptConnect(w http.ResponseWriter, r *http.Request, target string) {
+	host, _, _ := net.SplitHostPort(target)
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Tunnels are not supported", http.StatusInternalServerError)
+		return
+	}
+
+	clientConn, _, err := hijacker.Hijack()
+	if err != nil {
+		s.logger.Printf("Could not hijack connection %v", err)
+		return
+	}
+
+	if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		clientConn.Close()
+		return
+	}
+
+	tlsConn := tls.Server(clientConn, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" {
+				return s.mitm.Leaf(hello.ServerName)
+			}
+			return s.mitm.Leaf(host)
+		},
+		NextProtos: []string{"http/1.1"},
+	})
+
+	if err := tlsConn.Handshake(); err != nil {
+		s.logger.Printf("TLS handshake with client for %s failed %v", target, err)
+		tlsConn.Close()
+		return
+	}
+
+	// decrypted requests keep the api key of the tunnel
+	ctx := context.WithValue(context.Background(), apiKeyKey, r.Context().Value(apiKeyKey))
+	listener := newSingleConnListener(tlsConn)
+
+	interceptor := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.URL.Scheme = "https"
+			r.URL.Host = r.Host
+			if r.URL.Host == "" {
+				r.URL.Host = target
+			}
+
+			s.proxyAbsolute(w, r)
+		}),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				listener.Close()
+			}
+		},
+	}
+
+	interceptor.Serve(listener)
+}
+
+// singleConnListener - listener accepting a single already established connection
+type singleConnListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() {
+		conn = l.conn
+	})
+
+	if conn != nil {
+		return conn, nil
+	}
+
+	<-l.closed
+	return nil, errors.New("listener closed")
+}
+
+func (l *singleConnListener) Close() error {
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+	}
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	return &singleConnListener{conn: conn, closed: make(chan struct{})}
+}
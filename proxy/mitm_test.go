@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCertificateAuthority(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gpm-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+	if err := CreateCA(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := LoadCA(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca.CertificatePEM())
+
+	for _, host := range []string{"example.com", "127.0.0.1"} {
+		leaf, err := ca.Leaf(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cert, _ := x509.ParseCertificate(leaf.Certificate[0])
+		if _, err := cert.Verify(x509.VerifyOptions{DNSName: host, Roots: pool}); err != nil {
+			t.Fatalf("leaf for %s is not valid %v", host, err)
+		}
+
+		cached, _ := ca.Leaf(host)
+		if cached != leaf {
+			t.Fatalf("expected leaf for %s to be cached", host)
+		}
+	}
+
+	if _, err := LoadCA(certFile, filepath.Join(dir, "missing.pem")); err == nil {
+		t.Fatal("expected error for missing key")
+	}
+}
+
+func TestProxyForwardIntercept(t *testing.T) {
+	destination := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.Path, r.Header.Get("X-Test"))
+	}))
+	defer destination.Close()
+
+	dir, err := ioutil.TempDir("", "gpm-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+	if err := CreateCA(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	list := NewList()
+	list.Filename = "../proxy.list.example"
+	list.Load()
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	server := NewServer(logger, list)
+	server.mitm, err = LoadCA(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(server.ProxyForward))
+	defer ts.Close()
+
+	// client trusts only the interception CA so the destination certificate can't be seen
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(server.mitm.CertificatePEM())
+	proxyURL, _ := url.Parse(ts.URL)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+	}
+
+	do := func(t *testing.T, uri string) (*http.Response, string) {
+		req, _ := http.NewRequest("POST", uri, nil)
+		req.Header.Set("X-Test", "intercepted")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+
+		return resp, string(body)
+	}
+
+	t.Run("decrypted requests are multiplexed", func(t *testing.T) {
+		// two requests reuse the same intercepted tunnel
+		for _, path := range []string{"/first", "/second"} {
+			resp, body := do(t, destination.URL+path)
+
+			if resp.StatusCode != http.StatusOK || body != "POST "+path+" intercepted" {
+				t.Fatalf("unexpected response %d %q", resp.StatusCode, body)
+			}
+		}
+	})
+
+	t.Run("origin status is passed through", func(t *testing.T) {
+		resp, _ := do(t, destination.URL+"/missing")
+
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected 404, got %d", resp.StatusCode)
+		}
+	})
+}
@@ -2,8 +2,11 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"strings"
 	"sync"
@@ -12,6 +15,9 @@ import (
 
 const firstRequest = 1
 
+// directProxy - name of the request made without a proxy
+const directProxy = "direct"
+
 // Multiplexer - orchestrates making HTTP requests to the requested URL
 type Multiplexer struct {
 	// holds original request that came from the end user
@@ -21,6 +27,55 @@ type Multiplexer struct {
 	destinationURL string
 	// HTTP Method that should be used
 	method string
+	// additional headers sent with every request
+	header http.Header
+	// body sent with every request
+	body string
+	// decides which statuses win the race, 2** by default
+	acceptStatus func(statusCode int) bool
+	// return redirects instead of following them
+	noRedirects bool
+	// redirect policy, redirects are followed when empty
+	redirect string
+	// maximum number of redirects followed, defaultMaxRedirects when 0
+	maxRedirects int
+	// every redirect goes through another proxy
+	rotateRedirects bool
+	// a response wins only once this many bytes of its body arrived
+	firstBytes int
+	// maximum time a read of the response body may wait for data
+	idleTimeout time.Duration
+	// proxies that must not be used, directProxy excludes the direct request
+	// and local pseudo-proxies exclude addresses of the local pool
+	exclude map[string]bool
+	// restrictions of the response body
+	limits BodyLimits
+	// accounts the traffic of the key, may be nil
+	usage *Usage
+	// api key the requests are made for
+	key string
+	// decompress bodies and transcode text to UTF-8
+	decode bool
+	// responses lacking the values of required extractors fail
+	extractors Extractors
+	// cookies of the session, the winner's cookies are saved to it
+	jar *CookieJar
+	// proxy of the session used by the first request instead of the direct one
+	pinned string
+	// browser header profiles requests are made with, may be nil
+	profiles *ProfileLibrary
+	// profile every request is made with, ProfileNone disables profiles
+	profile string
+	// ClientHello profile every request is made with
+	tlsProfile string
+	// protocol spoken with the destination, HTTP/2 is negotiated when empty
+	protocol string
+	// transports shared with other requests, every attempt gets a new one when nil
+	transports *TransportPool
+	// resolves the hosts attempts connect to, the system resolver is used when nil
+	resolver *Resolver
+	// only proxies of the country or the region are used, nil when the request is not targeted
+	geo *GeoTarget
 
 	// channel for passing the first response from the multiple requests
 	FirstResponse chan *FirstResponse
@@ -32,6 +87,10 @@ type Multiplexer struct {
 	doneCh chan struct{}
 	// since go does not support checking for whether channel is closed this flag is used along with doneCh
 	done bool
+	// index of the request whose response won, 0 until then
+	winner int
+	// every request along with the proxy it goes through
+	attempts map[int]*Attempt
 	// ticker to detect a time out
 	timeoutCh <-chan time.Time
 
@@ -83,7 +142,7 @@ func (m *Multiplexer) processRequest() {
 			m.finish()
 
 			// create a valid first response object and return
-			m.FirstResponse <- NewValidFirstResponse(firstResponse, m.GetElapsedTime())
+			m.respond(NewValidFirstResponse(firstResponse, m.GetElapsedTime()))
 
 			return
 		case newErr := <-m.errorCh:
@@ -91,23 +150,48 @@ func (m *Multiplexer) processRequest() {
 
 			if m.AllErrored() {
 				m.finish()
-				m.FirstResponse <- NewInvalidFirstResponse(m.GetFirstError(), false, m.GetElapsedTime())
+				m.respond(NewInvalidFirstResponse(m.GetFirstError(), false, m.GetElapsedTime()))
 				return
 			}
 		case <-m.timeoutCh:
 			m.finish()
 
 			// on time out create an invalid first response and return
-			m.FirstResponse <- NewInvalidFirstResponse(
+			m.respond(NewInvalidFirstResponse(
 				fmt.Errorf("all requests to %s failed with timeout after waiting for %.3f seconds", m.destinationURL, m.timeout.Seconds()),
 				true,
-				m.GetElapsedTime())
+				m.GetElapsedTime()))
+
+			return
+		case <-m.context.Done():
+			m.finish()
+
+			// nobody is waiting for the response anymore
+			m.respond(NewInvalidFirstResponse(
+				fmt.Errorf("requests to %s were cancelled: %v", m.destinationURL, m.context.Err()),
+				false,
+				m.GetElapsedTime()))
 
 			return
 		}
 	}
 }
 
+// respond - pass the first response along with the diagnostics of the session
+func (m *Multiplexer) respond(response *FirstResponse) {
+	response.proxy, response.profile = m.winnerProxy()
+	response.diagnostics = m.Diagnostics()
+	response.diagnostics.FinalURL = response.GetFinalURL()
+	m.FirstResponse <- response
+}
+
+// SetTimeout - override the timeout taken from env
+// must be called before the request processing starts
+func (m *Multiplexer) SetTimeout(timeout time.Duration) {
+	m.timeout = timeout
+	m.timeoutCh = time.After(timeout + time.Second)
+}
+
 // finish - closes the doneCh and marks done flag as true
 // after that RequestContext should not perform any action
 // all outgoing requests should be canceled
@@ -120,6 +204,113 @@ func (m *Multiplexer) finish() {
 	m.logger.Printf("List of errors for session [%d]: %v", m.session, m.errors)
 }
 
+// deliver - pass the response as the first one unless some other response already won
+// the request context of the winner is kept until its body is closed
+func (m *Multiplexer) deliver(index int, response *http.Response) bool {
+	m.doneMu.Lock()
+	defer m.doneMu.Unlock()
+
+	if m.done || m.winner != 0 {
+		return false
+	}
+
+	m.winner = index
+	// cookies must be saved before the response reaches the client
+	if attempt, ok := m.attempts[index]; ok && attempt.jar != nil {
+		attempt.jar.commit(m.jar)
+	}
+	m.responseCh <- response
+
+	return true
+}
+
+// winnerProxy - proxy and header profile used by the request that delivered the first response
+func (m *Multiplexer) winnerProxy() (string, string) {
+	m.doneMu.Lock()
+	defer m.doneMu.Unlock()
+	if attempt, ok := m.attempts[m.winner]; ok {
+		return attempt.proxy, attempt.Profile
+	}
+	return "", ""
+}
+
+// pickProxy - choose the proxy for the request with the index
+// the first request goes through the pinned proxy if any
+// or directly unless direct requests are excluded or the request is geo targeted
+// direct requests go out from an address of the local pool unless it is empty or excluded
+// returns an empty string when no proxy matches the geo target or the list is empty,
+// oneOff reports a proxy made up for the attempt, a gateway session or an address sampled from a block
+func (m *Multiplexer) pickProxy(index int) (proxy string, oneOff bool) {
+	proxy = directProxy
+	var tag string
+	if index == firstRequest && m.pinned != "" {
+		proxy = m.pinned
+	} else if index != firstRequest || m.exclude[directProxy] || m.geo != nil {
+		proxy, tag, oneOff = m.randProxy(m.exclude)
+	} else if local := m.proxyList.RandLocal(m.exclude); local != "" {
+		proxy, oneOff = local, m.proxyList.IsSampled(local)
+	}
+
+	m.startAttempt(index, proxy)
+	if tag != "" {
+		m.recordAttempt(index, func(attempt *Attempt) {
+			attempt.Tag = tag
+		})
+	}
+
+	return proxy, oneOff
+}
+
+// randProxy - random proxy skipping the excluded ones along with the tag it was picked by,
+// proxies of the geo target only when the request is targeted
+// every attempt through a gateway gets a session of its own, such proxies are reported as one-off
+func (m *Multiplexer) randProxy(exclude map[string]bool) (string, string, bool) {
+	if m.geo == nil {
+		proxy := m.proxyList.RandExcept(exclude)
+		if proxy == "" {
+			// everything is excluded, better retry a proxy than give up
+			proxy = m.proxyList.Rand()
+		}
+
+		return fillGateway(proxy, ""), "", isGateway(proxy)
+	}
+
+	for _, tags := range m.geo.stages() {
+		proxy, tag := m.proxyList.RandTagged(exclude, tags)
+		if proxy == "" {
+			// better retry a proxy of the target than widen
+			proxy, tag = m.proxyList.RandTagged(nil, tags)
+		}
+
+		if proxy != "" {
+			country := ""
+			if containsTag(getGatewayCountries(), tag) {
+				country = tag
+			}
+
+			return fillGateway(proxy, country), tag, isGateway(proxy)
+		}
+	}
+
+	return "", "", false
+}
+
+// unavailable - error of an attempt no proxy is left for
+func (m *Multiplexer) unavailable() *CodedError {
+	if m.geo != nil {
+		return m.geo.unavailable()
+	}
+
+	return noProxiesError()
+}
+
+// isWinner - checks if the request with the index delivered the first response
+func (m *Multiplexer) isWinner(index int) bool {
+	m.doneMu.Lock()
+	defer m.doneMu.Unlock()
+	return m.winner == index
+}
+
 // IsDone - checks whether RequestContext is done with it's activity
 func (m *Multiplexer) IsDone() bool {
 	m.doneMu.Lock()
@@ -140,20 +331,22 @@ func (m *Multiplexer) AllErrored() bool {
 }
 
 // GetFirstError get an error that was mostly or excludively encountered during requests
-// otherwise just return that all requests failed
+// an error received from the destination itself is preferred over
+// transport errors since it describes the destination rather than a proxy
 func (m *Multiplexer) GetFirstError() error {
-	return m.errors[0]
-	// if m.AllErrored() {
-	// 	for _, err := range m.errors {
-	// 		for _, anotherErr := range m.errors {
-	// 			if err.Error() != anotherErr.Error() {
-	// 				return fmt.Errorf("all requests to %s have failed", m.destinationURL)
-	// 			}
-	// 		}
-	// 	}
-
-	// 	return m.errors[0]
-	// }
+	m.errorMu.Lock()
+	defer m.errorMu.Unlock()
+
+	for _, err := range m.errors {
+		switch err.(type) {
+		case *StatusError, *BodyTooLargeError, *ContentTypeError, *ExtractionError, *TooManyRedirectsError, *DNSError:
+			return err
+		}
+	}
+
+	if len(m.errors) > 0 {
+		return m.errors[0]
+	}
 
 	return fmt.Errorf("all requests to %s have failed", m.destinationURL)
 }
@@ -176,8 +369,13 @@ func (m *Multiplexer) SafeClose() {
 	m.once.Do(func() {
 		close(m.responseCh)
 		close(m.FirstResponse)
-		close(m.errorCh)
+		// errorCh is left open, late attempts still report to it and give up once doneCh is closed
 		m.canelContext()
+
+		// a response delivered after the multiplexer gave up is never read
+		for response := range m.responseCh {
+			response.Body.Close()
+		}
 		m.logger.Printf("Request context [%d] in now closed", m.session)
 	})
 
@@ -189,14 +387,32 @@ func (m *Multiplexer) GetElapsedTime() time.Duration {
 	return time.Now().UTC().Sub(m.startedAt)
 }
 
-func (m *Multiplexer) createRequest() *http.Request {
-	req, _ := http.NewRequest(m.method, m.destinationURL, nil)
+// createRequest - request of an attempt, the header profile is applied unless it is nil
+func (m *Multiplexer) createRequest(ctx context.Context, profile *HeaderProfile) *http.Request {
+	var body io.Reader
+	if m.body != "" {
+		body = strings.NewReader(m.body)
+	}
+
+	req, _ := http.NewRequest(m.method, m.destinationURL, body)
+
+	for key, values := range m.header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+
+	if profile != nil {
+		profile.apply(req, m.header)
+	} else if userAgent := getUserAgent(); userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
 
 	// dump the request to the console
 	dump, _ := httputil.DumpRequest(req, false)
 	fmt.Println(string(dump))
 
-	return req.WithContext(m.context)
+	return req.WithContext(ctx)
 }
 
 func (m *Multiplexer) multiplex(index int) {
@@ -208,22 +424,54 @@ func (m *Multiplexer) multiplex(index int) {
 		}
 	}()
 
-	var transport *http.Transport
-	var err error
+	proxy, oneOff := m.pickProxy(index)
+	if proxy == "" {
+		// the proxies are gone since the request started
+		m.attemptFailed(index, m.unavailable())
+		return
+	}
+	profile := m.pickProfile(index, proxy)
+	tlsProfile := m.pickTLSProfile(index, profile)
 
-	if index == firstRequest {
-		transport = NewTransport()
-	} else {
-		transport, err = NewProxiedTransport(m.proxyList.Rand())
-		if err != nil {
-			m.logger.Printf("Could not create proxied transport, falls back to default one")
-		}
+	transport, err := m.attemptTransport(proxy, profile, tlsProfile, oneOff)
+	if err != nil && isChain(proxy) {
+		// going direct would skip every hop of the chain
+		m.attemptFailed(index, err)
+		return
+	} else if err != nil {
+		m.logger.Printf("Could not prepare transport, falls back to default one %v", err)
 	}
 
 	// create a new client
 	client := NewClient(transport)
+	client.CheckRedirect = m.checkRedirect(index)
+	if m.jar != nil {
+		jar := newAttemptJar(m.jar)
+		m.recordAttempt(index, func(attempt *Attempt) {
+			attempt.jar = jar
+		})
+		client.Jar = jar
+	}
+	if m.rotateRedirects {
+		client.Transport = &rotatingTransport{
+			m:          m,
+			index:      index,
+			first:      transport,
+			used:       map[string]bool{proxy: true},
+			profile:    profile,
+			tlsProfile: tlsProfile,
+		}
+	}
+	// every request has a context of its own, so the winner can keep reading
+	// its body after the multiplexer is done and the rest are cancelled
+	ctx, cancel := context.WithCancel(m.originalRequest.Context())
 	// create a new request
-	req := m.createRequest()
+	req := m.createRequest(httptrace.WithClientTrace(m.hopTrace(ctx, index), m.attemptTrace(index)), profile)
+	addProxyHeader(req, proxy)
+
+	if m.usage != nil {
+		m.usage.Request(m.key, proxy)
+	}
 
 	go func() {
 		defer func() {
@@ -237,47 +485,137 @@ func (m *Multiplexer) multiplex(index int) {
 		if err != nil {
 			// we don't want to register an error when context has timed out
 			// for any timout error there is a specialized handler
-			if strings.Contains(err.Error(), "context") || strings.Contains(err.Error(), "canceled") {
+			var tooManyRedirects *TooManyRedirectsError
+			var dnsErr *DNSError
+			if errors.As(err, &tooManyRedirects) {
+				m.attemptFailed(index, tooManyRedirects)
+			} else if strings.Contains(err.Error(), "context") || strings.Contains(err.Error(), "canceled") {
 				m.logger.Printf("\nRequest to %s within session [%d] got cancelled", req.URL, m.session)
+			} else if errors.As(err, &dnsErr) && isDirect(proxy) {
+				// the destination itself could not be resolved
+				m.attemptFailed(index, dnsErr)
 			} else {
 				// will save error in errors list
-				m.errorOccurred(
+				m.attemptFailed(index,
 					fmt.Errorf("\nRequest to %s failed with error [%s]", req.URL, err.Error()))
 			}
 
+			cancel()
+			return
+		}
+
+		m.recordAttempt(index, func(attempt *Attempt) {
+			attempt.Status = response.StatusCode
+			attempt.Protocol = response.Proto
+			attempt.Elapsed = time.Since(attempt.startedAt).Seconds()
+		})
+
+		if m.usage != nil {
+			response.Body = &countingBody{ReadCloser: response.Body, account: func(n int64) {
+				m.usage.Bytes(m.key, proxy, n)
+			}}
+		}
+
+		// check if response is one of 2** or an expected 304
+		if !m.accepts(response) {
+			m.attemptFailed(index, &StatusError{StatusCode: response.StatusCode, URL: req.URL.String()})
+			response.Body.Close()
+			cancel()
+			return
+		}
+
+		if err := m.limits.Check(req.URL.String(), response); err != nil {
+			m.attemptFailed(index, err)
+			response.Body.Close()
+			cancel()
 			return
 		}
 
-		// check if response is one of 2**
-		if response.StatusCode >= 200 && response.StatusCode < 300 {
-			if !m.IsDone() {
-				m.responseCh <- response
+		if m.limits.MaxBodySize > 0 {
+			response.Body = newLimitedBody(response.Body, req.URL.String(), m.limits.MaxBodySize)
+		}
+
+		if m.decode {
+			if err := decodeResponse(response, m.limits.MaxBodySize); err != nil {
+				m.attemptFailed(index, err)
+				response.Body.Close()
+				cancel()
+				return
+			}
+		}
+
+		if m.extractors.Required() && extractable(response.StatusCode) {
+			if err := checkExtractors(response, m.extractors); err != nil {
+				m.attemptFailed(index, err)
+				cancel()
+				return
+			}
+		}
+
+		if m.firstBytes > 0 {
+			// the body must start flowing before the response can win
+			if err := prefetch(response, m.firstBytes, m.idleTimeout, cancel); err != nil {
+				// a stalled read is interrupted by cancelling the request
+				// any other cancellation means the request lost
+				if _, stalled := err.(*StallError); stalled || ctx.Err() == nil {
+					m.attemptFailed(index, err)
+				}
+				cancel()
 				return
 			}
-			m.logger.Printf("\nResponse to request to %s already received", req.URL)
 		} else {
-			m.errorOccurred(fmt.Errorf("error status %d received from %s", response.StatusCode, req.URL))
+			response.Body = &attemptBody{Reader: response.Body, body: response.Body, cancel: cancel}
+		}
+
+		if m.deliver(index, response) {
+			return
 		}
 
 		// close response body of any response that was not passed to the channel
+		m.logger.Printf("\nResponse to request to %s already received", req.URL)
 		response.Body.Close()
 	}()
 
 	select {
 	case <-m.doneCh:
+		if m.isWinner(index) {
+			return
+		}
 		m.logger.Printf("\nMultiplexer on session [%d] is done. Cancelling remaining requests", m.session)
-		transport.CancelRequest(req)
+		cancel()
 		return
-	case <-m.context.Done():
+	case <-ctx.Done():
 		m.logger.Printf("\nContext on session [%d] was cancelled. Cancelling remaining requests", m.session)
-		transport.CancelRequest(req)
 		return
 	}
 }
 
+// accepts - checks whether the response is good enough to be the first response
+// 304 is only expected for conditional requests
+func (m *Multiplexer) accepts(response *http.Response) bool {
+	// a redirect that is not followed is passed to the client
+	if m.returnsRedirects() && response.StatusCode >= 300 && response.StatusCode < 400 && response.Header.Get("Location") != "" {
+		return true
+	}
+
+	if m.acceptStatus != nil {
+		return m.acceptStatus(response.StatusCode)
+	}
+
+	if response.StatusCode == http.StatusNotModified {
+		return m.header.Get("If-None-Match") != "" || m.header.Get("If-Modified-Since") != ""
+	}
+
+	return response.StatusCode >= 200 && response.StatusCode < 300
+}
+
 func (m *Multiplexer) errorOccurred(err error) {
 	m.logger.Println(err)
-	m.errorCh <- err
+
+	select {
+	case m.errorCh <- err:
+	case <-m.doneCh:
+	}
 }
 
 // NewMultiplexer - create new request context
@@ -310,6 +648,7 @@ func NewMultiplexer(
 		timeout:         timeout,
 		concurrentTries: cuncurrentTries,
 		session:         session,
+		attempts:        make(map[int]*Attempt),
 		destinationURL:  destinationURL,
 		method:          method,
 		proxyList:       proxyList,
@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// RequestOptions - options the client may pass along with a request
+type RequestOptions struct {
+	// share a single multiplexer session with identical concurrent requests
+	Coalesce bool `json:"coalesce"`
+	// seconds to wait for the first response, overrides GPM_MAX_TIMEOUT
+	Timeout int `json:"timeout"`
+	// the result is posted to this URL once the request is done
+	CallbackURL string `json:"callback_url"`
+	// a response wins once its body starts flowing and the body is streamed to the client
+	Stream bool `json:"stream"`
+	// bytes of the body a response must receive to win when streaming, 1 by default
+	FirstBytes int `json:"first_bytes"`
+	// seconds a streamed body may send nothing, overrides GPM_STREAM_IDLE_TIMEOUT
+	IdleTimeout int `json:"idle_timeout"`
+	// maximum size of the response body, can't exceed the limit of the api key
+	MaxBodySize int64 `json:"max_body_size"`
+	// allowed media types of the response, e.g. `text/html` or `image/*`
+	ContentTypes []string `json:"content_types"`
+	// decompress the body and transcode text to UTF-8
+	Decode bool `json:"decode"`
+	// the response body is replaced with a JSON object of the extracted values
+	Extract Extractors `json:"extract,omitempty"`
+	// links of HTML and CSS are rewritten to point back through gpm, single requests only
+	Rewrite bool `json:"rewrite,omitempty"`
+	// redirect policy, one of `follow` (default), `none` or `same_host`
+	Redirect string `json:"redirect,omitempty"`
+	// maximum number of redirects followed, 10 by default
+	MaxRedirects int `json:"max_redirects,omitempty"`
+	// proxy used along the redirect chain, `same` (default) or `rotate`
+	RedirectProxy string `json:"redirect_proxy,omitempty"`
+	// attempts, proxies and redirect chains are reported with the response
+	Diagnostics bool `json:"diagnostics,omitempty"`
+	// requests of a session share cookies and stick to the proxy that succeeded first
+	Session string `json:"session,omitempty"`
+	// name of the header profile every attempt is made with, `none` disables profiles
+	Profile string `json:"profile,omitempty"`
+	// ClientHello profile of TLS connections, `go` disables fingerprints
+	TLS string `json:"tls,omitempty"`
+	// `http1` keeps HTTP/1.1, `h2c` speaks HTTP/2 to plain HTTP destinations, HTTP/2 is negotiated otherwise
+	Protocol string `json:"protocol,omitempty"`
+	// only proxies tagged with the country or the region are used, overrides the rule of the destination's domain
+	Country string `json:"country,omitempty"`
+	Region  string `json:"region,omitempty"`
+	// `fail` (default) or `widen` to the neighbours when no proxy has the country or the region
+	GeoFallback string `json:"geo_fallback,omitempty"`
+}
+
+// validate - check the values of the options
+func (o RequestOptions) validate() error {
+	switch o.Redirect {
+	case "", RedirectFollow, RedirectNone, RedirectSameHost:
+	default:
+		return fmt.Errorf("[redirect] must be one of %s, %s or %s", RedirectFollow, RedirectNone, RedirectSameHost)
+	}
+
+	switch o.RedirectProxy {
+	case "", RedirectProxySame, RedirectProxyRotate:
+	default:
+		return fmt.Errorf("[redirect_proxy] must be either %s or %s", RedirectProxySame, RedirectProxyRotate)
+	}
+
+	if o.MaxRedirects < 0 {
+		return fmt.Errorf("[max_redirects] must be a positive number")
+	}
+
+	if err := ValidateTLSProfile(o.TLS); err != nil {
+		return err
+	}
+
+	if err := ValidateProtocol(o.Protocol); err != nil {
+		return err
+	}
+
+	if err := ValidateGeoFallback(o.GeoFallback); err != nil {
+		return err
+	}
+
+	if o.Session != "" {
+		return ValidateSessionName(o.Session)
+	}
+
+	return nil
+}
+
+// limits - body limits requested by the client
+func (o RequestOptions) limits() BodyLimits {
+	return BodyLimits{MaxBodySize: o.MaxBodySize, ContentTypes: o.ContentTypes}
+}
+
+// ParseRequestOptions - parse request options from the request query
+func ParseRequestOptions(r *http.Request) (*RequestOptions, error) {
+	options := &RequestOptions{}
+
+	coalesce, err := parseBoolParam(r, "coalesce")
+	if err != nil {
+		return nil, err
+	}
+	options.Coalesce = coalesce
+
+	if timeout, err := ExtractQueryParam(r, "timeout"); err == nil && timeout != "" {
+		options.Timeout, err = strconv.Atoi(timeout)
+		if err != nil || options.Timeout < 0 {
+			return nil, fmt.Errorf("[timeout] query param must be a positive number of seconds")
+		}
+	}
+
+	stream, err := parseBoolParam(r, "stream")
+	if err != nil {
+		return nil, err
+	}
+	options.Stream = stream
+
+	if options.FirstBytes, err = parseIntParam(r, "first_bytes"); err != nil {
+		return nil, err
+	}
+
+	if options.IdleTimeout, err = parseIntParam(r, "idle_timeout"); err != nil {
+		return nil, err
+	}
+
+	if options.Decode, err = parseBoolParam(r, "decode"); err != nil {
+		return nil, err
+	}
+
+	if options.Rewrite, err = parseBoolParam(r, "rewrite"); err != nil {
+		return nil, err
+	}
+	// only decoded text can be rewritten
+	options.Decode = options.Decode || options.Rewrite
+
+	if extract, err := ExtractQueryParam(r, "extract"); err == nil && extract != "" {
+		if options.Extract, err = ParseExtractors(extract); err != nil {
+			return nil, err
+		}
+	}
+
+	if redirect, err := ExtractQueryParam(r, "redirect"); err == nil {
+		options.Redirect = redirect
+	}
+
+	if options.MaxRedirects, err = parseIntParam(r, "max_redirects"); err != nil {
+		return nil, err
+	}
+
+	if redirectProxy, err := ExtractQueryParam(r, "redirect_proxy"); err == nil {
+		options.RedirectProxy = redirectProxy
+	}
+
+	if options.Diagnostics, err = parseBoolParam(r, "diagnostics"); err != nil {
+		return nil, err
+	}
+
+	if session, err := ExtractQueryParam(r, "session"); err == nil {
+		options.Session = session
+	}
+
+	if profile, err := ExtractQueryParam(r, "profile"); err == nil {
+		options.Profile = profile
+	}
+
+	if tlsProfile, err := ExtractQueryParam(r, "tls"); err == nil {
+		options.TLS = tlsProfile
+	}
+
+	if protocol, err := ExtractQueryParam(r, "protocol"); err == nil {
+		options.Protocol = protocol
+	}
+
+	if country, err := ExtractQueryParam(r, "country"); err == nil {
+		options.Country = country
+	}
+
+	if region, err := ExtractQueryParam(r, "region"); err == nil {
+		options.Region = region
+	}
+
+	if geoFallback, err := ExtractQueryParam(r, "geo_fallback"); err == nil {
+		options.GeoFallback = geoFallback
+	}
+
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+
+	maxBodySize, err := parseIntParam(r, "max_body_size")
+	if err != nil {
+		return nil, err
+	}
+	options.MaxBodySize = int64(maxBodySize)
+
+	if contentTypes, err := ExtractQueryParam(r, "content_types"); err == nil {
+		options.ContentTypes = parseContentTypes(contentTypes)
+	}
+
+	if callbackURL, err := ExtractQueryParam(r, "callback_url"); err == nil && callbackURL != "" {
+		if err := ValidateCallbackURL(callbackURL); err != nil {
+			return nil, err
+		}
+		options.CallbackURL = callbackURL
+	}
+
+	return options, nil
+}
+
+// parseIntParam - parse a non negative integer query param, missing param is 0
+func parseIntParam(r *http.Request, key string) (int, error) {
+	value, err := ExtractQueryParam(r, key)
+	if err != nil || value == "" {
+		return 0, nil
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("[%s] query param must be a positive number", key)
+	}
+
+	return i, nil
+}
+
+// parseBoolParam - parse a boolean query param, missing param is false
+func parseBoolParam(r *http.Request, key string) (bool, error) {
+	value, err := ExtractQueryParam(r, key)
+	if err != nil || value == "" {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("[%s] query param must be a boolean", key)
+	}
+
+	return b, nil
+}
@@ -0,0 +1,371 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Header profile pinning modes
+const (
+	// every attempt picks a random profile
+	ProfilePinAttempt = "attempt"
+	// every proxy keeps the profile it got first
+	ProfilePinProxy = "proxy"
+)
+
+// ProfileNone - request option disabling header profiles
+const ProfileNone = "none"
+
+// maxRequestHead - request heads longer than this are sent as they are
+const maxRequestHead = 64 << 10
+
+// HeaderProfile - headers of a browser in the order the browser sends them
+// headers with an empty value only take part in ordering, e.g. Host or Cookie
+type HeaderProfile struct {
+	Name    string      `json:"name"`
+	Headers [][2]string `json:"headers"`
+	// ClientHello profile of the browser, e.g. `chrome`
+	TLS string `json:"tls,omitempty"`
+}
+
+// apply - set the headers of the profile on the request
+// headers the request already has are kept
+func (p *HeaderProfile) apply(req *http.Request, keep http.Header) {
+	for _, header := range p.Headers {
+		if header[1] == "" || keep.Get(header[0]) != "" {
+			continue
+		}
+
+		req.Header.Set(header[0], header[1])
+	}
+}
+
+// ordered - wraps connections so request heads follow the header order of the profile
+func (p *HeaderProfile) ordered(conn net.Conn) net.Conn {
+	order := make(map[string]int, len(p.Headers))
+	names := make(map[string]string, len(p.Headers))
+	for i, header := range p.Headers {
+		name := strings.ToLower(header[0])
+		order[name] = i
+		names[name] = header[0]
+	}
+
+	return &orderedConn{Conn: conn, order: order, names: names}
+}
+
+// ProfileLibrary - header profiles loaded from a file
+type ProfileLibrary struct {
+	Filename string
+
+	profiles []*HeaderProfile
+	byName   map[string]*HeaderProfile
+
+	mu sync.Mutex
+	// profiles of proxies when profiles are pinned to proxies
+	proxies map[string]string
+}
+
+// Load - load the profiles from the JSON file, nothing is loaded without a file
+func (pl *ProfileLibrary) Load() {
+	if pl.Filename == "" {
+		return
+	}
+
+	data, err := os.ReadFile(pl.Filename)
+	if err != nil {
+		panic(err)
+	}
+
+	var profiles []*HeaderProfile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		panic(fmt.Errorf("could not parse header profiles %s: %v", pl.Filename, err))
+	}
+
+	for _, profile := range profiles {
+		if err := ValidateTLSProfile(profile.TLS); err != nil {
+			panic(fmt.Errorf("header profile %s: %v", profile.Name, err))
+		}
+
+		pl.Add(profile)
+	}
+}
+
+// Add profile to the library
+func (pl *ProfileLibrary) Add(profile *HeaderProfile) {
+	if _, ok := pl.byName[profile.Name]; !ok {
+		pl.profiles = append(pl.profiles, profile)
+	}
+	pl.byName[profile.Name] = profile
+}
+
+// Count the profiles in the library
+func (pl *ProfileLibrary) Count() int {
+	return len(pl.profiles)
+}
+
+// Get profile by its name, returns nil if profile is unknown
+func (pl *ProfileLibrary) Get(name string) *HeaderProfile {
+	return pl.byName[name]
+}
+
+// Rand - random profile, profiles not in the exclude map are preferred
+func (pl *ProfileLibrary) Rand(exclude map[string]bool) *HeaderProfile {
+	if len(pl.profiles) == 0 {
+		return nil
+	}
+
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	candidates := make([]*HeaderProfile, 0, len(pl.profiles))
+	for _, profile := range pl.profiles {
+		if !exclude[profile.Name] {
+			candidates = append(candidates, profile)
+		}
+	}
+	if len(candidates) == 0 {
+		return pl.profiles[r.Intn(len(pl.profiles))]
+	}
+
+	return candidates[r.Intn(len(candidates))]
+}
+
+// ForProxy - the profile of the proxy, a proxy gets a random one on first use
+func (pl *ProfileLibrary) ForProxy(proxy string) *HeaderProfile {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	if profile := pl.byName[pl.proxies[proxy]]; profile != nil {
+		return profile
+	}
+
+	profile := pl.Rand(nil)
+	if profile != nil {
+		pl.proxies[proxy] = profile.Name
+	}
+
+	return profile
+}
+
+// NewProfileLibrary - make new library of header profiles
+func NewProfileLibrary() *ProfileLibrary {
+	return &ProfileLibrary{
+		Filename: os.Getenv("GPM_HEADER_PROFILES"),
+		byName:   make(map[string]*HeaderProfile),
+		proxies:  make(map[string]string),
+	}
+}
+
+// ValidateProfile - checks the requested profile exists
+func (pl *ProfileLibrary) ValidateProfile(name string) error {
+	if name == "" || name == ProfileNone || pl.Get(name) != nil {
+		return nil
+	}
+
+	return fmt.Errorf("[profile] %s is unknown", name)
+}
+
+// pickProfile - choose the header profile for the request with the index
+// a requested or pinned profile is used by every request
+// otherwise requests of the session get distinct profiles when there are enough of them
+func (m *Multiplexer) pickProfile(index int, proxy string) *HeaderProfile {
+	if m.profiles == nil || m.profiles.Count() == 0 || m.profile == ProfileNone {
+		return nil
+	}
+
+	var profile *HeaderProfile
+	switch {
+	case m.profile != "":
+		profile = m.profiles.Get(m.profile)
+	case getHeaderProfilePin() == ProfilePinProxy:
+		profile = m.profiles.ForProxy(proxy)
+	default:
+		m.doneMu.Lock()
+		used := make(map[string]bool, len(m.attempts))
+		for _, attempt := range m.attempts {
+			used[attempt.Profile] = true
+		}
+		m.doneMu.Unlock()
+
+		profile = m.profiles.Rand(used)
+	}
+
+	if profile != nil {
+		m.recordAttempt(index, func(attempt *Attempt) {
+			attempt.Profile = profile.Name
+		})
+	}
+
+	return profile
+}
+
+// orderTransport - request heads sent over the connections of the transport follow the profile
+// TLS tunnelled through a proxy is established by the transport itself unless the connection
+// is fingerprinted, so without a ClientHello profile the order applies to direct requests
+// and to plain HTTP requests through proxies, HTTP/2 connections are left alone
+func orderTransport(transport *http.Transport, profile *HeaderProfile) {
+	dial := dialFunc(transport.DialContext)
+	if dial == nil {
+		dial = defaultDial
+	}
+	http2 := allowsHTTP2(transport)
+
+	dialTLS := transport.DialTLSContext
+	if dialTLS == nil {
+		dialTLS = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+
+			tlsConn, err := goTLSHandshake(ctx, conn, addr, transport.TLSClientConfig, http2)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+
+			return tlsConn, nil
+		}
+	}
+
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		return profile.ordered(conn), nil
+	}
+
+	transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialTLS(ctx, network, addr)
+		if err != nil || negotiatedHTTP2(conn) {
+			return conn, err
+		}
+
+		return profile.ordered(conn), nil
+	}
+}
+
+// orderedConn - reorders the headers of requests written to the connection
+// bodies are passed as they are, the connection turns transparent
+// after CONNECT or a chunked body since the rest can't be told apart from a head
+type orderedConn struct {
+	net.Conn
+
+	// position and spelling of headers by lower cased name
+	order map[string]int
+	names map[string]string
+
+	head        []byte
+	body        int64
+	passthrough bool
+}
+
+func (c *orderedConn) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) > 0 {
+		switch {
+		case c.passthrough:
+			if _, err := c.Conn.Write(p); err != nil {
+				return 0, err
+			}
+			return n, nil
+		case c.body > 0:
+			chunk := p
+			if int64(len(chunk)) > c.body {
+				chunk = chunk[:c.body]
+			}
+			if _, err := c.Conn.Write(chunk); err != nil {
+				return 0, err
+			}
+			c.body -= int64(len(chunk))
+			p = p[len(chunk):]
+		default:
+			c.head = append(c.head, p...)
+			end := bytes.Index(c.head, []byte("\r\n\r\n"))
+			if end < 0 {
+				if len(c.head) > maxRequestHead {
+					c.passthrough = true
+					p, c.head = c.head, nil
+					continue
+				}
+				return n, nil
+			}
+
+			rest := append([]byte(nil), c.head[end+4:]...)
+			head := c.reorder(string(c.head[:end]))
+			c.head = nil
+
+			if _, err := io.WriteString(c.Conn, head); err != nil {
+				return 0, err
+			}
+			p = rest
+		}
+	}
+
+	return n, nil
+}
+
+// reorder - headers of the request head in the order of the profile
+// headers unknown to the profile follow in their original order
+func (c *orderedConn) reorder(head string) string {
+	lines := strings.Split(head, "\r\n")
+	requestLine, headers := lines[0], lines[1:]
+
+	if strings.HasPrefix(requestLine, "CONNECT ") {
+		c.passthrough = true
+	}
+
+	position := func(line string) int {
+		name := strings.ToLower(strings.TrimSpace(strings.SplitN(line, ":", 2)[0]))
+		if i, ok := c.order[name]; ok {
+			return i
+		}
+		return len(c.order)
+	}
+
+	sort.SliceStable(headers, func(i, j int) bool {
+		return position(headers[i]) < position(headers[j])
+	})
+
+	for i, line := range headers {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		switch name {
+		case "content-length":
+			c.body, _ = strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+		case "transfer-encoding":
+			c.passthrough = true
+		}
+
+		if spelling, ok := c.names[name]; ok {
+			headers[i] = spelling + ":" + parts[1]
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(requestLine + "\r\n")
+	for _, line := range headers {
+		b.WriteString(line + "\r\n")
+	}
+	b.WriteString("\r\n")
+
+	return b.String()
+}
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+)
+
+var testProfile = &HeaderProfile{
+	Name: "test-browser",
+	Headers: [][2]string{
+		{"Host", ""},
+		{"sec-ch-ua", `"Test";v="1"`},
+		{"User-Agent", "TestBrowser/1.0"},
+		{"Accept", "text/html"},
+		{"Accept-Encoding", ""},
+	},
+}
+
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	return c.written.Write(p)
+}
+
+func TestOrderedConn(t *testing.T) {
+	recorder := &recordingConn{}
+	conn := testProfile.ordered(recorder)
+
+	first := "POST / HTTP/1.1\r\nHost: a\r\nAccept: text/html\r\nContent-Length: 4\r\nUser-Agent: x\r\n\r\n"
+	second := "GET / HTTP/1.1\r\nUser-Agent: x\r\nSec-Ch-Ua: y\r\nHost: a\r\n\r\n"
+
+	// heads and bodies arrive split at arbitrary points
+	stream := first + "body" + second
+	for _, part := range []string{stream[:10], stream[10:70], stream[70:]} {
+		if _, err := conn.Write([]byte(part)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := "POST / HTTP/1.1\r\nHost: a\r\nUser-Agent: x\r\nAccept: text/html\r\nContent-Length: 4\r\n\r\nbody" +
+		"GET / HTTP/1.1\r\nHost: a\r\nsec-ch-ua: y\r\nUser-Agent: x\r\n\r\n"
+	if recorder.written.String() != expected {
+		t.Fatalf("Expected\n%q\ngot\n%q", expected, recorder.written.String())
+	}
+}
+
+func TestHeaderProfiles(t *testing.T) {
+	heads := make(chan string, 1)
+
+	// the raw request head shows the order headers are sent in
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				reader := bufio.NewReader(conn)
+				var head strings.Builder
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == "\r\n" {
+						break
+					}
+					head.WriteString(line)
+				}
+
+				heads <- head.String()
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok"))
+			}(conn)
+		}
+	}()
+
+	list := NewList()
+	list.Filename = "../proxy.list.example"
+	list.Load()
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	server := NewServer(logger, list)
+	server.profiles.Add(testProfile)
+
+	r := chi.NewRouter()
+	r.With(server.ProxyGetRequest).Get("/get", server.ProxyGetResponse)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	t.Run("profile headers are sent in order", func(t *testing.T) {
+		resp, body := testRequest(t, ts, "GET", "/get?diagnostics=1&url="+uriEncode("http://"+listener.Addr().String()+"/"), nil)
+		if body != "ok" {
+			t.Fatalf("Unexpected body %s", body)
+		}
+
+		head := <-heads
+		lines := strings.Split(strings.TrimSpace(head), "\r\n")
+		expected := []string{"GET / HTTP/1.1", "Host: " + listener.Addr().String(), `sec-ch-ua: "Test";v="1"`, "User-Agent: TestBrowser/1.0", "Accept: text/html", "Accept-Encoding: gzip"}
+		if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+			t.Fatalf("Unexpected request head\n%s", head)
+		}
+
+		var diagnostics Diagnostics
+		if err := json.Unmarshal([]byte(resp.Header.Get(DiagnosticsHeader)), &diagnostics); err != nil {
+			t.Fatal(err)
+		}
+		if diagnostics.Attempts[0].Profile != testProfile.Name {
+			t.Fatalf("Expected the profile in diagnostics, got %s", resp.Header.Get(DiagnosticsHeader))
+		}
+	})
+
+	t.Run("profiles can be disabled", func(t *testing.T) {
+		testRequest(t, ts, "GET", "/get?profile=none&url="+uriEncode("http://"+listener.Addr().String()+"/"), nil)
+
+		if head := <-heads; strings.Contains(head, "TestBrowser") {
+			t.Fatalf("Expected no profile, got\n%s", head)
+		}
+	})
+
+	t.Run("unknown profile", func(t *testing.T) {
+		resp, _ := testRequest(t, ts, "GET", "/get?profile=unknown&url="+uriEncode("http://"+listener.Addr().String()+"/"), nil)
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400, got %d", resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,281 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ohler55/ojg/jp"
+	"github.com/ohler55/ojg/oj"
+)
+
+// formats of provider responses
+const (
+	ProviderFormatLines = "lines"
+	ProviderFormatJSON  = "json"
+	ProviderFormatCSV   = "csv"
+)
+
+// maxProviderResponse - bigger provider responses are rejected
+const maxProviderResponse = 16 << 20
+
+// Provider - source of proxies refreshed periodically
+type Provider interface {
+	Fetch(ctx context.Context) ([]string, error)
+}
+
+// HTTPProvider - fetches the proxies from an HTTP endpoint of the provider
+type HTTPProvider struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// request headers, e.g. the credentials of the provider's API
+	// ${VAR} in the URL and in the headers is replaced with the environment variable
+	Headers map[string]string `json:"headers,omitempty"`
+	// lines (default), json or csv
+	Format string `json:"format,omitempty"`
+	// JSONPath of the proxies in json responses, a proxy is either a string
+	// or an object with host, port and optional scheme, username and password
+	Path string `json:"path,omitempty"`
+	// header of the column with the proxies in csv responses,
+	// the first column of responses without a header row by default
+	Column string `json:"column,omitempty"`
+	// seconds between refreshes, GPM_PROVIDER_REFRESH by default
+	Refresh int `json:"refresh,omitempty"`
+	// tags of every proxy of the provider
+	Tags []string `json:"tags,omitempty"`
+
+	path   jp.Expr
+	client *http.Client
+}
+
+// compile - validate the provider and keep the JSONPath ready for use
+func (p *HTTPProvider) compile() error {
+	if p.Name == "" {
+		return fmt.Errorf("provider of %s has no name", p.URL)
+	}
+
+	if u, err := url.Parse(p.URL); err != nil || u.Host == "" {
+		return fmt.Errorf("provider %s has an invalid url %q", p.Name, p.URL)
+	}
+
+	switch p.Format {
+	case "", ProviderFormatLines, ProviderFormatCSV:
+	case ProviderFormatJSON:
+		if p.Path == "" {
+			return fmt.Errorf("provider %s of the json format needs a path", p.Name)
+		}
+
+		var err error
+		if p.path, err = jp.ParseString(p.Path); err != nil {
+			return fmt.Errorf("provider %s has an invalid path %q: %v", p.Name, p.Path, err)
+		}
+	default:
+		return fmt.Errorf("format of provider %s must be one of lines, json or csv, got %q", p.Name, p.Format)
+	}
+
+	if p.client == nil {
+		p.client = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	return nil
+}
+
+// RefreshInterval - how often the proxies of the provider are fetched
+func (p *HTTPProvider) RefreshInterval() time.Duration {
+	if p.Refresh > 0 {
+		return time.Duration(p.Refresh) * time.Second
+	}
+
+	return getProviderRefresh()
+}
+
+// Fetch - request the list of the provider and parse its proxies
+func (p *HTTPProvider) Fetch(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, os.ExpandEnv(p.URL), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, value := range p.Headers {
+		req.Header.Set(name, os.ExpandEnv(value))
+	}
+
+	response, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return nil, fmt.Errorf("provider %s responded with %s", p.Name, response.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxProviderResponse+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxProviderResponse {
+		return nil, fmt.Errorf("response of provider %s exceeds %d bytes", p.Name, maxProviderResponse)
+	}
+
+	return p.parse(body)
+}
+
+// parse - proxies of the response body in the format of the provider
+func (p *HTTPProvider) parse(body []byte) ([]string, error) {
+	switch p.Format {
+	case ProviderFormatJSON:
+		return p.parseJSON(body)
+	case ProviderFormatCSV:
+		return p.parseCSV(body)
+	default:
+		return parseLines(body), nil
+	}
+}
+
+// parseLines - a proxy per line, empty lines and # comments are skipped
+func parseLines(body []byte) []string {
+	var proxies []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			proxies = append(proxies, line)
+		}
+	}
+
+	return proxies
+}
+
+func (p *HTTPProvider) parseJSON(body []byte) ([]string, error) {
+	data, err := oj.Parse(body)
+	if err != nil {
+		return nil, fmt.Errorf("response of provider %s is not JSON: %v", p.Name, err)
+	}
+
+	var proxies []string
+	for _, match := range p.path.Get(data) {
+		switch value := match.(type) {
+		case string:
+			proxies = append(proxies, strings.TrimSpace(value))
+		case map[string]interface{}:
+			proxy, err := proxyFromFields(value)
+			if err != nil {
+				return nil, fmt.Errorf("provider %s: %v", p.Name, err)
+			}
+			proxies = append(proxies, proxy)
+		default:
+			return nil, fmt.Errorf("provider %s: %s matched %v which is not a proxy", p.Name, p.Path, match)
+		}
+	}
+
+	return proxies, nil
+}
+
+// proxyFromFields - proxy URL of an object with host, port, scheme, username and password
+func proxyFromFields(fields map[string]interface{}) (string, error) {
+	field := func(name string) string {
+		if value, ok := fields[name]; ok && value != nil {
+			return fmt.Sprint(value)
+		}
+		return ""
+	}
+
+	if field("host") == "" || field("port") == "" {
+		return "", fmt.Errorf("proxy object %v must have a host and a port", fields)
+	}
+
+	proxyURL := &url.URL{Scheme: "http", Host: net.JoinHostPort(field("host"), field("port"))}
+	if scheme := field("scheme"); scheme != "" {
+		proxyURL.Scheme = scheme
+	}
+	if username := field("username"); username != "" {
+		proxyURL.User = url.UserPassword(username, field("password"))
+	}
+
+	return proxyURL.String(), nil
+}
+
+func (p *HTTPProvider) parseCSV(body []byte) ([]string, error) {
+	rows, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("response of provider %s is not CSV: %v", p.Name, err)
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	// the header row only comes first when a column is named
+	column := 0
+	if p.Column != "" {
+		column = -1
+		for i, name := range rows[0] {
+			if strings.EqualFold(strings.TrimSpace(name), p.Column) {
+				column = i
+			}
+		}
+
+		if column < 0 {
+			return nil, fmt.Errorf("response of provider %s has no %s column", p.Name, p.Column)
+		}
+		rows = rows[1:]
+	}
+
+	var proxies []string
+	for _, row := range rows {
+		if column < len(row) && strings.TrimSpace(row[column]) != "" {
+			proxies = append(proxies, strings.TrimSpace(row[column]))
+		}
+	}
+
+	return proxies, nil
+}
+
+// LoadProviders - providers of the JSON file
+func LoadProviders(filename string) ([]*HTTPProvider, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var providers []*HTTPProvider
+	if err := json.Unmarshal(data, &providers); err != nil {
+		return nil, fmt.Errorf("could not parse proxy providers %s: %v", filename, err)
+	}
+
+	names := make(map[string]bool)
+	for _, provider := range providers {
+		if err := provider.compile(); err != nil {
+			return nil, err
+		}
+
+		if names[provider.Name] {
+			return nil, fmt.Errorf("provider %s is defined twice", provider.Name)
+		}
+		names[provider.Name] = true
+	}
+
+	return providers, nil
+}
+
+// providedProxies - the provider along with its last good list
+type providedProxies struct {
+	provider Provider
+	tags     []string
+	refresh  time.Duration
+
+	proxies   []string
+	fetchedAt time.Time
+	err       error
+}
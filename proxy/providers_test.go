@@ -0,0 +1,230 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+func TestProxyProviders(t *testing.T) {
+	os.Setenv("GPM_TEST_PROVIDER_TOKEN", "rotated")
+	defer os.Unsetenv("GPM_TEST_PROVIDER_TOKEN")
+
+	var failing int32
+	var fetches int64
+
+	r := chi.NewRouter()
+	r.Get("/lines", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer rotated" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "# pool of acme\n10.0.0.1:8080\n\nsocks5://10.0.0.2:1080\n")
+	})
+	r.Get("/json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data": [
+			{"host": "10.0.1.1", "port": 3128, "username": "u", "password": "p"},
+			{"host": "10.0.1.2", "port": 1080, "scheme": "socks5"},
+			"10.0.0.1:8080"
+		]}`)
+	})
+	r.Get("/csv", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "country,proxy\nus,10.0.2.1:8080\nde,10.0.2.2:8080\n")
+	})
+	r.Get("/headless", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "10.0.2.3:8080,us\n10.0.2.4:8080,de\n")
+	})
+	r.Get("/flaky", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&fetches, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			http.Error(w, "maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "10.0.3.1:8080\n")
+	})
+
+	r.Get("/delayed", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		fmt.Fprint(w, "10.0.4.1:8080\n")
+	})
+	r.Get("/stuck", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	provider := func(t *testing.T, p *HTTPProvider) *HTTPProvider {
+		if err := p.compile(); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	t.Run("formats", func(t *testing.T) {
+		cases := []struct {
+			provider *HTTPProvider
+			expected []string
+		}{
+			{
+				&HTTPProvider{Name: "lines", URL: ts.URL + "/lines", Headers: map[string]string{"Authorization": "Bearer ${GPM_TEST_PROVIDER_TOKEN}"}},
+				[]string{"10.0.0.1:8080", "socks5://10.0.0.2:1080"},
+			},
+			{
+				&HTTPProvider{Name: "json", URL: ts.URL + "/json", Format: ProviderFormatJSON, Path: "$.data[*]"},
+				[]string{"http://u:p@10.0.1.1:3128", "socks5://10.0.1.2:1080", "10.0.0.1:8080"},
+			},
+			{
+				&HTTPProvider{Name: "csv", URL: ts.URL + "/csv", Format: ProviderFormatCSV, Column: "Proxy"},
+				[]string{"10.0.2.1:8080", "10.0.2.2:8080"},
+			},
+			{
+				&HTTPProvider{Name: "headless", URL: ts.URL + "/headless", Format: ProviderFormatCSV},
+				[]string{"10.0.2.3:8080", "10.0.2.4:8080"},
+			},
+		}
+
+		for _, c := range cases {
+			proxies, err := provider(t, c.provider).Fetch(context.Background())
+			if err != nil {
+				t.Fatalf("%s: %v", c.provider.Name, err)
+			}
+
+			if !reflect.DeepEqual(proxies, c.expected) {
+				t.Fatalf("%s: expected %v, got %v", c.provider.Name, c.expected, proxies)
+			}
+		}
+	})
+
+	t.Run("providers are merged with their tags", func(t *testing.T) {
+		list := NewList()
+		list.Add("10.0.9.1:8080")
+		list.AddProvider("acme", provider(t, &HTTPProvider{Name: "acme", URL: ts.URL + "/lines",
+			Headers: map[string]string{"Authorization": "Bearer ${GPM_TEST_PROVIDER_TOKEN}"}}), []string{"acme", "datacenter"}, time.Minute)
+		list.AddProvider("resi", provider(t, &HTTPProvider{Name: "resi", URL: ts.URL + "/json",
+			Format: ProviderFormatJSON, Path: "$.data[*]"}), []string{"residential"}, time.Minute)
+
+		for _, name := range []string{"acme", "resi"} {
+			if err := list.RefreshProvider(context.Background(), name); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if list.Count() != 5 {
+			t.Fatalf("Expected the file entry and 4 distinct provider proxies, got %v", list.list)
+		}
+
+		if tags := list.Tags("http://10.0.0.1:8080"); !reflect.DeepEqual(tags, []string{"acme", "datacenter", "residential"}) {
+			t.Fatalf("Expected the tags of both providers, got %v", tags)
+		}
+		if tags := list.Tags("socks5://10.0.1.2:1080"); !reflect.DeepEqual(tags, []string{"residential"}) {
+			t.Fatalf("Expected socks5 proxies to keep their scheme, got %v in %v", tags, list.list)
+		}
+		if tags := list.Tags("http://10.0.9.1:8080"); len(tags) != 0 {
+			t.Fatalf("Expected the file entry to have no tags, got %v", tags)
+		}
+	})
+
+	t.Run("last good list is kept", func(t *testing.T) {
+		list := NewList()
+		list.AddProvider("flaky", provider(t, &HTTPProvider{Name: "flaky", URL: ts.URL + "/flaky"}), nil, time.Minute)
+
+		if err := list.RefreshProvider(context.Background(), "flaky"); err != nil {
+			t.Fatal(err)
+		}
+
+		atomic.StoreInt32(&failing, 1)
+		defer atomic.StoreInt32(&failing, 0)
+
+		if err := list.RefreshProvider(context.Background(), "flaky"); err == nil {
+			t.Fatalf("Expected the refresh to fail")
+		}
+
+		if list.Count() != 1 || list.Rand() != "http://10.0.3.1:8080" {
+			t.Fatalf("Expected the last good list, got %v", list.list)
+		}
+	})
+
+	t.Run("periodic refresh", func(t *testing.T) {
+		list := NewList()
+		list.AddProvider("flaky", provider(t, &HTTPProvider{Name: "flaky", URL: ts.URL + "/flaky"}), nil, 20*time.Millisecond)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		before := atomic.LoadInt64(&fetches)
+		list.WatchProviders(ctx, log.New(os.Stdout, "", log.LstdFlags))
+
+		if list.Count() != 1 {
+			t.Fatalf("Expected the proxies to be fetched right away")
+		}
+
+		time.Sleep(110 * time.Millisecond)
+		cancel()
+
+		if n := atomic.LoadInt64(&fetches) - before; n < 3 {
+			t.Fatalf("Expected the provider to be refreshed periodically, got %d fetches", n)
+		}
+	})
+
+	t.Run("providers are fetched at the same time on start", func(t *testing.T) {
+		os.Setenv("GPM_PROVIDER_START_TIMEOUT", "1")
+		defer os.Unsetenv("GPM_PROVIDER_START_TIMEOUT")
+
+		list := NewList()
+		list.AddProvider("stuck", provider(t, &HTTPProvider{Name: "stuck", URL: ts.URL + "/stuck"}), nil, time.Minute)
+		list.AddProvider("first", provider(t, &HTTPProvider{Name: "first", URL: ts.URL + "/delayed"}), nil, time.Minute)
+		list.AddProvider("second", provider(t, &HTTPProvider{Name: "second", URL: ts.URL + "/delayed"}), nil, time.Minute)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		startedAt := time.Now()
+		list.WatchProviders(ctx, log.New(os.Stdout, "", log.LstdFlags))
+
+		if elapsed := time.Since(startedAt); elapsed > 1500*time.Millisecond {
+			t.Fatalf("Expected the start to wait for the deadline at most, waited %v", elapsed)
+		}
+		if list.Count() != 1 || list.Rand() != "http://10.0.4.1:8080" {
+			t.Fatalf("Expected the proxies of the providers that answered, got %v", list.list)
+		}
+	})
+
+	t.Run("configuration", func(t *testing.T) {
+		dir := t.TempDir()
+		write := func(config string) string {
+			filename := filepath.Join(dir, "providers.json")
+			if err := os.WriteFile(filename, []byte(config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			return filename
+		}
+
+		providers, err := LoadProviders(write(`[{"name": "acme", "url": "https://api.acme.test/proxies", "refresh": 60, "tags": ["us"]}]`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(providers) != 1 || providers[0].RefreshInterval() != time.Minute {
+			t.Fatalf("Unexpected providers %+v", providers)
+		}
+
+		for _, invalid := range []string{
+			`[{"name": "acme", "url": "https://api.acme.test", "format": "xml"}]`,
+			`[{"name": "acme", "url": "https://api.acme.test", "format": "json"}]`,
+			`[{"url": "https://api.acme.test"}]`,
+			`[{"name": "acme", "url": "https://a.test"}, {"name": "acme", "url": "https://b.test"}]`,
+		} {
+			if _, err := LoadProviders(write(invalid)); err == nil {
+				t.Fatalf("Expected %s to be rejected", invalid)
+			}
+		}
+	})
+}
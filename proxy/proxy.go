@@ -2,19 +2,38 @@ package proxy
 
 import (
 	"bufio"
+	"context"
+	"fmt"
 	"math/rand"
+	"net"
 	"os"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
 // List - list of available proxies
 type List struct {
 	Filename string
-	list     []string
+
+	mu sync.RWMutex
+	// proxies of the file and of the providers merged
+	list []string
+	// proxies of the file and the ones added directly
+	static []string
+	// tags of the proxies of the file
+	staticTags map[string][]string
+	// proxies of the providers by their names
+	providers map[string]*providedProxies
+	// tags of the proxies
+	tags map[string][]string
+	// local addresses and blocks direct requests go out from
+	locals []*net.IPNet
 }
 
-// Load the contents of the proxy.list
+// Load the contents of the proxy.list, the providers of GPM_PROXY_PROVIDERS
+// and the local addresses of GPM_LOCAL_ADDRESSES
 func (l *List) Load() {
 	f, err := os.Open(l.Filename)
 	if err != nil {
@@ -25,28 +44,389 @@ func (l *List) Load() {
 	scanner.Split(bufio.ScanLines)
 
 	for scanner.Scan() {
-		l.Add(scanner.Text())
+		if err := l.Add(scanner.Text()); err != nil {
+			panic(err)
+		}
+	}
+
+	// the gateway of GPM_PROXY_URL
+	if gateway := getProxyStr(); gateway != "" {
+		if err := l.Add(gateway); err != nil {
+			panic(err)
+		}
+	}
+
+	if filename := getProxyProviders(); filename != "" {
+		providers, err := LoadProviders(filename)
+		if err != nil {
+			panic(err)
+		}
+
+		for _, provider := range providers {
+			l.AddProvider(provider.Name, provider, provider.Tags, provider.RefreshInterval())
+		}
+	}
+
+	for _, address := range getLocalAddresses() {
+		if err := l.AddLocal(address); err != nil {
+			panic(err)
+		}
 	}
 }
 
-// Add proxy to the list of proxies
-func (l *List) Add(proxy string) {
-	if !strings.Contains(proxy, "http") {
-		proxy = "http://" + proxy
+// normalizeProxy - proxies without a scheme are http proxies
+func normalizeProxy(proxy string) string {
+	if isChain(proxy) {
+		return normalizeChain(proxy)
+	}
+
+	if !strings.Contains(proxy, "://") {
+		return "http://" + proxy
+	}
+
+	return proxy
+}
+
+// tagsSuffix - tags follow the proxy, e.g. `127.0.0.1:8089 tags=us,north-america`
+const tagsSuffix = " tags="
+
+// Add proxy or a chain of proxies to the list of proxies along with its tags
+// invalid chains are rejected instead of being dialed directly later
+func (l *List) Add(proxy string) error {
+	var tags []string
+	if i := strings.LastIndex(proxy, tagsSuffix); i >= 0 {
+		for _, tag := range strings.Split(proxy[i+len(tagsSuffix):], ",") {
+			if tag = strings.TrimSpace(tag); tag != "" && !containsTag(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+		proxy = strings.TrimSpace(proxy[:i])
 	}
 
+	proxy = normalizeProxy(proxy)
+	if isChain(proxy) {
+		if _, err := parseChain(proxy); err != nil {
+			return fmt.Errorf("invalid chain %s: %w", redactProxy(proxy), err)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.static = append(l.static, proxy)
 	l.list = append(l.list, proxy)
+
+	for _, tag := range tags {
+		if !containsTag(l.staticTags[proxy], tag) {
+			l.staticTags[proxy] = append(l.staticTags[proxy], tag)
+			l.tags[proxy] = append(l.tags[proxy], tag)
+		}
+	}
+
+	return nil
+}
+
+// AddProvider - register the provider, its proxies are part of the list once they are fetched
+func (l *List) AddProvider(name string, provider Provider, tags []string, refresh time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.providers[name] = &providedProxies{provider: provider, tags: tags, refresh: refresh}
+}
+
+// RefreshProvider - fetch the proxies of the provider, the last good list is kept when it fails
+func (l *List) RefreshProvider(ctx context.Context, name string) error {
+	l.mu.RLock()
+	provided, ok := l.providers[name]
+	l.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown provider %s", name)
+	}
+
+	proxies, err := provided.provider.Fetch(ctx)
+	if err == nil && len(proxies) == 0 {
+		err = fmt.Errorf("provider %s returned no proxies", name)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	provided.err = err
+	if err != nil {
+		return err
+	}
+
+	provided.proxies = make([]string, len(proxies))
+	for i, proxy := range proxies {
+		provided.proxies[i] = normalizeProxy(proxy)
+	}
+	provided.fetchedAt = time.Now()
+	l.merge()
+
+	return nil
+}
+
+// WatchProviders - fetch the proxies of every provider and keep refreshing them until the context is done
+// the providers are fetched at the same time first, for up to GPM_PROVIDER_START_TIMEOUT,
+// failures are logged, the proxies of the last successful fetch stay in the list
+func (l *List) WatchProviders(ctx context.Context, logger Logger) {
+	l.mu.RLock()
+	providers := make(map[string]time.Duration, len(l.providers))
+	for name, provided := range l.providers {
+		providers[name] = provided.refresh
+	}
+	l.mu.RUnlock()
+
+	refresh := func(ctx context.Context, name string) {
+		if err := l.RefreshProvider(ctx, name); err != nil {
+			logger.Printf("Refreshing proxies of provider %s failed, keeping the last good list: %v", name, err)
+		}
+	}
+
+	startCtx, cancel := context.WithTimeout(ctx, getProviderStartTimeout())
+	var wg sync.WaitGroup
+	for name := range providers {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			refresh(startCtx, name)
+		}(name)
+	}
+	wg.Wait()
+	cancel()
+
+	for name, interval := range providers {
+		go func(name string, interval time.Duration) {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					refresh(ctx, name)
+				}
+			}
+		}(name, interval)
+	}
+}
+
+// merge - proxies of the file followed by the proxies of the providers, each proxy is listed once
+// a proxy listed by the file and several providers gets the tags of all of them
+func (l *List) merge() {
+	names := make([]string, 0, len(l.providers))
+	for name := range l.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	seen := make(map[string]bool, len(l.static))
+	list := append(make([]string, 0, len(l.static)), l.static...)
+	for _, proxy := range l.static {
+		seen[proxy] = true
+	}
+
+	tags := make(map[string][]string, len(l.staticTags))
+	for proxy, static := range l.staticTags {
+		tags[proxy] = append([]string(nil), static...)
+	}
+
+	for _, name := range names {
+		provided := l.providers[name]
+		for _, proxy := range provided.proxies {
+			if !seen[proxy] {
+				seen[proxy] = true
+				list = append(list, proxy)
+			}
+
+			for _, tag := range provided.tags {
+				if !containsTag(tags[proxy], tag) {
+					tags[proxy] = append(tags[proxy], tag)
+				}
+			}
+		}
+	}
+
+	l.list = list
+	l.tags = tags
+}
+
+// containsTag - tags are matched regardless of the case
+func containsTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Tags - tags of the proxy
+func (l *List) Tags(proxy string) []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.proxyTags(proxy)
+}
+
+// proxyTags - tags of the proxy, a gateway filling {country} has every country of GPM_GATEWAY_COUNTRIES
+func (l *List) proxyTags(proxy string) []string {
+	if !strings.Contains(proxy, countryPlaceholder) {
+		return l.tags[proxy]
+	}
+
+	tags := append([]string(nil), l.tags[proxy]...)
+	for _, country := range getGatewayCountries() {
+		if !containsTag(tags, country) {
+			tags = append(tags, country)
+		}
+	}
+
+	return tags
+}
+
+// RandTagged - random proxy having any of the tags skipping the excluded ones, along with the tag it has
+// the tags are tried in order, returns empty strings when no proxy has any of them
+func (l *List) RandTagged(exclude map[string]bool, tags []string) (string, string) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	for _, tag := range tags {
+		var candidates []string
+		for _, proxy := range l.list {
+			if !exclude[proxy] && containsTag(l.proxyTags(proxy), tag) {
+				candidates = append(candidates, proxy)
+			}
+		}
+
+		if len(candidates) > 0 {
+			return candidates[r.Intn(len(candidates))], tag
+		}
+	}
+
+	return "", ""
 }
 
 // Rand - get random proxy from list
+// returns an empty string when the list is empty
 func (l *List) Rand() string {
-	s := rand.NewSource(time.Now().Unix())
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if len(l.list) == 0 {
+		return ""
+	}
+
+	s := rand.NewSource(time.Now().UnixNano())
 	r := rand.New(s)
 	return l.list[r.Intn(len(l.list))]
 }
 
+// RandExcept - get random proxy from list skipping the excluded ones
+// returns an empty string when every proxy is excluded
+func (l *List) RandExcept(exclude map[string]bool) string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	candidates := make([]string, 0, len(l.list))
+	for _, proxy := range l.list {
+		if !exclude[proxy] {
+			candidates = append(candidates, proxy)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return ""
+	}
+
+	s := rand.NewSource(time.Now().UnixNano())
+	r := rand.New(s)
+	return candidates[r.Intn(len(candidates))]
+}
+
+// AddLocal - add a local address or a block of them, e.g. `192.0.2.10` or `2001:db8::/64`
+func (l *List) AddLocal(address string) error {
+	block, err := parseLocalAddress(address)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.locals = append(l.locals, block)
+
+	return nil
+}
+
+// RandLocal - pseudo-proxy of a random local address skipping the excluded ones
+// addresses of blocks are sampled, returns an empty string without local addresses
+func (l *List) RandLocal(exclude map[string]bool) string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	candidates := make([]*net.IPNet, 0, len(l.locals))
+	for _, block := range l.locals {
+		if ones, bits := block.Mask.Size(); ones < bits || !exclude[localProxy(block.IP)] {
+			candidates = append(candidates, block)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return ""
+	}
+
+	s := rand.NewSource(time.Now().UnixNano())
+	r := rand.New(s)
+
+	var proxy string
+	// a block rarely samples an excluded address, a few tries are enough
+	for i := 0; i < 3; i++ {
+		proxy = localProxy(sampleAddress(r, candidates[r.Intn(len(candidates))]))
+		if !exclude[proxy] {
+			break
+		}
+	}
+
+	return proxy
+}
+
+// IsSampled - checks if the pseudo-proxy is an address sampled from a block of local addresses
+func (l *List) IsSampled(proxy string) bool {
+	ip := localAddress(proxy)
+	if ip == nil {
+		return false
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for _, block := range l.locals {
+		if ones, bits := block.Mask.Size(); ones < bits && block.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CountLocal - count the local addresses and blocks
+func (l *List) CountLocal() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return len(l.locals)
+}
+
 // Count the available proxies in the list
 func (l *List) Count() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
 	return len(l.list)
 }
 
@@ -58,7 +438,10 @@ func NewList() *List {
 	}
 
 	return &List{
-		list:     make([]string, 0),
-		Filename: filename,
+		list:       make([]string, 0),
+		providers:  make(map[string]*providedProxies),
+		tags:       make(map[string][]string),
+		staticTags: make(map[string][]string),
+		Filename:   filename,
 	}
 }
@@ -1,8 +1,12 @@
 package proxy
 
 import (
+	"log"
+	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestProxyList(t *testing.T) {
@@ -20,3 +24,31 @@ func TestProxyList(t *testing.T) {
 		t.Errorf("Expected a valid http address with some port, but got %s", randProxy)
 	}
 }
+
+func TestEmptyProxyList(t *testing.T) {
+	list := NewList()
+	if list.Rand() != "" || list.RandExcept(nil) != "" {
+		t.Fatalf("Expected no proxy of an empty list")
+	}
+
+	server := NewServer(log.New(os.Stdout, "", log.LstdFlags), list)
+	req := httptest.NewRequest("GET", "/get", nil)
+
+	done := make(chan *FirstResponse, 1)
+	go func() {
+		done <- server.multiplex(req, &RequestSpec{
+			Method:  "GET",
+			URL:     "http://127.0.0.1:1/",
+			exclude: map[string]bool{directProxy: true},
+		}, nil)
+	}()
+
+	select {
+	case response := <-done:
+		if response.IsValid() || errorCode(response.GetError()) != ErrorCodeNoProxies {
+			t.Fatalf("Expected the attempts to fail with %s, got %v", ErrorCodeNoProxies, response.GetError())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the attempts to fail right away")
+	}
+}
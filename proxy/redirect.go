@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Redirect policies
+const (
+	// redirects are followed up to the maximum number of hops
+	RedirectFollow = "follow"
+	// redirects are returned to the client
+	RedirectNone = "none"
+	// redirects to the same host are followed, the rest are returned to the client
+	RedirectSameHost = "same_host"
+)
+
+// Proxy policies along the redirect chain
+const (
+	// the whole chain goes through the proxy of the attempt
+	RedirectProxySame = "same"
+	// every hop of the chain goes through a proxy not used by the chain yet
+	RedirectProxyRotate = "rotate"
+)
+
+// defaultMaxRedirects - hops followed when the request does not limit them
+const defaultMaxRedirects = 10
+
+// TooManyRedirectsError - the redirect chain is longer than allowed
+type TooManyRedirectsError struct {
+	URL string
+	Max int
+}
+
+func (e *TooManyRedirectsError) Error() string {
+	return fmt.Sprintf("request to %s stopped after %d redirects", e.URL, e.Max)
+}
+
+// checkRedirect - records the redirect chain of the attempt and applies the redirect policy
+func (m *Multiplexer) checkRedirect(index int) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		m.recordAttempt(index, func(attempt *Attempt) {
+			attempt.Redirects = append(attempt.Redirects, Redirect{
+				URL:      via[len(via)-1].URL.String(),
+				Status:   req.Response.StatusCode,
+				Location: req.Response.Header.Get("Location"),
+				Elapsed:  time.Since(attempt.startedAt).Seconds(),
+			})
+		})
+
+		maxRedirects := m.maxRedirects
+		if maxRedirects == 0 {
+			maxRedirects = defaultMaxRedirects
+		}
+
+		switch {
+		case m.noRedirects || m.redirect == RedirectNone:
+			return http.ErrUseLastResponse
+		case m.redirect == RedirectSameHost && req.URL.Host != via[0].URL.Host:
+			return http.ErrUseLastResponse
+		case len(via) > maxRedirects:
+			return &TooManyRedirectsError{URL: via[0].URL.String(), Max: maxRedirects}
+		}
+
+		return nil
+	}
+}
+
+// returnsRedirects - checks if redirects that are not followed are passed to the client
+func (m *Multiplexer) returnsRedirects() bool {
+	return m.redirect == RedirectNone || m.redirect == RedirectSameHost
+}
+
+// rotatingTransport - sends every hop of a redirect chain through another proxy
+type rotatingTransport struct {
+	m     *Multiplexer
+	index int
+	first http.RoundTripper
+	hops  int
+	used  map[string]bool
+	// every hop looks like the same browser
+	profile    *HeaderProfile
+	tlsProfile string
+}
+
+func (rt *rotatingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.hops++
+	if rt.hops == 1 {
+		return rt.first.RoundTrip(req)
+	}
+
+	proxy, _, _ := rt.m.randProxy(rt.used)
+	if proxy == "" {
+		return nil, rt.m.unavailable()
+	}
+	rt.used[proxy] = true
+
+	rt.m.recordAttempt(rt.index, func(attempt *Attempt) {
+		if len(attempt.Redirects) > 0 {
+			attempt.Redirects[len(attempt.Redirects)-1].Proxy = redactProxy(proxy)
+		}
+	})
+
+	transport, err := newAttemptTransport(proxy, rt.profile, rt.tlsProfile, rt.m.protocol, rt.m.resolver)
+	if err != nil {
+		return nil, err
+	}
+	// the transport serves a single request
+	transport.DisableKeepAlives = true
+
+	return transport.RoundTrip(req)
+}
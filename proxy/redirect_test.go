@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/go-chi/chi"
+)
+
+func TestRedirectPolicies(t *testing.T) {
+	elsewhere := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "elsewhere")
+	}))
+	defer elsewhere.Close()
+
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusFound)
+		case "/b":
+			http.Redirect(w, r, "/c", http.StatusMovedPermanently)
+		case "/away":
+			http.Redirect(w, r, elsewhere.URL+"/", http.StatusFound)
+		default:
+			fmt.Fprint(w, "done")
+		}
+	}))
+	defer destination.Close()
+
+	list := NewList()
+	list.Filename = "../proxy.list.example"
+	list.Load()
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	server := NewServer(logger, list)
+
+	r := chi.NewRouter()
+	r.With(server.ProxyGetRequest).Get("/get", server.ProxyGetResponse)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	t.Run("redirects are followed and reported", func(t *testing.T) {
+		resp, body := testRequest(t, ts, "GET", "/get?diagnostics=1&url="+uriEncode(destination.URL+"/a"), nil)
+
+		if body != "done" || resp.Header.Get(FinalURLHeader) != destination.URL+"/c" {
+			t.Fatalf("Unexpected response %s from %s", body, resp.Header.Get(FinalURLHeader))
+		}
+
+		var diagnostics Diagnostics
+		if err := json.Unmarshal([]byte(resp.Header.Get(DiagnosticsHeader)), &diagnostics); err != nil {
+			t.Fatal(err)
+		}
+
+		if diagnostics.Winner != firstRequest || diagnostics.FinalURL != destination.URL+"/c" {
+			t.Fatalf("Unexpected diagnostics %s", resp.Header.Get(DiagnosticsHeader))
+		}
+
+		winner := diagnostics.Attempts[0]
+		if winner.Proxy != directProxy || winner.Status != http.StatusOK || len(winner.Redirects) != 2 {
+			t.Fatalf("Unexpected winning attempt %+v", winner)
+		}
+
+		if winner.Redirects[0].URL != destination.URL+"/a" || winner.Redirects[0].Status != http.StatusFound || winner.Redirects[0].Location != "/b" {
+			t.Fatalf("Unexpected first redirect %+v", winner.Redirects[0])
+		}
+
+		if winner.Redirects[1].URL != destination.URL+"/b" || winner.Redirects[1].Status != http.StatusMovedPermanently {
+			t.Fatalf("Unexpected second redirect %+v", winner.Redirects[1])
+		}
+	})
+
+	t.Run("redirects are returned", func(t *testing.T) {
+		resp := notFollowingRequest(t, ts, "/get?redirect=none&url="+uriEncode(destination.URL+"/a"))
+
+		if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/b" {
+			t.Fatalf("Expected a redirect to /b, got %d %s", resp.StatusCode, resp.Header.Get("Location"))
+		}
+	})
+
+	t.Run("redirects to other hosts are returned", func(t *testing.T) {
+		resp := notFollowingRequest(t, ts, "/get?redirect=same_host&url="+uriEncode(destination.URL+"/away"))
+
+		if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != elsewhere.URL+"/" {
+			t.Fatalf("Expected a redirect elsewhere, got %d %s", resp.StatusCode, resp.Header.Get("Location"))
+		}
+
+		_, body := testRequest(t, ts, "GET", "/get?redirect=same_host&url="+uriEncode(destination.URL+"/a"), nil)
+		if body != "done" {
+			t.Fatalf("Expected redirects to the same host to be followed, got %s", body)
+		}
+	})
+
+	t.Run("too many redirects", func(t *testing.T) {
+		resp, _ := testRequest(t, ts, "GET", "/get?max_redirects=1&url="+uriEncode(destination.URL+"/a"), nil)
+
+		if resp.StatusCode != http.StatusBadGateway || resp.Header.Get(ErrorCodeHeader) != ErrorCodeTooManyRedirects {
+			t.Fatalf("Expected 502 with %s, got %d %q", ErrorCodeTooManyRedirects, resp.StatusCode, resp.Header.Get(ErrorCodeHeader))
+		}
+	})
+
+	t.Run("invalid policy", func(t *testing.T) {
+		resp, _ := testRequest(t, ts, "GET", "/get?redirect=sometimes&url="+uriEncode(destination.URL+"/a"), nil)
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400, got %d", resp.StatusCode)
+		}
+	})
+}
+
+// notFollowingRequest - make a GET request returning redirects as they are
+func notFollowingRequest(t *testing.T, ts *httptest.Server, path string) *http.Response {
+	req, _ := http.NewRequest("GET", ts.URL+path, nil)
+
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	return resp
+}
+
+func TestRedirectsThroughRotatingProxies(t *testing.T) {
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusFound)
+		case "/b":
+			http.Redirect(w, r, "/c", http.StatusFound)
+		default:
+			fmt.Fprint(w, "done")
+		}
+	}))
+	defer destination.Close()
+
+	forward := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.RequestURI = ""
+		resp, err := http.DefaultTransport.RoundTrip(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		copyHeaders(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	})
+
+	first := httptest.NewServer(forward)
+	defer first.Close()
+	second := httptest.NewServer(forward)
+	defer second.Close()
+
+	list := NewList()
+	list.Add(first.URL)
+	list.Add(second.URL)
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	server := NewServer(logger, list)
+
+	r := chi.NewRouter()
+	r.With(server.ProxyGetRequest).Get("/get", server.ProxyGetResponse)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	resp, body := testRequest(t, ts, "GET", "/get?diagnostics=1&redirect_proxy=rotate&url="+uriEncode(destination.URL+"/a"), nil)
+	if body != "done" {
+		t.Fatalf("Unexpected body %s", body)
+	}
+
+	var diagnostics Diagnostics
+	if err := json.Unmarshal([]byte(resp.Header.Get(DiagnosticsHeader)), &diagnostics); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, attempt := range diagnostics.Attempts {
+		if attempt.Index != diagnostics.Winner {
+			continue
+		}
+
+		if len(attempt.Redirects) != 2 {
+			t.Fatalf("Expected 2 redirects, got %+v", attempt)
+		}
+
+		if attempt.Redirects[0].Proxy == "" || attempt.Redirects[0].Proxy == attempt.Proxy {
+			t.Fatalf("Expected the second hop to go through another proxy, got %+v", attempt)
+		}
+
+		return
+	}
+
+	t.Fatalf("Winner is missing in %s", resp.Header.Get(DiagnosticsHeader))
+}
@@ -0,0 +1,684 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// time the other address family gets to answer once the first one did
+	resolutionDelay = 50 * time.Millisecond
+	// time the first address family gets to connect before the other one is tried too
+	fallbackDelay = 300 * time.Millisecond
+	// time an upstream server gets to answer a query
+	queryTimeout = 5 * time.Second
+	// resolved hosts kept in the cache
+	maxCachedHosts = 10000
+)
+
+var errNoSuchHost = errors.New("no such host")
+
+// DNSError - the host could not be resolved
+type DNSError struct {
+	Host string
+	Err  error
+}
+
+func (e *DNSError) Error() string {
+	return fmt.Sprintf("could not resolve %s: %v", e.Host, e.Err)
+}
+
+func (e *DNSError) Unwrap() error {
+	return e.Err
+}
+
+// Resolver - resolves hosts for the dialers of the attempts
+// static overrides go first, then the cache, then the upstream servers or the system resolver
+type Resolver struct {
+	// hosts file with static overrides
+	Filename string
+
+	// upstream servers tried in order, the system resolver is used when there are none
+	servers   []*url.URL
+	overrides map[string][]net.IP
+	// how long answers of the system resolver are cached, upstream answers are cached for their TTL
+	cacheTTL time.Duration
+
+	dialer *net.Dialer
+	client *http.Client
+
+	mu      sync.Mutex
+	cache   map[string]*dnsEntry
+	lookups map[string]*dnsLookup
+}
+
+type dnsEntry struct {
+	ips       []net.IP
+	expiresAt time.Time
+}
+
+// dnsLookup - lookup in flight shared by the dials of the same host
+type dnsLookup struct {
+	done chan struct{}
+	ips  []net.IP
+	err  error
+}
+
+// Load - load the upstream servers of GPM_DNS_SERVERS and the overrides of the hosts file
+func (r *Resolver) Load() {
+	if err := r.SetServers(getDNSServers()...); err != nil {
+		panic(err)
+	}
+
+	if r.Filename == "" {
+		return
+	}
+
+	file, err := os.Open(r.Filename)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	if err := r.loadHosts(file); err != nil {
+		panic(fmt.Errorf("could not parse hosts file %s: %v", r.Filename, err))
+	}
+}
+
+// loadHosts - overrides in the format of /etc/hosts, an address followed by its hosts
+func (r *Resolver) loadHosts(hosts io.Reader) error {
+	scanner := bufio.NewScanner(hosts)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			return fmt.Errorf("invalid line %q", scanner.Text())
+		}
+
+		for _, host := range fields[1:] {
+			r.Override(host, append(r.overrides[normalizeHost(host)], ip)...)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// SetServers - upstream servers like `1.1.1.1`, `tcp://8.8.8.8:53` or `https://dns.google/dns-query`
+// plain addresses are queried over UDP on port 53
+func (r *Resolver) SetServers(servers ...string) error {
+	parsed := make([]*url.URL, 0, len(servers))
+	for _, server := range servers {
+		if !strings.Contains(server, "://") {
+			server = "udp://" + server
+		}
+
+		u, err := url.Parse(server)
+		if err != nil {
+			return fmt.Errorf("invalid DNS server %s: %v", server, err)
+		}
+
+		switch u.Scheme {
+		case "udp", "tcp":
+			if u.Port() == "" {
+				u.Host = net.JoinHostPort(u.Hostname(), "53")
+			}
+		case "https":
+		default:
+			return fmt.Errorf("DNS server %s must be queried over udp, tcp or https", server)
+		}
+
+		parsed = append(parsed, u)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.servers = parsed
+
+	return nil
+}
+
+// Override - the host always resolves to the addresses
+func (r *Resolver) Override(host string, ips ...net.IP) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.overrides[normalizeHost(host)] = ips
+}
+
+// LookupIP - addresses of the host, the address family that answered first goes first
+// the second return value tells if the addresses were not looked up by this call
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, bool, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, true, nil
+	}
+
+	host = normalizeHost(host)
+
+	r.mu.Lock()
+	if ips, ok := r.overrides[host]; ok {
+		r.mu.Unlock()
+		return ips, true, nil
+	}
+
+	if entry, ok := r.cache[host]; ok && time.Now().Before(entry.expiresAt) {
+		r.mu.Unlock()
+		return entry.ips, true, nil
+	}
+
+	if lookup, ok := r.lookups[host]; ok {
+		r.mu.Unlock()
+		return lookup.wait(ctx, true)
+	}
+
+	lookup := &dnsLookup{done: make(chan struct{})}
+	r.lookups[host] = lookup
+	servers := r.servers
+	r.mu.Unlock()
+
+	// the lookup is shared, it goes on when the caller that started it gives up
+	go r.resolve(host, servers, lookup)
+
+	return lookup.wait(ctx, false)
+}
+
+// resolve - look the host up on behalf of everyone waiting for it and cache the answer
+// every server gets queryTimeout to answer, so does the system resolver
+func (r *Resolver) resolve(host string, servers []*url.URL, lookup *dnsLookup) {
+	timeout := queryTimeout * time.Duration(len(servers))
+	if timeout == 0 {
+		timeout = queryTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ips, ttl, err := r.lookup(ctx, servers, host)
+
+	r.mu.Lock()
+	delete(r.lookups, host)
+	if err == nil && ttl > 0 {
+		r.store(host, ips, ttl)
+	}
+	r.mu.Unlock()
+
+	lookup.ips, lookup.err = ips, err
+	close(lookup.done)
+}
+
+// wait - addresses of the lookup unless the context is done first
+func (lookup *dnsLookup) wait(ctx context.Context, shared bool) ([]net.IP, bool, error) {
+	select {
+	case <-lookup.done:
+		return lookup.ips, shared, lookup.err
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+}
+
+// store - cache the addresses of the host, expired hosts go first when the cache is full
+func (r *Resolver) store(host string, ips []net.IP, ttl time.Duration) {
+	now := time.Now()
+	if len(r.cache) >= maxCachedHosts {
+		for cached, entry := range r.cache {
+			if now.After(entry.expiresAt) {
+				delete(r.cache, cached)
+			}
+		}
+	}
+
+	// still full, forget any host
+	for cached := range r.cache {
+		if len(r.cache) < maxCachedHosts {
+			break
+		}
+		delete(r.cache, cached)
+	}
+
+	r.cache[host] = &dnsEntry{ips: ips, expiresAt: now.Add(ttl)}
+}
+
+// lookup - ask the upstream servers in order or the system resolver without any
+func (r *Resolver) lookup(ctx context.Context, servers []*url.URL, host string) ([]net.IP, time.Duration, error) {
+	if len(servers) == 0 {
+		// the context is detached from the callers, so the system resolver
+		// does not report the lookup to their traces a second time
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		ips := make([]net.IP, len(addrs))
+		for i, addr := range addrs {
+			ips[i] = addr.IP
+		}
+
+		return ips, r.cacheTTL, nil
+	}
+
+	var firstErr error
+	for _, server := range servers {
+		ips, ttl, err := r.lookupServer(ctx, server, host)
+		if err == nil || err == errNoSuchHost {
+			return ips, ttl, err
+		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return nil, 0, firstErr
+}
+
+// lookupServer - query A and AAAA records at the same time
+// once a family answered with addresses the other one gets the resolution delay to catch up
+func (r *Resolver) lookupServer(ctx context.Context, server *url.URL, host string) ([]net.IP, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	type answer struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+
+	answers := make(chan answer, 2)
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		go func(qtype dnsmessage.Type) {
+			ips, ttl, err := r.query(ctx, server, host, qtype)
+			answers <- answer{ips, ttl, err}
+		}(qtype)
+	}
+
+	var ips []net.IP
+	var ttl time.Duration
+	var errs []error
+	var delay <-chan time.Time
+
+	for received := 0; received < 2; {
+		select {
+		case a := <-answers:
+			received++
+			if a.err != nil {
+				errs = append(errs, a.err)
+				continue
+			}
+
+			ips = append(ips, a.ips...)
+			if len(a.ips) > 0 && (ttl == 0 || a.ttl < ttl) {
+				ttl = a.ttl
+			}
+			if len(ips) > 0 && delay == nil {
+				delay = time.After(resolutionDelay)
+			}
+		case <-delay:
+			received = 2
+		}
+	}
+
+	if len(ips) > 0 {
+		return ips, ttl, nil
+	}
+
+	for _, err := range errs {
+		if err != errNoSuchHost {
+			return nil, 0, err
+		}
+	}
+
+	return nil, 0, errNoSuchHost
+}
+
+// query - records of the type from the server over UDP, TCP or HTTPS
+func (r *Resolver) query(ctx context.Context, server *url.URL, host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// DNS over HTTPS uses 0, so identical queries can be cached
+	var id uint16
+	if server.Scheme != "https" {
+		id = uint16(rand.Uint32())
+	}
+
+	message := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	query, err := message.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var response []byte
+	switch server.Scheme {
+	case "udp":
+		response, err = r.exchangeUDP(ctx, server.Host, query)
+	case "tcp":
+		response, err = r.exchangeTCP(ctx, server.Host, query)
+	default:
+		response, err = r.exchangeHTTPS(ctx, server.String(), query)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var answer dnsmessage.Message
+	if err := answer.Unpack(response); err != nil {
+		return nil, 0, err
+	}
+
+	// a truncated answer is asked again over TCP
+	if answer.Truncated && server.Scheme == "udp" {
+		if response, err = r.exchangeTCP(ctx, server.Host, query); err != nil {
+			return nil, 0, err
+		}
+		if err := answer.Unpack(response); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if answer.ID != id {
+		return nil, 0, fmt.Errorf("DNS server %s answered another query", server.Host)
+	}
+
+	switch answer.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, errNoSuchHost
+	default:
+		return nil, 0, fmt.Errorf("DNS server %s answered %s", server.Host, answer.RCode)
+	}
+
+	var ips []net.IP
+	var ttl time.Duration
+	for _, resource := range answer.Answers {
+		switch body := resource.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(append([]byte(nil), body.A[:]...)))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(append([]byte(nil), body.AAAA[:]...)))
+		default:
+			continue
+		}
+
+		recordTTL := time.Duration(resource.Header.TTL) * time.Second
+		if ttl == 0 || recordTTL < ttl {
+			ttl = recordTTL
+		}
+	}
+
+	return ips, ttl, nil
+}
+
+func (r *Resolver) exchangeUDP(ctx context.Context, server string, query []byte) ([]byte, error) {
+	conn, err := r.dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	response := make([]byte, 4096)
+	n, err := conn.Read(response)
+	if err != nil {
+		return nil, err
+	}
+
+	return response[:n], nil
+}
+
+// exchangeTCP - messages over TCP are prefixed with their length
+func (r *Resolver) exchangeTCP(ctx context.Context, server string, query []byte) ([]byte, error) {
+	conn, err := r.dialer.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	prefixed := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(prefixed, uint16(len(query)))
+	copy(prefixed[2:], query)
+	if _, err := conn.Write(prefixed); err != nil {
+		return nil, err
+	}
+
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+
+	response := make([]byte, length)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// exchangeHTTPS - DNS over HTTPS as described in RFC 8484
+func (r *Resolver) exchangeHTTPS(ctx context.Context, server string, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS server %s answered with status %d", server, resp.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// DialContext - dial the address resolving its host with the resolver
+// the lookup is reported to the trace of the context
+func (r *Resolver) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return r.dialWith(ctx, r.dialer, network, addr)
+}
+
+// dialWith - dial the address with the dialer resolving its host with the resolver
+func (r *Resolver) dialWith(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.DNSStart != nil {
+		trace.DNSStart(httptrace.DNSStartInfo{Host: host})
+	}
+
+	ips, shared, err := r.LookupIP(ctx, host)
+	if err == nil {
+		ips = filterIPs(network, ips)
+		if len(ips) == 0 {
+			err = fmt.Errorf("no %s addresses", network)
+		}
+	}
+
+	if trace != nil && trace.DNSDone != nil {
+		addrs := make([]net.IPAddr, len(ips))
+		for i, ip := range ips {
+			addrs[i] = net.IPAddr{IP: ip}
+		}
+		trace.DNSDone(httptrace.DNSDoneInfo{Addrs: addrs, Err: err, Coalesced: shared})
+	}
+
+	if err != nil {
+		return nil, &DNSError{Host: host, Err: err}
+	}
+
+	return r.dialParallel(ctx, dialer, network, ips, port)
+}
+
+// dialParallel - happy eyeballs, addresses of the other family are dialed as well
+// once the family of the first address failed or did not connect within the fallback delay
+func (r *Resolver) dialParallel(ctx context.Context, dialer *net.Dialer, network string, ips []net.IP, port string) (net.Conn, error) {
+	var primaries, fallbacks []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (ips[0].To4() != nil) {
+			primaries = append(primaries, ip)
+		} else {
+			fallbacks = append(fallbacks, ip)
+		}
+	}
+
+	if len(fallbacks) == 0 {
+		return r.dialSerial(ctx, dialer, network, primaries, port)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+
+	results := make(chan dialResult, 2)
+	dial := func(ips []net.IP) {
+		conn, err := r.dialSerial(ctx, dialer, network, ips, port)
+		results <- dialResult{conn, err}
+	}
+
+	go dial(primaries)
+	timer := time.NewTimer(fallbackDelay)
+	defer timer.Stop()
+
+	var firstErr error
+	pending, fallbackStarted := 1, false
+	for {
+		select {
+		case <-timer.C:
+			if !fallbackStarted {
+				go dial(fallbacks)
+				pending, fallbackStarted = pending+1, true
+			}
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				// close the connection of the other family if it still gets established
+				go func(remaining int) {
+					for i := 0; i < remaining; i++ {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return result.conn, nil
+			}
+
+			if firstErr == nil {
+				firstErr = result.err
+			}
+
+			if !fallbackStarted {
+				go dial(fallbacks)
+				pending, fallbackStarted = pending+1, true
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+// dialSerial - dial the addresses one after another until one connects
+func (r *Resolver) dialSerial(ctx context.Context, dialer *net.Dialer, network string, ips []net.IP, port string) (net.Conn, error) {
+	var firstErr error
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, firstErr
+}
+
+// filterIPs - addresses the network can reach
+func filterIPs(network string, ips []net.IP) []net.IP {
+	switch network {
+	case "tcp4", "udp4", "ip4":
+	case "tcp6", "udp6", "ip6":
+	default:
+		return ips
+	}
+
+	v4 := strings.HasSuffix(network, "4")
+	filtered := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if (ip.To4() != nil) == v4 {
+			filtered = append(filtered, ip)
+		}
+	}
+
+	return filtered
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// NewResolver - creates new resolver configured from env
+func NewResolver() *Resolver {
+	return &Resolver{
+		Filename:  getDNSHosts(),
+		overrides: make(map[string][]net.IP),
+		cacheTTL:  getDNSCacheTTL(),
+		dialer:    &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+		client:    &http.Client{Timeout: queryTimeout},
+		cache:     make(map[string]*dnsEntry),
+		lookups:   make(map[string]*dnsLookup),
+	}
+}
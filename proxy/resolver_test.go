@@ -0,0 +1,352 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNS - answers A queries of its records, unknown names don't exist
+type fakeDNS struct {
+	records map[string]string
+	ttl     uint32
+	queries int64
+}
+
+func (f *fakeDNS) answer(query []byte) []byte {
+	var message dnsmessage.Message
+	if err := message.Unpack(query); err != nil || len(message.Questions) != 1 {
+		return nil
+	}
+	atomic.AddInt64(&f.queries, 1)
+
+	question := message.Questions[0]
+	response := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: message.ID, Response: true, RecursionAvailable: true},
+		Questions: message.Questions,
+	}
+
+	ip, ok := f.records[strings.TrimSuffix(question.Name.String(), ".")]
+	switch {
+	case !ok:
+		response.RCode = dnsmessage.RCodeNameError
+	case question.Type == dnsmessage.TypeA:
+		var a [4]byte
+		copy(a[:], net.ParseIP(ip).To4())
+		response.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: f.ttl},
+			Body:   &dnsmessage.AResource{A: a},
+		}}
+	}
+
+	packed, _ := response.Pack()
+	return packed
+}
+
+// serveUDP - serve the records over UDP, returns the address of the server
+func (f *fakeDNS) serveUDP(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(f.answer(buf[:n]), addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+// serveTCP - serve the records over TCP, returns the address of the server
+func (f *fakeDNS) serveTCP(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				var length uint16
+				if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+					return
+				}
+				query := make([]byte, length)
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+
+				answer := f.answer(query)
+				binary.Write(conn, binary.BigEndian, uint16(len(answer)))
+				conn.Write(answer)
+			}(conn)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestResolver(t *testing.T) {
+	dns := &fakeDNS{records: map[string]string{"app.test": "127.0.0.1"}, ttl: 1}
+	udpServer := dns.serveUDP(t)
+	ctx := context.Background()
+
+	lookup := func(t *testing.T, r *Resolver, host string) []net.IP {
+		ips, _, err := r.LookupIP(ctx, host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ips
+	}
+
+	t.Run("answers are cached for their TTL", func(t *testing.T) {
+		r := NewResolver()
+		if err := r.SetServers(udpServer); err != nil {
+			t.Fatal(err)
+		}
+
+		if ips := lookup(t, r, "app.test"); len(ips) != 1 || !ips[0].Equal(net.ParseIP("127.0.0.1")) {
+			t.Fatalf("Unexpected addresses %v", ips)
+		}
+
+		queries := atomic.LoadInt64(&dns.queries)
+		lookup(t, r, "APP.test.")
+		if atomic.LoadInt64(&dns.queries) != queries {
+			t.Fatalf("Expected the answer to be cached")
+		}
+
+		time.Sleep(1100 * time.Millisecond)
+		lookup(t, r, "app.test")
+		if atomic.LoadInt64(&dns.queries) == queries {
+			t.Fatalf("Expected the answer to expire")
+		}
+	})
+
+	t.Run("tcp and https", func(t *testing.T) {
+		doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			query, _ := io.ReadAll(r.Body)
+			w.Header().Set("Content-Type", "application/dns-message")
+			w.Write(dns.answer(query))
+		}))
+		defer doh.Close()
+
+		for _, server := range []string{"tcp://" + dns.serveTCP(t), doh.URL + "/dns-query"} {
+			r := NewResolver()
+			r.client = doh.Client()
+			if err := r.SetServers(server); err != nil {
+				t.Fatal(err)
+			}
+
+			if ips := lookup(t, r, "app.test"); len(ips) != 1 {
+				t.Fatalf("Unexpected addresses %v from %s", ips, server)
+			}
+		}
+	})
+
+	t.Run("failover", func(t *testing.T) {
+		r := NewResolver()
+		if err := r.SetServers("udp://127.0.0.1:1", udpServer); err != nil {
+			t.Fatal(err)
+		}
+
+		if ips := lookup(t, r, "app.test"); len(ips) != 1 {
+			t.Fatalf("Unexpected addresses %v", ips)
+		}
+	})
+
+	t.Run("lookups outlive the caller that started them", func(t *testing.T) {
+		asked := make(chan struct{}, 2)
+		answering, answer := context.WithCancel(ctx)
+		doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			query, _ := io.ReadAll(r.Body)
+			asked <- struct{}{}
+			<-answering.Done()
+			w.Header().Set("Content-Type", "application/dns-message")
+			w.Write(dns.answer(query))
+		}))
+		defer doh.Close()
+		defer answer()
+
+		r := NewResolver()
+		r.client = doh.Client()
+		if err := r.SetServers(doh.URL + "/dns-query"); err != nil {
+			t.Fatal(err)
+		}
+
+		firstCtx, cancel := context.WithCancel(ctx)
+		first := make(chan error, 1)
+		go func() {
+			_, _, err := r.LookupIP(firstCtx, "app.test")
+			first <- err
+		}()
+		<-asked
+
+		type result struct {
+			ips    []net.IP
+			shared bool
+			err    error
+		}
+		second := make(chan result, 1)
+		go func() {
+			ips, shared, err := r.LookupIP(ctx, "app.test")
+			second <- result{ips, shared, err}
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		cancel()
+		select {
+		case err := <-first:
+			if err != context.Canceled {
+				t.Fatalf("Expected the first caller to give up, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the first caller to give up on its own context")
+		}
+
+		answer()
+		select {
+		case res := <-second:
+			if res.err != nil || len(res.ips) != 1 || !res.shared {
+				t.Fatalf("Expected the shared lookup to answer, got %v %v %v", res.ips, res.shared, res.err)
+			}
+		case <-time.After(queryTimeout):
+			t.Fatalf("Expected the shared lookup to answer")
+		}
+	})
+
+	t.Run("no such host", func(t *testing.T) {
+		r := NewResolver()
+		r.SetServers(udpServer)
+
+		_, err := r.DialContext(ctx, "tcp", "missing.test:80")
+		var dnsErr *DNSError
+		if !errors.As(err, &dnsErr) || dnsErr.Err != errNoSuchHost {
+			t.Fatalf("Expected no such host, got %v", err)
+		}
+	})
+
+	t.Run("overrides", func(t *testing.T) {
+		r := NewResolver()
+		r.SetServers(udpServer)
+		if err := r.loadHosts(strings.NewReader("# overrides\n10.0.0.1 app.test other.test\n\n::1 app.test\n")); err != nil {
+			t.Fatal(err)
+		}
+
+		queries := atomic.LoadInt64(&dns.queries)
+		if ips := lookup(t, r, "app.test"); len(ips) != 2 || !ips[0].Equal(net.ParseIP("10.0.0.1")) {
+			t.Fatalf("Unexpected addresses %v", ips)
+		}
+		if atomic.LoadInt64(&dns.queries) != queries {
+			t.Fatalf("Expected overrides not to be queried")
+		}
+
+		if err := r.loadHosts(strings.NewReader("app.test\n")); err == nil {
+			t.Fatalf("Expected an invalid line to fail")
+		}
+	})
+
+	t.Run("happy eyeballs", func(t *testing.T) {
+		listener, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+
+		_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+		r := NewResolver()
+		r.Override("dual.test", net.ParseIP("::1"), net.ParseIP("127.0.0.1"))
+
+		conn, err := r.DialContext(ctx, "tcp", "dual.test:"+port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if conn.RemoteAddr().String() != listener.Addr().String() {
+			t.Fatalf("Expected IPv4 to be used, got %s", conn.RemoteAddr())
+		}
+	})
+}
+
+func TestDNSResolution(t *testing.T) {
+	dns := &fakeDNS{records: map[string]string{"app.test": "127.0.0.1"}, ttl: 60}
+	os.Setenv("GPM_DNS_SERVERS", dns.serveUDP(t))
+	defer os.Unsetenv("GPM_DNS_SERVERS")
+
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Host)
+	}))
+	defer destination.Close()
+
+	_, port, _ := net.SplitHostPort(destination.Listener.Addr().String())
+
+	list := NewList()
+	list.Filename = "../proxy.list.example"
+	list.Load()
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	server := NewServer(logger, list)
+
+	r := chi.NewRouter()
+	r.With(server.ProxyGetRequest).Get("/get", server.ProxyGetResponse)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	t.Run("timing in diagnostics", func(t *testing.T) {
+		resp, body := testRequest(t, ts, "GET", "/get?diagnostics=1&url="+uriEncode("http://app.test:"+port+"/"), nil)
+		if body != "app.test:"+port {
+			t.Fatalf("Unexpected body %s", body)
+		}
+
+		var diagnostics Diagnostics
+		if err := json.Unmarshal([]byte(resp.Header.Get(DiagnosticsHeader)), &diagnostics); err != nil {
+			t.Fatal(err)
+		}
+
+		direct := diagnostics.Attempts[0]
+		if direct.DNS <= 0 || direct.Address != destination.Listener.Addr().String() {
+			t.Fatalf("Expected DNS timing and the address, got %s", resp.Header.Get(DiagnosticsHeader))
+		}
+	})
+
+	t.Run("unresolvable destination", func(t *testing.T) {
+		resp, _ := testRequest(t, ts, "GET", "/get?url="+uriEncode("http://missing.test:"+port+"/"), nil)
+
+		if resp.Header.Get(ErrorCodeHeader) != ErrorCodeDNS {
+			t.Fatalf("Expected %s, got %d %q", ErrorCodeDNS, resp.StatusCode, resp.Header.Get(ErrorCodeHeader))
+		}
+	})
+}
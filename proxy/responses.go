@@ -17,14 +17,20 @@ type FirstResponse struct {
 	elapsed time.Duration
 	// an error created in the request context
 	err error
+	// body should be streamed to the client as it arrives
+	streamed bool
+	// proxy the response came through, directProxy when there was none
+	proxy string
+	// header profile the response was requested with, empty when there was none
+	profile string
+	// what happened while the response was being obtained, nil for cached responses
+	diagnostics *Diagnostics
 }
 
 // IsValid - checks if response is valid
+// the multiplexer decides which statuses are good enough to be the first response
 func (fr *FirstResponse) IsValid() bool {
-	return fr.Response != nil &&
-		fr.err == nil &&
-		fr.Response.StatusCode >= 200 &&
-		fr.Response.StatusCode < 300
+	return fr.Response != nil && fr.err == nil
 }
 
 // GetElapsedSeconds - get time elapsed since the request processing started
@@ -62,6 +68,15 @@ func (fr *FirstResponse) GetHeader() http.Header {
 	return fr.Response.Header
 }
 
+// GetFinalURL - URL the response came from after redirects, empty if unknown
+func (fr *FirstResponse) GetFinalURL() string {
+	if fr.Response == nil || fr.Response.Request == nil {
+		return ""
+	}
+
+	return fr.Response.Request.URL.String()
+}
+
 func NewValidFirstResponse(response *http.Response, elapsed time.Duration) *FirstResponse {
 	return &FirstResponse{
 		Response: response,
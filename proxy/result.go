@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+	"unicode/utf8"
+)
+
+// Result - outcome of a request made for a spec
+// reported by the endpoints that don't proxy the response as is
+type Result struct {
+	Index      int         `json:"index"`
+	URL        string      `json:"url"`
+	Method     string      `json:"method"`
+	StatusCode int         `json:"status,omitempty"`
+	Header     http.Header `json:"headers,omitempty"`
+	Body       string      `json:"body,omitempty"`
+	// values extracted from the body, replace the body
+	Extracted json.RawMessage `json:"extracted,omitempty"`
+	// base64 when the body is not valid UTF-8
+	BodyEncoding string `json:"body_encoding,omitempty"`
+	// seconds it took to process the request
+	Elapsed   float64 `json:"elapsed"`
+	TimedOut  bool    `json:"timed_out,omitempty"`
+	Cache     string  `json:"cache,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	ErrorCode string  `json:"error_code,omitempty"`
+	// delivery of the result to the callback URL if one was given
+	DeliveryID string `json:"delivery_id,omitempty"`
+	// URL the response came from after redirects
+	FinalURL string `json:"final_url,omitempty"`
+	// reported when the diagnostics option is set
+	Diagnostics *Diagnostics `json:"diagnostics,omitempty"`
+}
+
+// setError - mark result as failed
+func (res *Result) setError(err error) {
+	res.Error = err.Error()
+	res.ErrorCode = errorCode(err)
+}
+
+// setBody - set the body encoding it with base64 if it is not valid UTF-8
+func (res *Result) setBody(body []byte) {
+	if utf8.Valid(body) {
+		res.Body = string(body)
+		return
+	}
+
+	res.Body = base64.StdEncoding.EncodeToString(body)
+	res.BodyEncoding = "base64"
+}
+
+// runSpec - validate the spec, make the request and collect its outcome
+// on success the response is returned as well, its body is left to the caller
+// to consume and close
+func (s *Server) runSpec(r *http.Request, index int, spec *RequestSpec) (*Result, *FirstResponse) {
+	startedAt := time.Now()
+	result := &Result{Index: index, URL: spec.URL, Method: spec.Method}
+
+	defer func() {
+		result.Elapsed = time.Since(startedAt).Seconds()
+	}()
+
+	err := spec.Validate()
+	if err == nil {
+		err = s.profiles.ValidateProfile(spec.Options.Profile)
+	}
+	if err != nil {
+		result.setError(err)
+		return result, nil
+	}
+	result.URL, result.Method = spec.URL, spec.Method
+
+	if err := s.checkRobots(r, spec.URL); err != nil {
+		result.setError(err)
+		return result, nil
+	}
+
+	response, cacheStatus := s.fetch(r, spec)
+	result.Cache = cacheStatus
+	result.TimedOut = response.HasTimedOut()
+	if spec.Options.Diagnostics {
+		result.Diagnostics = response.diagnostics
+	}
+
+	if !response.IsValid() {
+		result.setError(response.GetError())
+		return result, nil
+	}
+
+	result.StatusCode = response.GetStatusCode()
+	result.Header = response.GetHeader()
+	result.FinalURL = response.GetFinalURL()
+
+	return result, response
+}
+
+// runSpecWithBody - run the spec and read the response body into the result
+func (s *Server) runSpecWithBody(r *http.Request, index int, spec *RequestSpec) *Result {
+	startedAt := time.Now()
+
+	result, response := s.runSpec(r, index, spec)
+	if response == nil {
+		return result
+	}
+	defer response.CloseBody()
+
+	body, err := ioutil.ReadAll(response.GetBody())
+	if err != nil {
+		result.setError(err)
+	} else if len(spec.Options.Extract) > 0 {
+		result.Extracted = body
+	} else {
+		result.setBody(body)
+	}
+
+	result.Elapsed = time.Since(startedAt).Seconds()
+
+	return result
+}
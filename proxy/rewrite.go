@@ -0,0 +1,266 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// attributes holding URLs
+var urlAttributes = map[string]bool{
+	"href":       true,
+	"src":        true,
+	"action":     true,
+	"formaction": true,
+	"poster":     true,
+	"data":       true,
+	"background": true,
+}
+
+var (
+	cssURLPattern    = regexp.MustCompile(`url\(\s*(['"]?)([^'")]*)(['"]?)\s*\)`)
+	cssImportPattern = regexp.MustCompile(`@import\s+(['"])([^'"]+)(['"])`)
+	refreshPattern   = regexp.MustCompile(`(?i)^(\s*\d+\s*;\s*url\s*=\s*)(.+)$`)
+)
+
+// Rewriter - rewrites URLs of HTML and CSS to point back through gpm
+type Rewriter struct {
+	// URL relative references are resolved against
+	base *url.URL
+	// endpoint the rewritten URLs point to, e.g. http://localhost:8081/get
+	endpoint string
+	// query params added to every rewritten URL along with the url param
+	query url.Values
+}
+
+// URL - absolute URL of the reference proxied through gpm
+// references that can't be fetched are left as they are
+func (rw *Rewriter) URL(ref string) string {
+	trimmed := strings.TrimSpace(ref)
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+		return ref
+	}
+
+	u, err := rw.base.Parse(trimmed)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ref
+	}
+
+	query := url.Values{}
+	for key, values := range rw.query {
+		query[key] = values
+	}
+	query.Set("url", u.String())
+
+	return rw.endpoint + "?" + query.Encode()
+}
+
+// CSS - rewrite url() and @import references of a stylesheet
+func (rw *Rewriter) CSS(css string) string {
+	css = cssURLPattern.ReplaceAllStringFunc(css, func(match string) string {
+		parts := cssURLPattern.FindStringSubmatch(match)
+		if parts[1] != parts[3] || strings.HasPrefix(strings.TrimSpace(parts[2]), "data:") {
+			return match
+		}
+
+		return "url(" + parts[1] + rw.URL(parts[2]) + parts[3] + ")"
+	})
+
+	return cssImportPattern.ReplaceAllStringFunc(css, func(match string) string {
+		parts := cssImportPattern.FindStringSubmatch(match)
+		if parts[1] != parts[3] {
+			return match
+		}
+
+		return "@import " + parts[1] + rw.URL(parts[2]) + parts[3]
+	})
+}
+
+// HTML - rewrite references in attributes, inline styles and stylesheets of a document
+// the document is rewritten token by token, so untouched markup is kept as is
+func (rw *Rewriter) HTML(r io.Reader, w io.Writer) error {
+	z := html.NewTokenizer(r)
+	inStyle := false
+
+	for {
+		tokenType := z.Next()
+
+		switch tokenType {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return nil
+			}
+			return z.Err()
+		case html.StartTagToken, html.SelfClosingTagToken:
+			raw := append([]byte(nil), z.Raw()...)
+			token := z.Token()
+
+			if token.Data == "style" && tokenType == html.StartTagToken {
+				inStyle = true
+			}
+
+			if rw.rewriteToken(&token) {
+				io.WriteString(w, token.String())
+			} else {
+				w.Write(raw)
+			}
+		case html.EndTagToken:
+			inStyle = false
+			w.Write(z.Raw())
+		case html.TextToken:
+			if inStyle {
+				io.WriteString(w, rw.CSS(string(z.Raw())))
+			} else {
+				w.Write(z.Raw())
+			}
+		default:
+			w.Write(z.Raw())
+		}
+	}
+}
+
+// rewriteToken - rewrite URL attributes of the tag, returns false if nothing changed
+func (rw *Rewriter) rewriteToken(token *html.Token) bool {
+	// resolving against <base> is done by gpm, the browser must not apply it again
+	if token.Data == "base" {
+		for _, attr := range token.Attr {
+			if attr.Key == "href" {
+				if base, err := rw.base.Parse(attr.Val); err == nil {
+					rw.base = base
+				}
+			}
+		}
+	}
+
+	changed := false
+	isRefresh := token.Data == "meta" && strings.EqualFold(attrValue(token, "http-equiv"), "refresh")
+
+	for i, attr := range token.Attr {
+		value := attr.Val
+
+		switch {
+		case token.Data == "base" && attr.Key == "href":
+			value = rw.URL(attr.Val)
+		case urlAttributes[attr.Key]:
+			value = rw.URL(attr.Val)
+		case attr.Key == "srcset":
+			value = rw.srcset(attr.Val)
+		case attr.Key == "style":
+			value = rw.CSS(attr.Val)
+		case isRefresh && attr.Key == "content":
+			if parts := refreshPattern.FindStringSubmatch(attr.Val); parts != nil {
+				value = parts[1] + rw.URL(strings.Trim(parts[2], `'"`))
+			}
+		}
+
+		if value != attr.Val {
+			token.Attr[i].Val = value
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// srcset - rewrite every candidate of a srcset attribute keeping its descriptor
+func (rw *Rewriter) srcset(value string) string {
+	candidates := strings.Split(value, ",")
+	for i, candidate := range candidates {
+		fields := strings.Fields(candidate)
+		if len(fields) == 0 {
+			continue
+		}
+
+		fields[0] = rw.URL(fields[0])
+		candidates[i] = strings.Join(fields, " ")
+	}
+
+	return strings.Join(candidates, ", ")
+}
+
+func attrValue(token *html.Token, key string) string {
+	for _, attr := range token.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+
+	return ""
+}
+
+// newRewriter - rewriter of the response to the request made to gpm
+// rewritten URLs carry the api key of the caller and the rewrite option
+func newRewriter(r *http.Request, base *url.URL) *Rewriter {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+
+	query := url.Values{"rewrite": {"1"}}
+	if apiKey := r.URL.Query().Get("api_key"); apiKey != "" {
+		query.Set("api_key", apiKey)
+	}
+
+	return &Rewriter{
+		base:     base,
+		endpoint: scheme + "://" + r.Host + r.URL.Path,
+		query:    query,
+	}
+}
+
+// rewriteResponse - rewrite HTML and CSS bodies so they render through gpm
+// other bodies are passed as they are
+func (s *Server) rewriteResponse(r *http.Request, spec *RequestSpec, response *FirstResponse) *FirstResponse {
+	if !response.IsValid() {
+		return response
+	}
+
+	contentType := mediaType(response.GetHeader().Get("Content-Type"))
+	if contentType != "text/html" && contentType != "application/xhtml+xml" && contentType != "text/css" {
+		return response
+	}
+
+	// the final URL after redirects, a cached response only knows the requested one
+	base, err := url.Parse(spec.URL)
+	if response.Response.Request != nil {
+		base, err = response.Response.Request.URL, nil
+	}
+	if err != nil {
+		return response
+	}
+
+	body, err := ioutil.ReadAll(response.GetBody())
+	response.CloseBody()
+	if err != nil {
+		return NewInvalidFirstResponse(err, false, response.elapsed)
+	}
+
+	rw := newRewriter(r, base)
+
+	var rewritten bytes.Buffer
+	if contentType == "text/css" {
+		rewritten.WriteString(rw.CSS(string(body)))
+	} else if err := rw.HTML(bytes.NewReader(body), &rewritten); err != nil {
+		return NewInvalidFirstResponse(err, false, response.elapsed)
+	}
+
+	rewrittenResponse := *response.Response
+	rewrittenResponse.Header = response.GetHeader().Clone()
+	rewrittenResponse.Header.Del("Content-Length")
+	rewrittenResponse.ContentLength = int64(rewritten.Len())
+	rewrittenResponse.Body = ioutil.NopCloser(&rewritten)
+
+	rewrittenFirstResponse := *response
+	rewrittenFirstResponse.Response = &rewrittenResponse
+
+	return &rewrittenFirstResponse
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+)
+
+func TestRewriterHTML(t *testing.T) {
+	base, _ := url.Parse("http://example.com/dir/page.html")
+	rw := &Rewriter{base: base, endpoint: "http://gpm/get", query: url.Values{"rewrite": {"1"}}}
+
+	proxied := func(target string) string {
+		return "http://gpm/get?" + url.Values{"rewrite": {"1"}, "url": {target}}.Encode()
+	}
+
+	page := `<html><head>
+<link rel="stylesheet" href="/style.css">
+<style>body { background: url('img/bg.png'); } @import "print.css";</style>
+</head><body>
+<a href="next.html">next</a> <a href="#top">top</a> <a href="javascript:void(0)">js</a> <a href="mailto:a@b.c">mail</a>
+<img src="//cdn.example.com/logo.png" srcset="a.png 1x, b.png 2x">
+<div style="background-image: url(data:image/png;base64,AAAA)"></div>
+<form action="search"></form>
+</body></html>`
+
+	var out bytes.Buffer
+	if err := rw.HTML(strings.NewReader(page), &out); err != nil {
+		t.Fatal(err)
+	}
+	rewritten := out.String()
+
+	for _, expected := range []string{
+		`href="` + htmlEscape(proxied("http://example.com/style.css")) + `"`,
+		`url('` + proxied("http://example.com/dir/img/bg.png") + `')`,
+		`@import "` + proxied("http://example.com/dir/print.css") + `"`,
+		`href="` + htmlEscape(proxied("http://example.com/dir/next.html")) + `"`,
+		`src="` + htmlEscape(proxied("http://cdn.example.com/logo.png")) + `"`,
+		htmlEscape(proxied("http://example.com/dir/a.png")) + ` 1x, ` + htmlEscape(proxied("http://example.com/dir/b.png")) + ` 2x`,
+		`action="` + htmlEscape(proxied("http://example.com/dir/search")) + `"`,
+		`<a href="#top">top</a>`,
+		`<a href="javascript:void(0)">js</a>`,
+		`<a href="mailto:a@b.c">mail</a>`,
+		`url(data:image/png;base64,AAAA)`,
+	} {
+		if !strings.Contains(rewritten, expected) {
+			t.Fatalf("Expected %s in\n%s", expected, rewritten)
+		}
+	}
+}
+
+func htmlEscape(s string) string {
+	return strings.Replace(s, "&", "&amp;", -1)
+}
+
+func TestRewrittenResponses(t *testing.T) {
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/start":
+			http.Redirect(w, r, "/dir/page", http.StatusFound)
+		case "/dir/page":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<a href="next">next</a>`)
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprint(w, `<a href="next">next</a>`)
+		}
+	}))
+	defer destination.Close()
+
+	list := NewList()
+	list.Filename = "../proxy.list.example"
+	list.Load()
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	server := NewServer(logger, list)
+	key, _ := ParseKey("browser", nil)
+	server.keys.Add(key)
+
+	r := chi.NewRouter()
+	r.Use(server.CheckAPIKey)
+	r.With(server.ProxyGetRequest).Get("/get", server.ProxyGetResponse)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	t.Run("links are resolved against the final URL", func(t *testing.T) {
+		_, body := testRequest(t, ts, "GET", "/get?api_key=browser&rewrite=1&url="+uriEncode(destination.URL+"/start"), nil)
+
+		next := url.Values{"api_key": {"browser"}, "rewrite": {"1"}, "url": {destination.URL + "/dir/next"}}.Encode()
+		if body != `<a href="`+htmlEscape(ts.URL+"/get?"+next)+`">next</a>` {
+			t.Fatalf("Unexpected body %s", body)
+		}
+	})
+
+	t.Run("the original response is left alone", func(t *testing.T) {
+		header := http.Header{"Content-Type": {"text/html"}, "Content-Length": {"23"}}
+		original := NewValidFirstResponse(&http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        header,
+			Body:          ioutil.NopCloser(strings.NewReader(`<a href="next">next</a>`)),
+			ContentLength: 23,
+		}, 0)
+
+		req, _ := http.NewRequest("GET", ts.URL+"/get", nil)
+		rewritten := server.rewriteResponse(req, &RequestSpec{URL: destination.URL + "/dir/"}, original)
+		body, _ := ioutil.ReadAll(rewritten.GetBody())
+
+		if header.Get("Content-Length") != "23" || rewritten.GetHeader().Get("Content-Length") != "" {
+			t.Fatalf("Expected the header to be copied, got %v and %v", header, rewritten.GetHeader())
+		}
+		if rewritten.Response.ContentLength != int64(len(body)) {
+			t.Fatalf("Expected the length of the rewritten body, got %d for %d bytes", rewritten.Response.ContentLength, len(body))
+		}
+	})
+
+	t.Run("other content types are left alone", func(t *testing.T) {
+		_, body := testRequest(t, ts, "GET", "/get?api_key=browser&rewrite=1&url="+uriEncode(destination.URL+"/text"), nil)
+
+		if body != `<a href="next">next</a>` {
+			t.Fatalf("Unexpected body %s", body)
+		}
+	})
+}
@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// robots.txt files bigger than that are truncated as allowed by RFC 9309
+const maxRobotsSize = 500 * 1024
+
+// user agent matched against robots.txt when GPM_USER_AGENT is not set
+// it is the product token go sends by default
+const defaultUserAgent = "Go-http-client"
+
+// robots.txt fetch failures are remembered for a short time only
+const robotsErrorTTL = time.Minute
+
+// Robots - parsed robots.txt file
+type Robots struct {
+	groups []*robotsGroup
+}
+
+type robotsGroup struct {
+	agents     []string
+	rules      []*robotsRule
+	crawlDelay time.Duration
+}
+
+type robotsRule struct {
+	allow   bool
+	pattern string
+	regx    *regexp.Regexp
+}
+
+// Allowed - checks whether the user agent may fetch the given path
+// the longest matching rule wins, on a tie allow rule is preferred
+func (rb *Robots) Allowed(userAgent, path string) bool {
+	if path == "" {
+		path = "/"
+	}
+
+	var match *robotsRule
+	for _, group := range rb.groupsFor(userAgent) {
+		for _, rule := range group.rules {
+			if !rule.regx.MatchString(path) {
+				continue
+			}
+
+			if match == nil ||
+				len(rule.pattern) > len(match.pattern) ||
+				(len(rule.pattern) == len(match.pattern) && rule.allow) {
+				match = rule
+			}
+		}
+	}
+
+	return match == nil || match.allow
+}
+
+// CrawlDelay - get the crawl delay requested for the user agent
+func (rb *Robots) CrawlDelay(userAgent string) time.Duration {
+	var delay time.Duration
+	for _, group := range rb.groupsFor(userAgent) {
+		if group.crawlDelay > delay {
+			delay = group.crawlDelay
+		}
+	}
+
+	return delay
+}
+
+// groupsFor - get the groups that apply to the user agent
+// the group naming the longest prefix of the product token is the most specific one and wins,
+// groups naming the same agent are merged, `*` applies only when no group names the agent
+func (rb *Robots) groupsFor(userAgent string) []*robotsGroup {
+	token := productToken(userAgent)
+
+	var specific, wildcard []*robotsGroup
+	longest := 0
+	for _, group := range rb.groups {
+		matched := 0
+		for _, agent := range group.agents {
+			if agent == "*" {
+				wildcard = append(wildcard, group)
+				continue
+			}
+
+			if token != "" && strings.HasPrefix(token, agent) && len(agent) > matched {
+				matched = len(agent)
+			}
+		}
+
+		switch {
+		case matched == 0 || matched < longest:
+		case matched > longest:
+			longest = matched
+			specific = []*robotsGroup{group}
+		default:
+			specific = append(specific, group)
+		}
+	}
+
+	if len(specific) > 0 {
+		return specific
+	}
+
+	return wildcard
+}
+
+// productToken - get lower cased product token of the user agent
+// e.g. `Googlebot/2.1 (+http://www.google.com/bot.html)` becomes `googlebot`
+func productToken(userAgent string) string {
+	token := strings.Fields(userAgent)
+	if len(token) == 0 {
+		return ""
+	}
+
+	return strings.ToLower(strings.SplitN(token[0], "/", 2)[0])
+}
+
+// ParseRobots - parse the contents of robots.txt
+func ParseRobots(body []byte) *Robots {
+	robots := &Robots{}
+
+	var group *robotsGroup
+	// consecutive user-agent lines belong to the same group
+	collectingAgents := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Split(bufio.ScanLines)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		field := strings.ToLower(strings.TrimSpace(parts[0]))
+		value := strings.TrimSpace(parts[1])
+
+		switch field {
+		case "user-agent":
+			if !collectingAgents || group == nil {
+				group = &robotsGroup{}
+				robots.groups = append(robots.groups, group)
+			}
+			group.agents = append(group.agents, strings.ToLower(value))
+			collectingAgents = true
+		case "allow", "disallow":
+			collectingAgents = false
+			// an empty disallow rule means everything is allowed
+			if group == nil || value == "" {
+				continue
+			}
+			group.rules = append(group.rules, newRobotsRule(field == "allow", value))
+		case "crawl-delay":
+			collectingAgents = false
+			if group == nil {
+				continue
+			}
+			if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+				group.crawlDelay = time.Duration(seconds * float64(time.Second))
+			}
+		}
+	}
+
+	return robots
+}
+
+// newRobotsRule - compile the rule pattern supporting `*` and `$` wildcards
+func newRobotsRule(allow bool, pattern string) *robotsRule {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	if strings.HasSuffix(expr, `\$`) {
+		expr = strings.TrimSuffix(expr, `\$`) + "$"
+	}
+
+	return &robotsRule{
+		allow:   allow,
+		pattern: pattern,
+		regx:    regexp.MustCompile("^" + expr),
+	}
+}
+
+// RobotsCache - fetches and caches robots.txt files of destination hosts
+type RobotsCache struct {
+	// fetches the robots.txt through the multiplexer
+	fetch func(r *http.Request, robotsURL string) *FirstResponse
+	// time to keep fetched robots.txt files
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*robotsEntry
+}
+
+type robotsEntry struct {
+	robots    *Robots
+	err       error
+	expiresAt time.Time
+}
+
+// Get - get robots.txt that applies to the destination URL
+func (rc *RobotsCache) Get(r *http.Request, destinationURL string) (*Robots, error) {
+	u, err := url.Parse(destinationURL)
+	if err != nil {
+		return nil, err
+	}
+
+	robotsURL := u.Scheme + "://" + u.Host + "/robots.txt"
+
+	rc.mu.Lock()
+	entry, ok := rc.entries[robotsURL]
+	rc.mu.Unlock()
+
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.robots, entry.err
+	}
+
+	entry = rc.load(r, robotsURL)
+
+	rc.mu.Lock()
+	rc.entries[robotsURL] = entry
+	rc.mu.Unlock()
+
+	return entry.robots, entry.err
+}
+
+// load - fetch robots.txt and turn the outcome into a cache entry
+// following RFC 9309 a 4xx status means there are no restrictions
+// while any other failure means the host is unreachable
+func (rc *RobotsCache) load(r *http.Request, robotsURL string) *robotsEntry {
+	response := rc.fetch(r, robotsURL)
+
+	if !response.IsValid() {
+		if statusErr, ok := response.GetError().(*StatusError); ok &&
+			statusErr.StatusCode >= 400 && statusErr.StatusCode < 500 {
+			return &robotsEntry{robots: &Robots{}, expiresAt: time.Now().Add(rc.ttl)}
+		}
+
+		return &robotsEntry{
+			err:       fmt.Errorf("could not fetch %s: %v", robotsURL, response.GetError()),
+			expiresAt: time.Now().Add(robotsErrorTTL),
+		}
+	}
+
+	defer response.CloseBody()
+
+	body, err := io.ReadAll(io.LimitReader(response.GetBody(), maxRobotsSize))
+	if err != nil {
+		return &robotsEntry{
+			err:       fmt.Errorf("could not read %s: %v", robotsURL, err),
+			expiresAt: time.Now().Add(robotsErrorTTL),
+		}
+	}
+
+	return &robotsEntry{robots: ParseRobots(body), expiresAt: time.Now().Add(rc.ttl)}
+}
+
+// NewRobotsCache - creates new robots.txt cache
+func NewRobotsCache(fetch func(r *http.Request, robotsURL string) *FirstResponse) *RobotsCache {
+	return &RobotsCache{
+		fetch:   fetch,
+		ttl:     getRobotsTTL(),
+		entries: make(map[string]*robotsEntry),
+	}
+}
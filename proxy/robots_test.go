@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+const testRobots = `# comment
+User-agent: gpmbot
+User-agent: otherbot
+Disallow: /private
+Allow: /private/public
+Crawl-delay: 1.5
+
+User-agent: *
+Disallow: /
+Allow: /open$
+Allow: /*.html
+`
+
+func TestParseRobots(t *testing.T) {
+	robots := ParseRobots([]byte(testRobots))
+
+	cases := []struct {
+		agent   string
+		path    string
+		allowed bool
+	}{
+		{"gpmbot/1.0", "/", true},
+		{"GpmBot", "/private", false},
+		{"gpmbot", "/private/page", false},
+		{"gpmbot", "/private/public/page", true},
+		{"otherbot", "/private", false},
+		{"someone", "/", false},
+		{"someone", "/open", true},
+		{"someone", "/open/more", false},
+		{"someone", "/deep/page.html", true},
+	}
+
+	for _, c := range cases {
+		if robots.Allowed(c.agent, c.path) != c.allowed {
+			t.Errorf("Expected %s to be allowed=%v for %s", c.path, c.allowed, c.agent)
+		}
+	}
+
+	if robots.CrawlDelay("gpmbot") != 1500*time.Millisecond {
+		t.Errorf("Expected crawl delay of 1.5s, got %v", robots.CrawlDelay("gpmbot"))
+	}
+
+	if robots.CrawlDelay("someone") != 0 {
+		t.Errorf("Expected no crawl delay, got %v", robots.CrawlDelay("someone"))
+	}
+
+	// the longest user agent naming the product wins regardless of the order of the groups
+	robots = ParseRobots([]byte("User-agent: gpmbot\nDisallow: /\n\nUser-agent: gpmbot-news\nAllow: /\n"))
+	if !robots.Allowed("gpmbot-news/2.0", "/page") {
+		t.Errorf("Expected the most specific group to apply")
+	}
+	if robots.Allowed("gpmbot-images", "/page") {
+		t.Errorf("Expected the group of the shorter agent to apply")
+	}
+}
+
+func TestRobotsCheck(t *testing.T) {
+	os.Setenv("GPM_USER_AGENT", "gpmbot/1.0")
+	defer os.Setenv("GPM_USER_AGENT", "")
+
+	var robotsRequests int64
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			atomic.AddInt64(&robotsRequests, 1)
+			fmt.Fprint(w, testRobots)
+			return
+		}
+
+		fmt.Fprint(w, "ok")
+	}))
+	defer destination.Close()
+
+	list := NewList()
+	list.Filename = "../proxy.list.example"
+	list.Load()
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	server := NewServer(logger, list)
+	key, _ := ParseKey("polite", []string{"robots"})
+	server.keys.Add(key)
+	key, _ = ParseKey("rude", nil)
+	server.keys.Add(key)
+
+	r := chi.NewRouter()
+	r.Use(server.CheckAPIKey)
+	r.Use(server.ProxyGetRequest)
+	r.Get("/get", server.ProxyGetResponse)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	t.Run("disallowed url", func(t *testing.T) {
+		resp, _ := testRequest(t, ts, "GET", "/get?api_key=polite&url="+uriEncode(destination.URL+"/private"), nil)
+
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("Expected forbidden, got %s", resp.Status)
+		}
+
+		if resp.Header.Get(ErrorCodeHeader) != ErrorCodeRobotsDisallowed {
+			t.Fatalf("Expected error code %s, got %s", ErrorCodeRobotsDisallowed, resp.Header.Get(ErrorCodeHeader))
+		}
+	})
+
+	t.Run("allowed url", func(t *testing.T) {
+		resp, body := testRequest(t, ts, "GET", "/get?api_key=polite&url="+uriEncode(destination.URL+"/private/public"), nil)
+
+		if resp.StatusCode != http.StatusOK || body != "ok" {
+			t.Fatalf("Expected ok response, got %s %s", resp.Status, body)
+		}
+
+		if atomic.LoadInt64(&robotsRequests) != 1 {
+			t.Fatalf("Expected robots.txt to be fetched once, got %d", atomic.LoadInt64(&robotsRequests))
+		}
+	})
+
+	t.Run("concurrent misses share the fetch", func(t *testing.T) {
+		var fetches int64
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/robots.txt" {
+				atomic.AddInt64(&fetches, 1)
+				time.Sleep(100 * time.Millisecond)
+			}
+			fmt.Fprint(w, "ok")
+		}))
+		defer slow.Close()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				testRequest(t, ts, "GET", "/get?api_key=polite&url="+uriEncode(slow.URL+"/page"), nil)
+			}()
+		}
+		wg.Wait()
+
+		if n := atomic.LoadInt64(&fetches); n != 1 {
+			t.Fatalf("Expected robots.txt to be fetched once, got %d", n)
+		}
+	})
+
+	t.Run("robots not required", func(t *testing.T) {
+		resp, _ := testRequest(t, ts, "GET", "/get?api_key=rude&url="+uriEncode(destination.URL+"/private"), nil)
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected ok response, got %s", resp.Status)
+		}
+	})
+}
+
+func TestHostScheduler(t *testing.T) {
+	scheduler := NewHostScheduler()
+	delay := 100 * time.Millisecond
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := scheduler.Wait(context.Background(), "example.com", delay); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 2*delay {
+		t.Fatalf("Expected requests to be spaced out by %v, took %v", delay, elapsed)
+	}
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// HostScheduler - spaces out requests to the same host
+type HostScheduler struct {
+	mu sync.Mutex
+	// the earliest time the next request to the host may start
+	next map[string]time.Time
+}
+
+// Wait - blocks until a request to the host may be made
+// every call reserves its own slot so concurrent callers are spaced out by delay
+func (hs *HostScheduler) Wait(ctx context.Context, host string, delay time.Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+
+	hs.mu.Lock()
+	hs.prune(now)
+	slot := hs.next[host]
+	if slot.Before(now) {
+		slot = now
+	}
+	hs.next[host] = slot.Add(delay)
+	hs.mu.Unlock()
+
+	wait := slot.Sub(now)
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// prune - forget hosts that can be requested right away
+func (hs *HostScheduler) prune(now time.Time) {
+	for host, next := range hs.next {
+		if next.Before(now) {
+			delete(hs.next, host)
+		}
+	}
+}
+
+// NewHostScheduler - creates new per host scheduler
+func NewHostScheduler() *HostScheduler {
+	return &HostScheduler{next: make(map[string]time.Time)}
+}
@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"sync/atomic"
+	"time"
 )
 
 // Server struct handles all the proxy related actions from serving
@@ -25,6 +28,43 @@ type Server struct {
 	// API key for security
 	// should come from env
 	apiKey string
+
+	// additional API keys along with their options
+	keys *KeyList
+
+	// robots.txt of destinations for the keys that require it
+	robots *RobotsCache
+
+	// spaces out requests to the same host
+	scheduler *HostScheduler
+
+	// response cache, nil when caching is disabled
+	cache *ResponseCache
+
+	// identical requests currently being multiplexed
+	flights *FlightGroup
+
+	// requests processed asynchronously
+	jobs *JobQueue
+
+	// posts results to callback URLs
+	callbacks *CallbackSender
+
+	// CA intercepting CONNECT tunnels, nil when interception is disabled
+	mitm *CertificateAuthority
+	// cookie jars and pinned proxies of named sessions
+	sessions *SessionStore
+	// browser header profiles outgoing requests are made with
+	profiles *ProfileLibrary
+	// transports shared by the attempts of all requests
+	transports *TransportPool
+	// resolves the hosts outgoing connections are made to
+	resolver *Resolver
+	// countries and regions requests to the domains are made from
+	geo *GeoRules
+
+	// traffic per api key and per proxy
+	usage *Usage
 }
 
 type contextKey string
@@ -36,6 +76,7 @@ func (c contextKey) String() string {
 var (
 	responseKey = contextKey("response")
 	sessionKey  = contextKey("session")
+	apiKeyKey   = contextKey("api_key")
 )
 
 // ProxyGetRequest is a middleware that will perform multiplexing
@@ -43,9 +84,14 @@ var (
 func (s *Server) ProxyGetRequest(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
-			s.logger.Printf("\nMultiplexer GET middleware exiting session [%d]...", s.session)
+			s.logger.Printf("\nMultiplexer GET middleware exiting session [%d]...", atomic.LoadInt64(&s.session))
 
 			if rec := recover(); rec != nil {
+				// the connection must be aborted so the client sees a truncated body
+				if rec == http.ErrAbortHandler {
+					panic(rec)
+				}
+
 				msg := fmt.Sprintf("Internal server error occurred. Recovered from %v", rec)
 				http.Error(w, msg, http.StatusInternalServerError)
 			}
@@ -57,40 +103,241 @@ func (s *Server) ProxyGetRequest(next http.Handler) http.Handler {
 			return
 		}
 
-		// create new context
-		requestContext, err := NewMultiplexer(
-			r, http.MethodGet,
-			destinationURL,
-			s.logger,
-			s.proxyList,
-			atomic.AddInt64(&s.session, 1),
-		)
-
+		options, err := ParseRequestOptions(r)
+		if err == nil {
+			err = s.profiles.ValidateProfile(options.Profile)
+		}
 		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		spec := &RequestSpec{Method: http.MethodGet, URL: destinationURL, Options: *options}
+
+		if spec.Options.CallbackURL != "" {
+			writeJSON(w, http.StatusAccepted, s.deliverLater(r, spec))
+			return
+		}
+
+		if err := s.checkRobots(r, spec.URL); err != nil {
 			s.logger.Println(err)
-			http.Error(w, err.Error(), http.StatusBadGateway)
+			writeCodedError(w, err)
 			return
 		}
 
-		// process the request and get the first good response
-		// if one actually arrives
-		go requestContext.processRequest()
+		response, cacheStatus := s.fetch(r, spec)
+		if spec.Options.Rewrite {
+			response = s.rewriteResponse(r, spec, response)
+		}
 
-		response := <-requestContext.FirstResponse
-		requestContext.SafeClose()
+		if cacheStatus != "" {
+			w.Header().Set(CacheStatusHeader, cacheStatus)
+		}
 
-		s.logger.Printf("Done. Response for session %d received.", s.session)
+		if spec.Options.Diagnostics && response.diagnostics != nil {
+			w.Header().Set(DiagnosticsHeader, response.diagnostics.Header())
+		}
+
+		s.logger.Printf("Done. Response for session %d received.", atomic.LoadInt64(&s.session))
 
 		ctx := context.WithValue(r.Context(), responseKey, response)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// multiplex - runs a multiplexer for the request spec
+// and waits for the first good response if one actually arrives
+// header is sent along with the headers of the spec
+func (s *Server) multiplex(r *http.Request, spec *RequestSpec, header http.Header) *FirstResponse {
+	// create new context
+	requestContext, err := NewMultiplexer(
+		r, spec.Method,
+		spec.URL,
+		s.logger,
+		s.proxyList,
+		atomic.AddInt64(&s.session, 1),
+	)
+
+	if err != nil {
+		s.logger.Println(err)
+		return NewInvalidFirstResponse(err, false, 0)
+	}
+
+	requestContext.header = spec.outgoingHeader(header)
+	requestContext.body = spec.Body
+	requestContext.acceptStatus = spec.acceptStatus
+	requestContext.noRedirects = spec.noRedirects
+	requestContext.redirect = spec.Options.Redirect
+	requestContext.maxRedirects = spec.Options.MaxRedirects
+	requestContext.rotateRedirects = spec.Options.RedirectProxy == RedirectProxyRotate
+	requestContext.exclude = spec.exclude
+	requestContext.usage = s.usage
+	requestContext.decode = spec.Options.Decode
+	requestContext.extractors = spec.Options.Extract
+
+	key := requestKey(r)
+	requestContext.key = key.Value
+	requestContext.limits = spec.Options.limits().Merge(key.Limits)
+	requestContext.profiles = s.profiles
+	requestContext.profile = spec.Options.Profile
+	requestContext.tlsProfile = spec.Options.TLS
+	requestContext.protocol = spec.Options.Protocol
+	requestContext.transports = s.transports
+	requestContext.resolver = s.resolver
+
+	// geo targeted requests fail right away when no proxy can serve them
+	if requestContext.geo = s.geo.Target(spec.URL, spec.Options); requestContext.geo != nil && !requestContext.geo.available(s.proxyList) {
+		return NewInvalidFirstResponse(requestContext.geo.unavailable(), false, 0)
+	}
+
+	var session *Session
+	var pinned string
+	if spec.Options.Session != "" {
+		session = s.sessions.Open(key.Value, spec.Options.Session)
+		requestContext.jar = session.jar
+		if requestContext.profile == "" {
+			requestContext.profile = session.Profile()
+		}
+
+		// the pinned proxy may not serve the geo target of the request, the session races for a proxy that does
+		if pinned = session.Proxy(); pinned != "" && requestContext.geo != nil &&
+			!requestContext.geo.matches(append([]string{session.Tag()}, s.proxyList.Tags(pinned)...)) {
+			s.logger.Printf("Pinned proxy of session %s does not serve %s, racing again", session.Name, requestContext.geo)
+			session.Unpin()
+			pinned = ""
+		}
+
+		// a pinned session keeps its proxy instead of racing
+		if pinned != "" {
+			requestContext.pinned = pinned
+			requestContext.concurrentTries = 1
+		}
+	}
+
+	if spec.Options.Timeout > 0 {
+		requestContext.SetTimeout(time.Duration(spec.Options.Timeout) * time.Second)
+	}
+
+	if spec.Options.Stream {
+		requestContext.firstBytes = spec.Options.FirstBytes
+		if requestContext.firstBytes == 0 {
+			requestContext.firstBytes = 1
+		}
+
+		requestContext.idleTimeout = getStreamIdleTimeout()
+		if spec.Options.IdleTimeout > 0 {
+			requestContext.idleTimeout = time.Duration(spec.Options.IdleTimeout) * time.Second
+		}
+	}
+
+	go requestContext.processRequest()
+
+	response := <-requestContext.FirstResponse
+	requestContext.SafeClose()
+
+	if session != nil {
+		if response.IsValid() {
+			var tag string
+			if response.diagnostics != nil {
+				tag = response.diagnostics.Tag
+			}
+			session.Pin(response.proxy, response.profile, tag)
+		} else if pinned != "" && r.Context().Err() == nil {
+			s.logger.Printf("Pinned proxy of session %s failed, racing again: %v", session.Name, response.GetError())
+			session.Unpin()
+			return s.multiplex(r, spec, header)
+		}
+	}
+
+	response.streamed = spec.Options.Stream
+
+	return response
+}
+
+// fetch - get the response from the cache if it is enabled
+// or multiplex the request otherwise, values are extracted from the body if requested
+// returns the response along with the cache status, empty when cache is disabled
+func (s *Server) fetch(r *http.Request, spec *RequestSpec) (*FirstResponse, string) {
+	limits := spec.Options.limits().Merge(requestKey(r).Limits)
+
+	multiplex := func(header http.Header) *FirstResponse {
+		// requests of a session depend on its cookies, streamed bodies are not buffered
+		if !spec.Options.Coalesce || spec.Options.Session != "" || spec.Options.Stream {
+			return s.multiplex(r, spec, header)
+		}
+
+		// requests share a session only when they are held to the same limits
+		key := flightKey(spec.Method, spec.cacheURL(), spec.Body, spec.outgoingHeader(header)) +
+			fmt.Sprintf("\nlimits: %d %s", limits.MaxBodySize, strings.Join(limits.ContentTypes, ","))
+		response := s.flights.Do(r.Context(), key, func(ctx context.Context) *FirstResponse {
+			return s.multiplex(r.WithContext(ctx), spec, header)
+		})
+
+		return limitResponse(response, limits, spec.URL)
+	}
+
+	var response *FirstResponse
+	var cacheStatus string
+
+	if s.cache == nil || spec.Options.Session != "" {
+		response = multiplex(nil)
+	} else {
+		response, cacheStatus = s.cache.Fetch(r, spec, multiplex)
+		// responses of the cache never went through the race of the request
+		if cacheStatus != CacheMiss {
+			response = limitResponse(response, limits, spec.URL)
+		}
+	}
+
+	if len(spec.Options.Extract) > 0 {
+		response = extractResponse(response, spec.Options.Extract, spec.URL)
+	}
+
+	return response, cacheStatus
+}
+
+// checkRobots - checks the destination allows the request if the api key honours robots.txt
+// and waits for the crawl delay if any
+func (s *Server) checkRobots(r *http.Request, destinationURL string) *CodedError {
+	if !requestKey(r).Robots {
+		return nil
+	}
+
+	robots, err := s.robots.Get(r, destinationURL)
+	if err != nil {
+		return &CodedError{Code: ErrorCodeRobotsUnreachable, Status: http.StatusBadGateway, Err: err}
+	}
+
+	u, err := url.Parse(destinationURL)
+	if err != nil {
+		return &CodedError{Status: http.StatusBadRequest, Err: err}
+	}
+
+	userAgent := getUserAgent()
+	if userAgent == "" {
+		userAgent = defaultUserAgent
+	}
+
+	if !robots.Allowed(userAgent, u.RequestURI()) {
+		return &CodedError{
+			Code:   ErrorCodeRobotsDisallowed,
+			Status: http.StatusForbidden,
+			Err:    fmt.Errorf("Access to %s is disallowed by robots.txt", destinationURL),
+		}
+	}
+
+	if err := s.scheduler.Wait(r.Context(), u.Host, robots.CrawlDelay(userAgent)); err != nil {
+		return &CodedError{Status: http.StatusGatewayTimeout, Err: err}
+	}
+
+	return nil
+}
+
 // CheckAPIKey is a middleware that checks if apiKey is provided and
 // that it is valid``
 func (s *Server) CheckAPIKey(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if s.apiKey != "" {
+		if s.keysRequired() {
 			apiKey, err := ExtractQueryParam(r, "api_key")
 			if err != nil {
 				msg := fmt.Sprint("API key is missing")
@@ -99,22 +346,56 @@ func (s *Server) CheckAPIKey(next http.Handler) http.Handler {
 				return
 			}
 
-			if s.apiKey != apiKey {
+			key := s.lookupKey(apiKey)
+			if key == nil {
 				msg := fmt.Sprint("API key is invalid")
 				s.logger.Println(msg)
 				http.Error(w, msg, http.StatusUnauthorized)
 				return
 			}
+
+			r = r.WithContext(context.WithValue(r.Context(), apiKeyKey, key))
 		}
 
 		next.ServeHTTP(w, r)
 	})
 }
 
+// requestKey - api key of the request, an empty key when keys are not required
+func requestKey(r *http.Request) *Key {
+	if key, ok := r.Context().Value(apiKeyKey).(*Key); ok && key != nil {
+		return key
+	}
+
+	return &Key{}
+}
+
+// keysRequired - checks if clients must provide an api key
+func (s *Server) keysRequired() bool {
+	return s.apiKey != "" || s.keys.Count() > 0
+}
+
+// lookupKey - find the api key, returns nil if the key is invalid
+func (s *Server) lookupKey(apiKey string) *Key {
+	if key := s.keys.Get(apiKey); key != nil {
+		return key
+	}
+
+	if s.apiKey != "" && s.apiKey == apiKey {
+		return &Key{Value: apiKey}
+	}
+
+	return nil
+}
+
 // ProxyGetResponse - handle HTTP GET request
 func (s *Server) ProxyGetResponse(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		if rec := recover(); rec != nil {
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+
 			msg := fmt.Sprintf("Internal error occurred. Recovered from %v", rec)
 			http.Error(w, msg, http.StatusBadGateway)
 		}
@@ -136,34 +417,100 @@ func (s *Server) proxyResponse(w http.ResponseWriter, response *FirstResponse) {
 	// check if response is valid
 	if !response.IsValid() {
 		s.logger.Println(response.GetError())
+		if code := errorCode(response.GetError()); code != "" {
+			w.Header().Set(ErrorCodeHeader, code)
+		}
 		http.Error(w, response.GetError().Error(), http.StatusBadGateway)
 		return
 	}
 
 	// copy all the headers
 	copyHeaders(w.Header(), response.GetHeader())
+	if finalURL := response.GetFinalURL(); finalURL != "" {
+		w.Header().Set(FinalURLHeader, finalURL)
+	}
 	// copy status code
 	w.WriteHeader(response.GetStatusCode())
 
 	// copy body
-	bytesCopied, _ := io.Copy(w, response.GetBody())
+	bytesCopied, err := s.copyBody(w, response)
 	// close body
-	if err := response.CloseBody(); err != nil {
-		s.logger.Printf("Can't close response body %v", err)
+	if closeErr := response.CloseBody(); closeErr != nil {
+		s.logger.Printf("Can't close response body %v", closeErr)
+	}
+
+	if err != nil {
+		s.logger.Printf("Copying body to the client failed after %v bytes %v", bytesCopied, err)
+		// it is too late to fail over, the client must not mistake
+		// a truncated body for a complete one
+		if _, tooLarge := err.(*BodyTooLargeError); tooLarge || response.streamed {
+			panic(http.ErrAbortHandler)
+		}
+		return
 	}
 
 	s.logger.Printf("Copied %v bytes to the client. All done.", bytesCopied)
 }
 
+// copyBody - copy the response body to the client, streamed bodies are flushed as they arrive
+func (s *Server) copyBody(w http.ResponseWriter, response *FirstResponse) (int64, error) {
+	if response.streamed {
+		return streamBody(w, response.GetBody())
+	}
+
+	return io.Copy(w, response.GetBody())
+}
+
 // NewServer - creates a new proxy server
 func NewServer(logger Logger, list *List) *Server {
 	apiKey := os.Getenv("GPM_SERVER_API_KEY")
 
+	keys := NewKeyList()
+	keys.Load()
+
+	profiles := NewProfileLibrary()
+	profiles.Load()
+
+	resolver := NewResolver()
+	resolver.Load()
+
+	geo := NewGeoRules()
+	geo.Load()
+
 	server := Server{
 		logger:    logger,
 		apiKey:    apiKey,
+		keys:      keys,
 		proxyList: list,
+		scheduler: NewHostScheduler(),
+		cache:     NewResponseCache(),
+		flights:   NewFlightGroup(getCoalesceMaxBody()),
+		callbacks: NewCallbackSender(),
+		usage:     NewUsage(),
+		sessions:  NewSessionStore(getSessionTTL(), getMaxSessions(), getSessionMaxCookies()),
+		profiles:  profiles,
+
+		transports: NewTransportPool(getMaxTransports()),
+		resolver:   resolver,
+		geo:        geo,
 	}
 
+	// concurrent misses of the same host share a single fetch of its robots.txt
+	server.robots = NewRobotsCache(func(r *http.Request, robotsURL string) *FirstResponse {
+		return server.flights.Do(r.Context(), flightKey(http.MethodGet, robotsURL, "", nil), func(ctx context.Context) *FirstResponse {
+			return server.multiplex(r.WithContext(ctx), &RequestSpec{Method: http.MethodGet, URL: robotsURL}, nil)
+		})
+	})
+
+	if mitmEnabled() {
+		ca, err := LoadCA(getCACertFile(), getCAKeyFile())
+		if err != nil {
+			panic(err)
+		}
+		server.mitm = ca
+	}
+
+	server.jobs = NewJobQueue(server.runJob, server.notifyJob, getJobDir(), getJobTTL(), getJobWorkers(), getJobQueueDepth())
+
 	return &server
 }
@@ -0,0 +1,316 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+var sessionNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// ValidateSessionName - session names are short and URL safe
+func ValidateSessionName(name string) error {
+	if !sessionNamePattern.MatchString(name) {
+		return fmt.Errorf("[session] must be 1 to 64 letters, digits, dots, dashes or underscores")
+	}
+
+	return nil
+}
+
+// Session - cookies and the proxy shared by the requests of a session
+type Session struct {
+	Name string
+
+	mu      sync.Mutex
+	jar     *CookieJar
+	proxy   string
+	profile string
+	// tag the pinned proxy was picked by for a geo targeted request
+	tag        string
+	createdAt  time.Time
+	lastUsedAt time.Time
+}
+
+// Proxy - proxy the session is pinned to, empty if none
+func (s *Session) Proxy() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.proxy
+}
+
+// Tag - tag the pinned proxy was picked by, empty if none
+func (s *Session) Tag() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tag
+}
+
+// Profile - header profile the session is pinned to, empty if none
+func (s *Session) Profile() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.profile
+}
+
+// Pin - pin the session to the proxy and the header profile unless it is pinned already
+// the tag the proxy was picked by is kept along with it
+func (s *Session) Pin(proxy, profile, tag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.proxy == "" {
+		s.proxy, s.tag = proxy, tag
+	}
+	if s.profile == "" {
+		s.profile = profile
+	}
+}
+
+// Unpin - the next request of the session races proxies again
+// the header profile is kept, so the session still looks like the same browser
+func (s *Session) Unpin() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.proxy, s.tag = "", ""
+}
+
+func (s *Session) touch(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastUsedAt = now
+}
+
+func (s *Session) expired(now time.Time, ttl time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return now.Sub(s.lastUsedAt) > ttl
+}
+
+// SessionInfo - session as it is reported to the client
+type SessionInfo struct {
+	Name       string          `json:"name"`
+	Proxy      string          `json:"proxy,omitempty"`
+	Profile    string          `json:"profile,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	LastUsedAt time.Time       `json:"last_used_at"`
+	ExpiresAt  time.Time       `json:"expires_at"`
+	Cookies    []SessionCookie `json:"cookies"`
+}
+
+// SessionStore - sessions of every api key, idle sessions expire
+// and the least recently used ones are dropped beyond the limit
+type SessionStore struct {
+	mu          sync.Mutex
+	sessions    map[string]*Session
+	ttl         time.Duration
+	maxSessions int
+	maxCookies  int
+}
+
+// Open - get the session of the key creating it if necessary
+func (ss *SessionStore) Open(key, name string) *Session {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	now := time.Now()
+	ss.purge(now)
+
+	id := sessionID(key, name)
+	if session, ok := ss.sessions[id]; ok {
+		session.touch(now)
+		return session
+	}
+
+	if ss.maxSessions > 0 && len(ss.sessions) >= ss.maxSessions {
+		ss.evict()
+	}
+
+	session := &Session{
+		Name:       name,
+		jar:        NewCookieJar(ss.maxCookies),
+		createdAt:  now,
+		lastUsedAt: now,
+	}
+	ss.sessions[id] = session
+
+	return session
+}
+
+// Get - get the session of the key if it exists
+func (ss *SessionStore) Get(key, name string) (*Session, bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.purge(time.Now())
+	session, ok := ss.sessions[sessionID(key, name)]
+
+	return session, ok
+}
+
+// Delete - forget the session of the key
+func (ss *SessionStore) Delete(key, name string) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	id := sessionID(key, name)
+	_, ok := ss.sessions[id]
+	delete(ss.sessions, id)
+
+	return ok
+}
+
+// Info - the session along with its cookies, proxy credentials are left out
+func (ss *SessionStore) Info(session *Session) SessionInfo {
+	cookies := session.jar.List()
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	info := SessionInfo{
+		Name:       session.Name,
+		CreatedAt:  session.createdAt,
+		LastUsedAt: session.lastUsedAt,
+		ExpiresAt:  session.lastUsedAt.Add(ss.ttl),
+		Profile:    session.profile,
+		Cookies:    cookies,
+	}
+	if session.proxy != "" {
+		info.Proxy = redactProxy(session.proxy)
+	}
+
+	return info
+}
+
+// purge - forget the sessions idle for longer than TTL
+func (ss *SessionStore) purge(now time.Time) {
+	for id, session := range ss.sessions {
+		if session.expired(now, ss.ttl) {
+			delete(ss.sessions, id)
+		}
+	}
+}
+
+// evict - forget the least recently used session
+func (ss *SessionStore) evict() {
+	var oldestID string
+	var oldest time.Time
+
+	for id, session := range ss.sessions {
+		session.mu.Lock()
+		lastUsedAt := session.lastUsedAt
+		session.mu.Unlock()
+
+		if oldestID == "" || lastUsedAt.Before(oldest) {
+			oldestID, oldest = id, lastUsedAt
+		}
+	}
+
+	delete(ss.sessions, oldestID)
+}
+
+// sessions of different keys never mix
+func sessionID(key, name string) string {
+	return key + "/" + name
+}
+
+// NewSessionStore - creates new session store
+func NewSessionStore(ttl time.Duration, maxSessions, maxCookies int) *SessionStore {
+	return &SessionStore{
+		sessions:    make(map[string]*Session),
+		ttl:         ttl,
+		maxSessions: maxSessions,
+		maxCookies:  maxCookies,
+	}
+}
+
+// attemptJar - cookies of a single attempt, they reach the session only if the attempt wins
+// so losing responses can't overwrite the cookies of the winner
+type attemptJar struct {
+	*CookieJar
+
+	mu   sync.Mutex
+	sets []cookieSet
+}
+
+type cookieSet struct {
+	u       *url.URL
+	cookies []*http.Cookie
+}
+
+func (aj *attemptJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	aj.mu.Lock()
+	aj.sets = append(aj.sets, cookieSet{u, cookies})
+	aj.mu.Unlock()
+
+	aj.CookieJar.SetCookies(u, cookies)
+}
+
+// commit - replay the cookies set during the attempt into the session jar
+func (aj *attemptJar) commit(jar *CookieJar) {
+	aj.mu.Lock()
+	defer aj.mu.Unlock()
+
+	for _, set := range aj.sets {
+		jar.SetCookies(set.u, set.cookies)
+	}
+}
+
+func newAttemptJar(jar *CookieJar) *attemptJar {
+	return &attemptJar{CookieJar: jar.clone()}
+}
+
+// sessionFromRequest - session named in the URL for the key of the request
+func (s *Server) sessionFromRequest(w http.ResponseWriter, r *http.Request) (*Session, bool) {
+	session, ok := s.sessions.Get(requestKey(r).Value, chi.URLParam(r, "name"))
+	if !ok {
+		http.Error(w, "Session not found", http.StatusNotFound)
+	}
+
+	return session, ok
+}
+
+// GetSession - handle GET /sessions/{name} with the session and its cookies
+func (s *Server) GetSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.sessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.sessions.Info(session))
+}
+
+// ExportSessionCookies - handle GET /sessions/{name}/cookies
+// cookies are exported as JSON or in the cookies.txt format with format=netscape
+func (s *Server) ExportSessionCookies(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.sessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		writeJSON(w, http.StatusOK, session.jar.List())
+	case "netscape":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := session.jar.WriteNetscape(w); err != nil {
+			s.logger.Printf("Could not export cookies of session %s %v", session.Name, err)
+		}
+	default:
+		http.Error(w, "[format] must be either json or netscape", http.StatusBadRequest)
+	}
+}
+
+// DeleteSession - handle DELETE /sessions/{name}
+func (s *Server) DeleteSession(w http.ResponseWriter, r *http.Request) {
+	if !s.sessions.Delete(requestKey(r).Value, chi.URLParam(r, "name")) {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
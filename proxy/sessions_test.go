@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+)
+
+func TestCookieJar(t *testing.T) {
+	jar := NewCookieJar(3)
+	u, _ := url.Parse("https://www.example.com/account/login")
+
+	jar.SetCookies(u, []*http.Cookie{
+		{Name: "host", Value: "1"},
+		{Name: "domain", Value: "2", Domain: ".example.com", Path: "/"},
+		{Name: "secure", Value: "3", Path: "/", Secure: true},
+		{Name: "suffix", Value: "4", Domain: "com"},
+		{Name: "other", Value: "5", Domain: "other.com"},
+	})
+
+	cookieNames := func(rawURL string) string {
+		u, _ := url.Parse(rawURL)
+		names := []string{}
+		for _, cookie := range jar.Cookies(u) {
+			names = append(names, cookie.Name)
+		}
+		// cookies with paths of the same length come in no particular order
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+
+	if names := cookieNames("https://www.example.com/account/settings"); names != "domain,host,secure" {
+		t.Fatalf("Unexpected cookies %s", names)
+	}
+
+	if names := cookieNames("http://api.example.com/"); names != "domain" {
+		t.Fatalf("Unexpected cookies for the subdomain %s", names)
+	}
+
+	jar.SetCookies(u, []*http.Cookie{{Name: "domain", Domain: "example.com", Path: "/", MaxAge: -1}})
+	if names := cookieNames("https://www.example.com/"); names != "secure" {
+		t.Fatalf("Expected the deleted cookie to be gone, got %s", names)
+	}
+
+	limited := NewCookieJar(1)
+	limited.SetCookies(u, []*http.Cookie{{Name: "old", Value: "1"}})
+	limited.SetCookies(u, []*http.Cookie{{Name: "new", Value: "2"}})
+	if cookies := limited.List(); len(cookies) != 1 || cookies[0].Name != "new" {
+		t.Fatalf("Expected the oldest cookie to be dropped, got %v", cookies)
+	}
+
+	var export strings.Builder
+	if err := jar.WriteNetscape(&export); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(export.String(), "www.example.com\tFALSE\t/\tTRUE\t0\tsecure\t3\n") {
+		t.Fatalf("Unexpected export\n%s", export.String())
+	}
+
+	// the domain of the host itself reaches its subdomains too
+	api, _ := url.Parse("https://api.example.com/")
+	jar.SetCookies(api, []*http.Cookie{{Name: "api", Value: "6", Domain: "api.example.com", Path: "/"}})
+	if names := cookieNames("https://v2.api.example.com/"); names != "api" {
+		t.Fatalf("Expected the cookie of the host domain to reach subdomains, got %s", names)
+	}
+
+	export.Reset()
+	if err := jar.WriteNetscape(&export); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(export.String(), ".api.example.com\tTRUE\t/\tFALSE\t0\tapi\t6\n") {
+		t.Fatalf("Expected the cookie to be exported domain-wide\n%s", export.String())
+	}
+}
+
+func TestSessions(t *testing.T) {
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: "secret", Path: "/"})
+			http.Redirect(w, r, "/account", http.StatusFound)
+		default:
+			cookie, err := r.Cookie("sid")
+			if err != nil {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, "hello "+cookie.Value)
+		}
+	}))
+	defer destination.Close()
+
+	list := NewList()
+	list.Filename = "../proxy.list.example"
+	list.Load()
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	server := NewServer(logger, list)
+
+	r := chi.NewRouter()
+	r.With(server.ProxyGetRequest).Get("/get", server.ProxyGetResponse)
+	r.Get("/sessions/{name}", server.GetSession)
+	r.Get("/sessions/{name}/cookies", server.ExportSessionCookies)
+	r.Delete("/sessions/{name}", server.DeleteSession)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	t.Run("cookies are kept across requests", func(t *testing.T) {
+		_, body := testRequest(t, ts, "GET", "/get?session=abc&url="+uriEncode(destination.URL+"/login"), nil)
+		if body != "hello secret" {
+			t.Fatalf("Unexpected body %s", body)
+		}
+
+		_, body = testRequest(t, ts, "GET", "/get?session=abc&url="+uriEncode(destination.URL+"/account"), nil)
+		if body != "hello secret" {
+			t.Fatalf("Expected the cookie of the session to be sent, got %s", body)
+		}
+
+		resp, _ := testRequest(t, ts, "GET", "/get?session=other&url="+uriEncode(destination.URL+"/account"), nil)
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Fatalf("Expected other sessions to have no cookies, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("inspect and export", func(t *testing.T) {
+		_, body := testRequest(t, ts, "GET", "/sessions/abc", nil)
+
+		var info SessionInfo
+		if err := json.Unmarshal([]byte(body), &info); err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Proxy != directProxy || len(info.Cookies) != 1 || info.Cookies[0].Name != "sid" || info.Cookies[0].Value != "secret" {
+			t.Fatalf("Unexpected session %s", body)
+		}
+
+		_, body = testRequest(t, ts, "GET", "/sessions/abc/cookies?format=netscape", nil)
+		if !strings.HasSuffix(body, "\tsid\tsecret\n") {
+			t.Fatalf("Unexpected export %s", body)
+		}
+	})
+
+	t.Run("failing pinned proxy falls back", func(t *testing.T) {
+		session := server.sessions.Open("", "pinned")
+		session.Pin("http://127.0.0.1:8087", "", "")
+
+		_, body := testRequest(t, ts, "GET", "/get?session=pinned&url="+uriEncode(destination.URL+"/login"), nil)
+		if body != "hello secret" {
+			t.Fatalf("Unexpected body %s", body)
+		}
+
+		if session.Proxy() != directProxy {
+			t.Fatalf("Expected the session to be pinned to the direct request, got %s", session.Proxy())
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		resp, _ := testRequest(t, ts, "DELETE", "/sessions/abc", nil)
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("Expected 204, got %d", resp.StatusCode)
+		}
+
+		resp, _ = testRequest(t, ts, "GET", "/sessions/abc", nil)
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("Expected 404, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("invalid name", func(t *testing.T) {
+		resp, _ := testRequest(t, ts, "GET", "/get?session="+uriEncode("a/b")+"&url="+uriEncode(destination.URL), nil)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400, got %d", resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// RequestSpec - description of a request that should be multiplexed
+type RequestSpec struct {
+	URL     string            `json:"url"`
+	Method  string            `json:"method"`
+	Header  map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+	Options RequestOptions    `json:"options"`
+
+	// decides which statuses win the race instead of the default 2**
+	acceptStatus func(statusCode int) bool
+	// redirects are returned instead of being followed
+	noRedirects bool
+	// proxies that must not be used
+	exclude map[string]bool
+}
+
+// Validate - validate the spec and normalize its URL and method
+func (spec *RequestSpec) Validate() error {
+	destinationURL, err := normalizeURL(spec.URL, spec.Options.TLS)
+	if err != nil {
+		return err
+	}
+
+	spec.URL = destinationURL
+
+	if err := spec.Options.validate(); err != nil {
+		return err
+	}
+
+	if spec.Options.CallbackURL != "" {
+		if err := ValidateCallbackURL(spec.Options.CallbackURL); err != nil {
+			return err
+		}
+	}
+
+	spec.Method = strings.ToUpper(spec.Method)
+	if spec.Method == "" {
+		spec.Method = http.MethodGet
+	}
+	if !httpguts.ValidHeaderFieldName(spec.Method) {
+		return fmt.Errorf("[method] %q is not a valid HTTP method", spec.Method)
+	}
+
+	return nil
+}
+
+// cacheURL - the URL responses to the spec are cached and shared under
+// options changing the response are part of it
+func (spec *RequestSpec) cacheURL() string {
+	destinationURL := spec.URL
+	if spec.Options.Decode {
+		destinationURL = "decoded " + destinationURL
+	}
+
+	if spec.Options.Rewrite {
+		destinationURL = "rewritten " + destinationURL
+	}
+
+	if spec.Options.Redirect != "" && spec.Options.Redirect != RedirectFollow {
+		destinationURL = "redirect=" + spec.Options.Redirect + " " + destinationURL
+	}
+
+	// headers, fingerprints, protocols and exit countries may change what the destination answers,
+	// geo targets of the domain rules follow from the URL itself
+	for _, option := range []struct{ name, value string }{
+		{"profile", spec.Options.Profile},
+		{"tls", spec.Options.TLS},
+		{"protocol", spec.Options.Protocol},
+		{"country", strings.ToLower(spec.Options.Country)},
+		{"region", strings.ToLower(spec.Options.Region)},
+		{"geo_fallback", spec.Options.GeoFallback},
+	} {
+		if option.value != "" {
+			destinationURL = option.name + "=" + option.value + " " + destinationURL
+		}
+	}
+
+	return destinationURL
+}
+
+// outgoingHeader - headers of the spec combined with the extra ones
+func (spec *RequestSpec) outgoingHeader(extra http.Header) http.Header {
+	header := make(http.Header, len(spec.Header)+len(extra))
+	for key, value := range spec.Header {
+		header.Set(key, value)
+	}
+
+	if spec.Options.Decode {
+		header.Set("Accept-Encoding", acceptedEncodings)
+	}
+
+	for key, values := range extra {
+		header[key] = values
+	}
+
+	return header
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// streamChunkSize - size of chunks streamed to the client
+const streamChunkSize = 32 << 10
+
+// StallError - the response body did not send anything within the idle timeout
+type StallError struct {
+	URL     string
+	Timeout time.Duration
+}
+
+func (e *StallError) Error() string {
+	return fmt.Sprintf("response from %s stalled for %.3f seconds", e.URL, e.Timeout.Seconds())
+}
+
+// idleTimeoutReader - fails a read that receives nothing within the timeout
+// the stalled read is interrupted by cancelling the context of the request
+type idleTimeoutReader struct {
+	body    io.ReadCloser
+	url     string
+	timeout time.Duration
+	timer   *time.Timer
+	expired int32
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	r.timer.Reset(r.timeout)
+	n, err := r.body.Read(p)
+	r.timer.Stop()
+
+	if err != nil && err != io.EOF && atomic.LoadInt32(&r.expired) == 1 {
+		return n, &StallError{URL: r.url, Timeout: r.timeout}
+	}
+
+	return n, err
+}
+
+func (r *idleTimeoutReader) Close() error {
+	r.timer.Stop()
+	return r.body.Close()
+}
+
+func newIdleTimeoutReader(body io.ReadCloser, url string, timeout time.Duration, cancel context.CancelFunc) *idleTimeoutReader {
+	r := &idleTimeoutReader{body: body, url: url, timeout: timeout}
+	r.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&r.expired, 1)
+		cancel()
+	})
+	r.timer.Stop()
+
+	return r
+}
+
+// attemptBody - body of a response that owns the context of its request
+// the request is cancelled once the body is closed
+type attemptBody struct {
+	io.Reader
+	body   io.Closer
+	cancel context.CancelFunc
+}
+
+func (b *attemptBody) Close() error {
+	err := b.body.Close()
+	b.cancel()
+	return err
+}
+
+// prefetch - read the first bytes of the body so the response can only win
+// once the body is actually flowing, a stalled body fails the attempt instead
+func prefetch(response *http.Response, firstBytes int, idleTimeout time.Duration, cancel context.CancelFunc) error {
+	var body io.ReadCloser = response.Body
+	if idleTimeout > 0 {
+		body = newIdleTimeoutReader(body, response.Request.URL.String(), idleTimeout, cancel)
+	}
+
+	prefix := make([]byte, firstBytes)
+	n, err := io.ReadFull(body, prefix)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		body.Close()
+		return err
+	}
+
+	response.Body = &attemptBody{
+		Reader: io.MultiReader(bytes.NewReader(prefix[:n]), body),
+		body:   body,
+		cancel: cancel,
+	}
+
+	return nil
+}
+
+// streamBody - copy the body flushing every chunk so the client
+// receives it at the pace of the destination
+func streamBody(w http.ResponseWriter, body io.Reader) (int64, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return io.Copy(w, body)
+	}
+
+	var written int64
+	buf := make([]byte, streamChunkSize)
+
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return written, werr
+			}
+			written += int64(n)
+			flusher.Flush()
+		}
+
+		if err == io.EOF {
+			return written, nil
+		}
+
+		if err != nil {
+			return written, err
+		}
+	}
+}
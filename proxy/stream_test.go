@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+func TestStreamedResponses(t *testing.T) {
+	release := make(chan struct{})
+
+	// stall - send headers and optionally a part of the body then send nothing
+	stall := func(w http.ResponseWriter, r *http.Request, partial string) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, partial)
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}
+
+	// the direct request reaches destination, the proxied ones are answered by the fake proxy
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/partial":
+			stall(w, r, "partial")
+		default:
+			stall(w, r, "")
+		}
+	}))
+	defer destination.Close()
+
+	fakeProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/flowing":
+			fmt.Fprint(w, "from proxy")
+		case "/partial":
+			stall(w, r, "partial")
+		default:
+			stall(w, r, "")
+		}
+	}))
+	defer fakeProxy.Close()
+	defer close(release)
+
+	list := NewList()
+	list.Add(fakeProxy.URL)
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	server := NewServer(logger, list)
+
+	r := chi.NewRouter()
+	r.Use(server.ProxyGetRequest)
+	r.Get("/get", server.ProxyGetResponse)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	t.Run("stalled response does not win", func(t *testing.T) {
+		startedAt := time.Now()
+		resp, body := testRequest(t, ts, "GET", "/get?stream=1&idle_timeout=1&url="+uriEncode(destination.URL+"/flowing"), nil)
+
+		if resp.StatusCode != http.StatusOK || body != "from proxy" {
+			t.Fatalf("Expected body from proxy, got %d %q", resp.StatusCode, body)
+		}
+
+		if time.Since(startedAt) > time.Second {
+			t.Fatalf("Expected flowing response to win without waiting for the stalled one")
+		}
+	})
+
+	t.Run("all responses stalled", func(t *testing.T) {
+		resp, _ := testRequest(t, ts, "GET", "/get?stream=1&idle_timeout=1&url="+uriEncode(destination.URL+"/stalled"), nil)
+
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Fatalf("Expected 502, got %d", resp.StatusCode)
+		}
+
+		if code := resp.Header.Get(ErrorCodeHeader); code != ErrorCodeStreamStalled {
+			t.Fatalf("Expected %s error code, got %q", ErrorCodeStreamStalled, code)
+		}
+	})
+
+	t.Run("stall after the body started is not mistaken for the end", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/get?stream=1&idle_timeout=1&url=" + uriEncode(destination.URL+"/partial"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err == nil {
+			t.Fatalf("Expected truncated body to fail, got %q", body)
+		}
+
+		if string(body) != "partial" {
+			t.Fatalf("Expected the streamed part of the body, got %q", body)
+		}
+	})
+
+	t.Run("invalid options", func(t *testing.T) {
+		resp, _ := testRequest(t, ts, "GET", "/get?stream=1&first_bytes=-1&url="+uriEncode(destination.URL), nil)
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400, got %d", resp.StatusCode)
+		}
+	})
+}
+
+func TestIdleTimeoutReader(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	cancelled := make(chan struct{})
+	reader := newIdleTimeoutReader(pr, "http://example.com", 50*time.Millisecond, func() {
+		close(cancelled)
+		pr.CloseWithError(fmt.Errorf("cancelled"))
+	})
+
+	go pw.Write([]byte("data"))
+
+	buf := make([]byte, 4)
+	if n, err := reader.Read(buf); err != nil || string(buf[:n]) != "data" {
+		t.Fatalf("Expected data, got %q %v", buf[:n], err)
+	}
+
+	_, err := reader.Read(buf)
+	if _, ok := err.(*StallError); !ok {
+		t.Fatalf("Expected stall error, got %v", err)
+	}
+
+	<-cancelled
+}
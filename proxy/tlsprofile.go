@@ -0,0 +1,310 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	utls "github.com/refraction-networking/utls"
+	xproxy "golang.org/x/net/proxy"
+)
+
+// TLSProfileGo - the ClientHello of the Go TLS stack, disables fingerprints
+const TLSProfileGo = "go"
+
+// ClientHello fingerprints connections can be made with
+var tlsProfiles = map[string]utls.ClientHelloID{
+	"chrome":     utls.HelloChrome_Auto,
+	"firefox":    utls.HelloFirefox_Auto,
+	"safari":     utls.HelloSafari_Auto,
+	"edge":       utls.HelloEdge_Auto,
+	"ios":        utls.HelloIOS_Auto,
+	"randomized": utls.HelloRandomizedALPN,
+}
+
+// ValidateTLSProfile - checks the ClientHello profile exists
+func ValidateTLSProfile(name string) error {
+	if _, ok := tlsProfiles[name]; ok || name == "" || name == TLSProfileGo {
+		return nil
+	}
+
+	names := make([]string, 0, len(tlsProfiles))
+	for name := range tlsProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return fmt.Errorf("[tls] must be one of %s or %s", strings.Join(names, ", "), TLSProfileGo)
+}
+
+// tlsProfileForHost - ClientHello profile of the domain configured in GPM_TLS_DOMAINS
+// rules look like `example.com=chrome,.shop.com=firefox`, a leading dot matches subdomains as well
+func tlsProfileForHost(host string) string {
+	host = strings.ToLower(host)
+
+	for _, rule := range strings.Split(getTLSDomains(), ",") {
+		parts := strings.SplitN(strings.TrimSpace(rule), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		domain := strings.ToLower(strings.TrimSpace(parts[0]))
+		if host == strings.TrimPrefix(domain, ".") || (strings.HasPrefix(domain, ".") && strings.HasSuffix(host, domain)) {
+			return strings.TrimSpace(parts[1])
+		}
+	}
+
+	return ""
+}
+
+// keepsHTTPS - checks if the request chose its TLS stack or its domain is fingerprinted by GPM_TLS_DOMAINS or GPM_TLS_PROFILE
+// https destinations of such requests are not downgraded to http
+func keepsHTTPS(destinationURL, tlsProfile string) bool {
+	u, err := url.Parse(destinationURL)
+	if err != nil || u.Scheme != "https" {
+		return false
+	}
+
+	if tlsProfile == TLSProfileGo {
+		return true
+	}
+
+	if tlsProfile == "" {
+		tlsProfile = tlsProfileForHost(u.Hostname())
+	}
+
+	if tlsProfile == "" {
+		tlsProfile = getTLSProfile()
+	}
+
+	_, ok := tlsProfiles[tlsProfile]
+	return ok
+}
+
+// pickTLSProfile - ClientHello profile of the attempt
+// the request option goes first, then the domain, the header profile and GPM_TLS_PROFILE
+func (m *Multiplexer) pickTLSProfile(index int, profile *HeaderProfile) string {
+	name := m.tlsProfile
+
+	if name == "" {
+		if u, err := url.Parse(m.destinationURL); err == nil {
+			name = tlsProfileForHost(u.Hostname())
+		}
+	}
+
+	if name == "" && profile != nil {
+		name = profile.TLS
+	}
+
+	if name == "" {
+		name = getTLSProfile()
+	}
+
+	if _, ok := tlsProfiles[name]; !ok {
+		return ""
+	}
+
+	m.recordAttempt(index, func(attempt *Attempt) {
+		attempt.TLS = name
+	})
+
+	return name
+}
+
+// prepareTransport - apply the ClientHello profile and the header order of the attempt to the transport
+func prepareTransport(transport *http.Transport, proxy string, profile *HeaderProfile, tlsProfile string) error {
+	if tlsProfile != "" {
+		if err := fingerprintTransport(transport, proxy, tlsProfile); err != nil {
+			return err
+		}
+	}
+
+	if profile != nil {
+		orderTransport(transport, profile)
+	}
+
+	return nil
+}
+
+// fingerprintTransport - TLS connections of the transport are made with the ClientHello of the profile
+// TLS through a proxy is tunnelled by the dialer, plain HTTP still goes through the proxy as usual
+func fingerprintTransport(transport *http.Transport, proxy string, tlsProfile string) error {
+	var proxyURL *url.URL
+	// chains tunnel every connection in the dialer already
+	if proxy != "" && !isDirect(proxy) && !isChain(proxy) {
+		var err error
+		if proxyURL, err = url.Parse(proxy); err != nil {
+			return err
+		}
+
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			if req.URL.Scheme == "https" {
+				return nil, nil
+			}
+			return proxyURL, nil
+		}
+	}
+
+	id := tlsProfiles[tlsProfile]
+	insecure := transport.TLSClientConfig != nil && transport.TLSClientConfig.InsecureSkipVerify
+	http2 := allowsHTTP2(transport)
+
+	dial := dialFunc(transport.DialContext)
+	if dial == nil {
+		dial = defaultDial
+	}
+
+	transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialThrough(ctx, dial, proxyURL, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConn, err := handshakeFingerprinted(ctx, conn, addr, id, insecure, http2)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		return tlsConn, nil
+	}
+
+	return nil
+}
+
+// dialThrough - dial the address directly, through a SOCKS5 proxy or through a CONNECT tunnel
+func dialThrough(ctx context.Context, dial dialFunc, proxyURL *url.URL, addr string) (net.Conn, error) {
+	if proxyURL == nil {
+		return dial(ctx, "tcp", addr)
+	}
+
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		socks, err := xproxy.FromURL(proxyURL, dial)
+		if err != nil {
+			return nil, err
+		}
+
+		if contextDialer, ok := socks.(xproxy.ContextDialer); ok {
+			return contextDialer.DialContext(ctx, "tcp", addr)
+		}
+		return socks.Dial("tcp", addr)
+	default:
+		return dialTunnel(ctx, dial, proxyURL, addr)
+	}
+}
+
+// handshakeFingerprinted - TLS handshake with the ClientHello of the profile
+// the ALPN protocols of the profile are offered as they are, so the ClientHello matches the browser,
+// they are narrowed to HTTP/1.1 only when the transport can't speak HTTP/2
+func handshakeFingerprinted(ctx context.Context, conn net.Conn, addr string, id utls.ClientHelloID, insecure, http2 bool) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	config := &utls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: insecure,
+		NextProtos:         alpnProtocols(http2),
+	}
+
+	var uconn *utls.UConn
+	if id == utls.HelloRandomizedALPN {
+		uconn = utls.UClient(conn, config, id)
+	} else {
+		spec, err := utls.UTLSIdToSpec(id)
+		if err != nil {
+			return nil, err
+		}
+
+		if !http2 {
+			for _, extension := range spec.Extensions {
+				if alpn, ok := extension.(*utls.ALPNExtension); ok {
+					alpn.AlpnProtocols = alpnProtocols(false)
+				}
+			}
+		}
+
+		uconn = utls.UClient(conn, config, utls.HelloCustom)
+		if err := uconn.ApplyPreset(&spec); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := uconn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+
+	return &fingerprintedConn{uconn}, nil
+}
+
+// fingerprintedConn - connection of a fingerprinted handshake
+// the transport learns the negotiated protocol from its state and speaks HTTP/2 over it when h2 was picked
+type fingerprintedConn struct {
+	*utls.UConn
+}
+
+// ConnectionState - state of the connection in terms of the Go TLS stack
+func (c *fingerprintedConn) ConnectionState() tls.ConnectionState {
+	state := c.UConn.ConnectionState()
+
+	return tls.ConnectionState{
+		Version:                     state.Version,
+		HandshakeComplete:           state.HandshakeComplete,
+		DidResume:                   state.DidResume,
+		CipherSuite:                 state.CipherSuite,
+		NegotiatedProtocol:          state.NegotiatedProtocol,
+		NegotiatedProtocolIsMutual:  state.NegotiatedProtocolIsMutual,
+		ServerName:                  state.ServerName,
+		PeerCertificates:            state.PeerCertificates,
+		VerifiedChains:              state.VerifiedChains,
+		SignedCertificateTimestamps: state.SignedCertificateTimestamps,
+		OCSPResponse:                state.OCSPResponse,
+	}
+}
+
+// negotiatedHTTP2 - checks if h2 was picked in the TLS handshake of the connection
+func negotiatedHTTP2(conn net.Conn) bool {
+	stater, ok := conn.(interface{ ConnectionState() tls.ConnectionState })
+	return ok && stater.ConnectionState().NegotiatedProtocol == "h2"
+}
+
+// allowsHTTP2 - checks if the transport speaks HTTP/2 with TLS destinations
+func allowsHTTP2(transport *http.Transport) bool {
+	if transport.Protocols != nil {
+		return transport.Protocols.HTTP2()
+	}
+
+	return transport.ForceAttemptHTTP2 && transport.TLSNextProto == nil
+}
+
+// alpnProtocols - protocols offered in the handshakes of the Go TLS stack
+func alpnProtocols(http2 bool) []string {
+	if http2 {
+		return []string{"h2", "http/1.1"}
+	}
+
+	return []string{"http/1.1"}
+}
+
+// goTLSHandshake - TLS handshake of the Go TLS stack for connections the transport does not dial itself
+func goTLSHandshake(ctx context.Context, conn net.Conn, addr string, config *tls.Config, http2 bool) (net.Conn, error) {
+	config = config.Clone()
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	config.NextProtos = alpnProtocols(http2)
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
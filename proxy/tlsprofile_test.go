@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/go-chi/chi"
+	utls "github.com/refraction-networking/utls"
+)
+
+// helloRecorder - TLS server recording the ClientHello of every connection
+type helloRecorder struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	hellos []*tls.ClientHelloInfo
+}
+
+func (hr *helloRecorder) last() *tls.ClientHelloInfo {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+
+	if len(hr.hellos) == 0 {
+		return nil
+	}
+	return hr.hellos[len(hr.hellos)-1]
+}
+
+func newHelloRecorder() *helloRecorder {
+	hr := &helloRecorder{}
+	hr.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	hr.Server.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			hr.mu.Lock()
+			hr.hellos = append(hr.hellos, hello)
+			hr.mu.Unlock()
+			return nil, nil
+		},
+	}
+	hr.Server.StartTLS()
+
+	return hr
+}
+
+// hasGREASE - Go never sends GREASE values, browsers do
+func hasGREASE(hello *tls.ClientHelloInfo) bool {
+	for _, suite := range hello.CipherSuites {
+		if suite&0x0f0f == 0x0a0a && suite>>8 == suite&0xff {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestTLSProfiles(t *testing.T) {
+	recorder := newHelloRecorder()
+	defer recorder.Close()
+
+	list := NewList()
+	list.Filename = "../proxy.list.example"
+	list.Load()
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	server := NewServer(logger, list)
+
+	r := chi.NewRouter()
+	r.With(server.ProxyGetRequest).Get("/get", server.ProxyGetResponse)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	t.Run("browser fingerprint", func(t *testing.T) {
+		_, body := testRequest(t, ts, "GET", "/get?tls=chrome&url="+uriEncode(recorder.URL), nil)
+		if body != "ok" {
+			t.Fatalf("Unexpected body %s", body)
+		}
+
+		hello := recorder.last()
+		if hello == nil || !hasGREASE(hello) {
+			t.Fatalf("Expected a Chrome ClientHello, got %+v", hello)
+		}
+
+		if !reflect.DeepEqual(hello.SupportedProtos, []string{"h2", "http/1.1"}) {
+			t.Fatalf("Expected the ALPN protocols of Chrome, got %v", hello.SupportedProtos)
+		}
+
+		_, body = testRequest(t, ts, "GET", "/get?tls=chrome&protocol=http1&url="+uriEncode(recorder.URL), nil)
+		if hello := recorder.last(); body != "ok" || !reflect.DeepEqual(hello.SupportedProtos, []string{"http/1.1"}) {
+			t.Fatalf("Expected only http/1.1 to be offered with HTTP/2 off, got %s %v", body, hello.SupportedProtos)
+		}
+	})
+
+	t.Run("fingerprinted HTTP/2", func(t *testing.T) {
+		h2 := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, r.Proto)
+		}))
+		h2.EnableHTTP2 = true
+		h2.StartTLS()
+		defer h2.Close()
+
+		for _, tlsProfile := range []string{"chrome", "firefox", "go"} {
+			_, body := testRequest(t, ts, "GET", "/get?tls="+tlsProfile+"&url="+uriEncode(h2.URL), nil)
+			if body != "HTTP/2.0" {
+				t.Fatalf("%s: expected HTTP/2 to be negotiated, got %s", tlsProfile, body)
+			}
+		}
+	})
+
+	t.Run("go fingerprint", func(t *testing.T) {
+		_, body := testRequest(t, ts, "GET", "/get?tls=go&url="+uriEncode(recorder.URL), nil)
+		if body != "ok" {
+			t.Fatalf("Unexpected body %s", body)
+		}
+
+		if hello := recorder.last(); hello == nil || hasGREASE(hello) {
+			t.Fatalf("Expected a Go ClientHello, got %+v", hello)
+		}
+	})
+
+	t.Run("per domain", func(t *testing.T) {
+		os.Setenv("GPM_TLS_DOMAINS", "example.com=safari,.shop.com=firefox,127.0.0.1=chrome")
+		defer os.Unsetenv("GPM_TLS_DOMAINS")
+
+		if profile := tlsProfileForHost("www.example.com"); profile != "" {
+			t.Fatalf("Expected subdomains not to match, got %s", profile)
+		}
+
+		if profile := tlsProfileForHost("www.shop.com"); profile != "firefox" {
+			t.Fatalf("Expected subdomains to match, got %s", profile)
+		}
+
+		// connections to the first recorder are reused
+		domainRecorder := newHelloRecorder()
+		defer domainRecorder.Close()
+
+		testRequest(t, ts, "GET", "/get?url="+uriEncode(domainRecorder.URL), nil)
+		if hello := domainRecorder.last(); hello == nil || !hasGREASE(hello) {
+			t.Fatalf("Expected a browser ClientHello, got %+v", hello)
+		}
+	})
+
+	t.Run("invalid profile", func(t *testing.T) {
+		resp, _ := testRequest(t, ts, "GET", "/get?tls=netscape&url="+uriEncode(recorder.URL), nil)
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400, got %d", resp.StatusCode)
+		}
+	})
+}
+
+func TestTLSProfileThroughProxy(t *testing.T) {
+	recorder := newHelloRecorder()
+	defer recorder.Close()
+
+	var connects int
+	var mu sync.Mutex
+	connectProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+
+		mu.Lock()
+		connects++
+		mu.Unlock()
+
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		pipe(conn, target)
+	}))
+	defer connectProxy.Close()
+
+	transport := NewTransport()
+	if err := fingerprintTransport(transport, connectProxy.URL, "firefox"); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := NewClient(transport).Get(recorder.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "ok" {
+		t.Fatalf("Unexpected body %s", body)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if connects != 1 {
+		t.Fatalf("Expected the connection to be tunnelled through the proxy, got %d CONNECTs", connects)
+	}
+
+	spec, _ := utls.UTLSIdToSpec(utls.HelloFirefox_Auto)
+	hello := recorder.last()
+	if hello == nil || !reflect.DeepEqual(hello.CipherSuites, spec.CipherSuites) {
+		t.Fatalf("Expected the cipher suites of Firefox, got %+v", hello)
+	}
+
+	proxyURL, _ := url.Parse(connectProxy.URL)
+	if u, _ := transport.Proxy(&http.Request{URL: &url.URL{Scheme: "http", Host: "example.com"}}); u.String() != proxyURL.String() {
+		t.Fatalf("Expected plain HTTP to go through the proxy, got %v", u)
+	}
+}
@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Protocols attempts speak with the destination
+const (
+	// HTTP/1.1 only, even when the destination offers HTTP/2
+	ProtocolHTTP1 = "http1"
+	// HTTP/2 without TLS, known in advance to be spoken by the destination
+	ProtocolH2C = "h2c"
+)
+
+// ValidateProtocol - checks the protocol is known, HTTP/2 is negotiated when it is empty
+func ValidateProtocol(protocol string) error {
+	switch protocol {
+	case "", ProtocolHTTP1, ProtocolH2C:
+		return nil
+	}
+
+	return fmt.Errorf("[protocol] must be either %s or %s", ProtocolHTTP1, ProtocolH2C)
+}
+
+// TransportPool - transports shared by the attempts of all requests
+// attempts through the same proxy with the same profiles reuse connections to the origin,
+// HTTP/2 connections are shared by concurrent requests
+type TransportPool struct {
+	mu         sync.Mutex
+	transports map[string]*pooledTransport
+	max        int
+}
+
+type pooledTransport struct {
+	transport  *http.Transport
+	lastUsedAt time.Time
+}
+
+// Get - transport of the key, created when the pool has none
+// transports that could not be created properly are not kept
+func (tp *TransportPool) Get(key string, create func() (*http.Transport, error)) (*http.Transport, error) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	now := time.Now()
+	if pooled, ok := tp.transports[key]; ok {
+		pooled.lastUsedAt = now
+		return pooled.transport, nil
+	}
+
+	transport, err := create()
+	if err != nil {
+		return transport, err
+	}
+
+	if tp.max > 0 && len(tp.transports) >= tp.max {
+		tp.evict()
+	}
+	tp.transports[key] = &pooledTransport{transport: transport, lastUsedAt: now}
+
+	return transport, nil
+}
+
+// Len - number of transports in the pool
+func (tp *TransportPool) Len() int {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	return len(tp.transports)
+}
+
+// evict - forget the least recently used transport closing its idle connections
+// requests still running over it finish normally
+func (tp *TransportPool) evict() {
+	var oldestKey string
+	var oldest time.Time
+
+	for key, pooled := range tp.transports {
+		if oldestKey == "" || pooled.lastUsedAt.Before(oldest) {
+			oldestKey, oldest = key, pooled.lastUsedAt
+		}
+	}
+
+	if pooled, ok := tp.transports[oldestKey]; ok {
+		pooled.transport.CloseIdleConnections()
+		delete(tp.transports, oldestKey)
+	}
+}
+
+// NewTransportPool - creates new transport pool keeping at most max transports
+func NewTransportPool(max int) *TransportPool {
+	return &TransportPool{
+		transports: make(map[string]*pooledTransport),
+		max:        max,
+	}
+}
+
+// transportKey - attempts with the same key can share a transport
+func transportKey(proxy string, profile *HeaderProfile, tlsProfile, protocol string) string {
+	var name string
+	if profile != nil {
+		name = profile.Name
+	}
+
+	return strings.Join([]string{proxy, name, tlsProfile, protocol}, "|")
+}
+
+// newAttemptTransport - transport going through the proxy with the profiles and the protocol of an attempt
+// hosts are resolved with the resolver unless it is nil
+func newAttemptTransport(proxy string, profile *HeaderProfile, tlsProfile, protocol string, resolver *Resolver) (*http.Transport, error) {
+	transport := NewTransport()
+	if !isDirect(proxy) && !isChain(proxy) {
+		var err error
+		if transport, err = NewProxiedTransport(proxy); err != nil {
+			return transport, err
+		}
+	}
+
+	if resolver != nil {
+		transport.DialContext = resolver.DialContext
+	}
+
+	if local := localAddress(proxy); local != nil {
+		transport.DialContext = localDial(local, resolver)
+	} else if isChain(proxy) {
+		hops, err := parseChain(proxy)
+		if err != nil {
+			return transport, err
+		}
+
+		dial := dialFunc(transport.DialContext)
+		if dial == nil {
+			dial = defaultDial
+		}
+		// every connection is tunnelled through all the hops, plain HTTP included
+		transport.DialContext = chainDial(hops, dial)
+	}
+
+	switch {
+	case protocol == ProtocolHTTP1:
+		disableHTTP2(transport)
+	case protocol == ProtocolH2C && isDirect(proxy):
+		protocols := new(http.Protocols)
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+		transport.Protocols = protocols
+		// headers are only reordered in HTTP/1.1 heads
+		profile = nil
+	}
+
+	return transport, prepareTransport(transport, proxy, profile, tlsProfile)
+}
+
+// disableHTTP2 - the transport speaks HTTP/1.1 only
+func disableHTTP2(transport *http.Transport) {
+	transport.ForceAttemptHTTP2 = false
+	transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+}
+
+// attemptTransport - transport of the attempt, taken from the pool when the multiplexer has one
+// one-off proxies are never used again, their transports are not pooled and serve a single request
+func (m *Multiplexer) attemptTransport(proxy string, profile *HeaderProfile, tlsProfile string, oneOff bool) (*http.Transport, error) {
+	create := func() (*http.Transport, error) {
+		return newAttemptTransport(proxy, profile, tlsProfile, m.protocol, m.resolver)
+	}
+
+	if oneOff {
+		transport, err := create()
+		if transport != nil {
+			transport.DisableKeepAlives = true
+		}
+		return transport, err
+	}
+
+	if m.transports == nil {
+		return create()
+	}
+
+	return m.transports.Get(transportKey(proxy, profile, tlsProfile, m.protocol), create)
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-chi/chi"
+)
+
+// protocolServer - responds with the protocol of the request and counts connections
+func protocolServer(connections *int64) *httptest.Server {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	}))
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(connections, 1)
+		}
+	}
+
+	return ts
+}
+
+func TestHTTP2(t *testing.T) {
+	var connections int64
+	destination := protocolServer(&connections)
+	destination.EnableHTTP2 = true
+	destination.StartTLS()
+	defer destination.Close()
+
+	var h2cConnections int64
+	h2cDestination := protocolServer(&h2cConnections)
+	h2cDestination.Config.Protocols = new(http.Protocols)
+	h2cDestination.Config.Protocols.SetHTTP1(true)
+	h2cDestination.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2cDestination.Start()
+	defer h2cDestination.Close()
+
+	list := NewList()
+	list.Filename = "../proxy.list.example"
+	list.Load()
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	server := NewServer(logger, list)
+
+	r := chi.NewRouter()
+	r.With(server.ProxyGetRequest).Get("/get", server.ProxyGetResponse)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	t.Run("negotiated with TLS destinations", func(t *testing.T) {
+		resp, body := testRequest(t, ts, "GET", "/get?tls=go&diagnostics=1&url="+uriEncode(destination.URL), nil)
+		if body != "HTTP/2.0" {
+			t.Fatalf("Expected HTTP/2, got %s", body)
+		}
+
+		var diagnostics Diagnostics
+		if err := json.Unmarshal([]byte(resp.Header.Get(DiagnosticsHeader)), &diagnostics); err != nil {
+			t.Fatal(err)
+		}
+		if diagnostics.Attempts[0].Protocol != "HTTP/2.0" {
+			t.Fatalf("Expected the protocol in diagnostics, got %s", resp.Header.Get(DiagnosticsHeader))
+		}
+	})
+
+	t.Run("connections are shared by concurrent requests", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				testRequest(t, ts, "GET", "/get?tls=go&url="+uriEncode(destination.URL), nil)
+			}()
+		}
+		wg.Wait()
+
+		if n := atomic.LoadInt64(&connections); n != 1 {
+			t.Fatalf("Expected a single connection to the destination, got %d", n)
+		}
+	})
+
+	t.Run("HTTP/1.1 on request", func(t *testing.T) {
+		_, body := testRequest(t, ts, "GET", "/get?tls=go&protocol=http1&url="+uriEncode(destination.URL), nil)
+		if body != "HTTP/1.1" {
+			t.Fatalf("Expected HTTP/1.1, got %s", body)
+		}
+	})
+
+	t.Run("h2c", func(t *testing.T) {
+		_, body := testRequest(t, ts, "GET", "/get?url="+uriEncode(h2cDestination.URL), nil)
+		if body != "HTTP/1.1" {
+			t.Fatalf("Expected HTTP/1.1 without h2c, got %s", body)
+		}
+
+		_, body = testRequest(t, ts, "GET", "/get?protocol=h2c&url="+uriEncode(h2cDestination.URL), nil)
+		if body != "HTTP/2.0" {
+			t.Fatalf("Expected HTTP/2 with h2c, got %s", body)
+		}
+	})
+
+	t.Run("invalid protocol", func(t *testing.T) {
+		resp, _ := testRequest(t, ts, "GET", "/get?protocol=spdy&url="+uriEncode(h2cDestination.URL), nil)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400, got %d", resp.StatusCode)
+		}
+	})
+}
+
+func TestHTTP2ThroughProxy(t *testing.T) {
+	var connections int64
+	destination := protocolServer(&connections)
+	destination.EnableHTTP2 = true
+	destination.StartTLS()
+	defer destination.Close()
+
+	var connects int64
+	connectProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+
+		atomic.AddInt64(&connects, 1)
+
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		pipe(conn, target)
+	}))
+	defer connectProxy.Close()
+
+	pool := NewTransportPool(10)
+	create := func() (*http.Transport, error) {
+		return newAttemptTransport(connectProxy.URL, nil, "", "", nil)
+	}
+
+	for i := 0; i < 3; i++ {
+		transport, err := pool.Get(transportKey(connectProxy.URL, nil, "", ""), create)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := NewClient(transport).Get(destination.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(body) != "HTTP/2.0" {
+			t.Fatalf("Expected HTTP/2 through the tunnel, got %s", body)
+		}
+	}
+
+	if pool.Len() != 1 || atomic.LoadInt64(&connects) != 1 || atomic.LoadInt64(&connections) != 1 {
+		t.Fatalf("Expected a single tunnel to be reused, got %d transports, %d CONNECTs and %d connections",
+			pool.Len(), connects, connections)
+	}
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// dialFunc - dials like net.Dialer does, so the resolver can be used wherever a dialer is expected
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Dial - dial without a context
+func (dial dialFunc) Dial(network, addr string) (net.Conn, error) {
+	return dial(context.Background(), network, addr)
+}
+
+// DialContext - dial with the context
+func (dial dialFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return dial(ctx, network, addr)
+}
+
+// defaultDial - dial resolving hosts with the system resolver
+var defaultDial dialFunc = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+
+// dialTunnel - dial the target through the http proxy using CONNECT
+func dialTunnel(ctx context.Context, dial dialFunc, proxyURL *url.URL, target string) (net.Conn, error) {
+	conn, err := dial(ctx, "tcp", proxyAddr(proxyURL))
+	if err != nil {
+		return nil, err
+	}
+
+	tunnel, err := connectThrough(ctx, conn, proxyURL, target)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tunnel, nil
+}
+
+// connectThrough - ask the http proxy on the other end of conn to open a tunnel to the target
+func connectThrough(ctx context.Context, conn net.Conn, proxyURL *url.URL, target string) (net.Conn, error) {
+	// abort the handshake as soon as the context is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+
+	for name, values := range proxyHeader(proxyURL) {
+		req.Header[name] = values
+	}
+
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := proxyURL.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy %s refused to connect to %s: %s", proxyURL.Host, target, response.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+
+	return conn, nil
+}
+
+// proxyAddr - host and port of the proxy with the default port of its scheme
+func proxyAddr(proxyURL *url.URL) string {
+	if proxyURL.Port() != "" {
+		return proxyURL.Host
+	}
+
+	switch proxyURL.Scheme {
+	case "https":
+		return net.JoinHostPort(proxyURL.Hostname(), "443")
+	case "socks5", "socks5h":
+		return net.JoinHostPort(proxyURL.Hostname(), "1080")
+	}
+
+	return net.JoinHostPort(proxyURL.Hostname(), "80")
+}
+
+// bufferedConn - connection with some of its data already read into a buffer
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (bc *bufferedConn) Read(b []byte) (int, error) {
+	return bc.reader.Read(b)
+}
+
+// pipe - copy data between the connections until both directions are done
+func pipe(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+
+	copyHalf := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+
+	<-done
+	<-done
+
+	a.Close()
+	b.Close()
+}
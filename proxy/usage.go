@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+)
+
+// UsageStats - traffic of a key or a proxy
+type UsageStats struct {
+	// requests made to destinations including the ones that lost the race
+	Requests int64 `json:"requests"`
+	// bytes of response bodies received
+	Bytes int64 `json:"bytes"`
+}
+
+// Usage - accounts traffic per api key and per proxy
+type Usage struct {
+	mu      sync.Mutex
+	keys    map[string]*UsageStats
+	proxies map[string]*UsageStats
+}
+
+// Request - account a request made for the key through the proxy
+func (u *Usage) Request(key, proxy string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.stats(u.keys, key).Requests++
+	// sessions of a gateway are accounted to the gateway
+	u.stats(u.proxies, redactProxy(proxy)).Requests++
+}
+
+// Bytes - account bytes received for the key through the proxy
+func (u *Usage) Bytes(key, proxy string, n int64) {
+	if n == 0 {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.stats(u.keys, key).Bytes += n
+	u.stats(u.proxies, redactProxy(proxy)).Bytes += n
+}
+
+// Key - usage of the key
+func (u *Usage) Key(key string) UsageStats {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return *u.stats(u.keys, key)
+}
+
+// Proxies - usage of every proxy
+func (u *Usage) Proxies() map[string]UsageStats {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	proxies := make(map[string]UsageStats, len(u.proxies))
+	for proxy, stats := range u.proxies {
+		proxies[redactProxy(proxy)] = *stats
+	}
+
+	return proxies
+}
+
+// redactProxy - proxy without its credentials, they must not leak
+func redactProxy(proxy string) string {
+	if isChain(proxy) {
+		return redactChain(proxy)
+	}
+
+	// headers of the proxy may carry credentials and session IDs of gateways as well
+	if proxyURL, err := url.Parse(proxy); err == nil && (proxyURL.User != nil || proxyURL.Fragment != "") {
+		proxyURL.User = nil
+		proxyURL.Fragment = ""
+		return proxyURL.String()
+	}
+
+	return proxy
+}
+
+func (u *Usage) stats(m map[string]*UsageStats, name string) *UsageStats {
+	stats, ok := m[name]
+	if !ok {
+		stats = &UsageStats{}
+		m[name] = stats
+	}
+
+	return stats
+}
+
+// countingBody - accounts the bytes of the body once it is closed
+type countingBody struct {
+	io.ReadCloser
+	read    int64
+	account func(n int64)
+	once    sync.Once
+}
+
+func (cb *countingBody) Read(p []byte) (int, error) {
+	n, err := cb.ReadCloser.Read(p)
+	atomic.AddInt64(&cb.read, int64(n))
+	return n, err
+}
+
+func (cb *countingBody) Close() error {
+	cb.once.Do(func() {
+		cb.account(atomic.LoadInt64(&cb.read))
+	})
+	return cb.ReadCloser.Close()
+}
+
+// NewUsage - creates new usage accounting
+func NewUsage() *Usage {
+	return &Usage{
+		keys:    make(map[string]*UsageStats),
+		proxies: make(map[string]*UsageStats),
+	}
+}
+
+// GetUsage - report the usage of the caller's api key and of every proxy
+func (s *Server) GetUsage(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, struct {
+		Key     UsageStats            `json:"key"`
+		Proxies map[string]UsageStats `json:"proxies"`
+	}{s.usage.Key(requestKey(r).Value), s.usage.Proxies()})
+}
@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -24,7 +26,8 @@ func copyHeaders(dest, src http.Header) {
 }
 
 // getProxyStr - combines proxy url with auth key
-// primarily because it works with crawlera
+// primarily because it works with crawlera, the session header of GPM_PROXY_SESSION_HEADER
+// makes a gateway of it
 func getProxyStr() string {
 	proxyURL := os.Getenv("GPM_PROXY_URL")
 	if proxyURL == "" {
@@ -34,15 +37,36 @@ func getProxyStr() string {
 	proxyURL = strings.Replace(proxyURL, "http://", "", 1)
 	proxyURL = strings.Replace(proxyURL, "https://", "", 1)
 
+	if header := os.Getenv("GPM_PROXY_SESSION_HEADER"); header != "" {
+		proxyURL += "#" + header + "=" + sessionPlaceholder
+	}
+
 	proxyAuth := getProxyAuth()
 
 	if proxyAuth == "" {
 		return fmt.Sprintf("http://%s", proxyURL)
 	}
 
+	// user and password of gateways, an api key otherwise
+	if strings.Contains(proxyAuth, ":") {
+		return fmt.Sprintf("http://%s@%s", proxyAuth, proxyURL)
+	}
+
 	return fmt.Sprintf("http://%s:@%s", proxyAuth, proxyURL)
 }
 
+// getGatewayCountries - countries the {country} of gateway templates is filled with
+func getGatewayCountries() []string {
+	var countries []string
+	for _, country := range strings.Split(os.Getenv("GPM_GATEWAY_COUNTRIES"), ",") {
+		if country = strings.TrimSpace(country); country != "" {
+			countries = append(countries, country)
+		}
+	}
+
+	return countries
+}
+
 func getProxyAuth() string {
 	proxyAuth := os.Getenv("GPM_PROXY_AUTH")
 	if proxyAuth == "" {
@@ -60,6 +84,392 @@ func getConcurrentTries() int {
 	return concurrentTries
 }
 
+// getUserAgent - user agent sent with outgoing requests and matched against robots.txt
+func getUserAgent() string {
+	return os.Getenv("GPM_USER_AGENT")
+}
+
+// getRobotsTTL - how long a fetched robots.txt is kept in cache
+func getRobotsTTL() time.Duration {
+	ttl, err := strconv.Atoi(os.Getenv("GPM_ROBOTS_TTL"))
+	if err != nil {
+		ttl = 3600 // seconds
+	}
+
+	return time.Duration(ttl) * time.Second
+}
+
+// getCacheBackend - response cache backend, either memory or disk
+// caching is disabled when empty
+func getCacheBackend() string {
+	return os.Getenv("GPM_CACHE")
+}
+
+// getCacheMaxBytes - memory budget of the in memory response cache
+func getCacheMaxBytes() int64 {
+	maxBytes, err := strconv.ParseInt(os.Getenv("GPM_CACHE_MAX_BYTES"), 10, 64)
+	if err != nil {
+		maxBytes = 64 << 20 // 64 MiB
+	}
+
+	return maxBytes
+}
+
+// getCacheMaxEntrySize - responses with bigger bodies are not cached
+func getCacheMaxEntrySize() int64 {
+	maxSize, err := strconv.ParseInt(os.Getenv("GPM_CACHE_MAX_ENTRY_SIZE"), 10, 64)
+	if err != nil {
+		maxSize = 4 << 20 // 4 MiB
+	}
+
+	return maxSize
+}
+
+// getCoalesceMaxBody - coalesced requests fail when the shared body is bigger
+func getCoalesceMaxBody() int64 {
+	maxBody, err := strconv.ParseInt(os.Getenv("GPM_COALESCE_MAX_BODY"), 10, 64)
+	if err != nil || maxBody < 1 {
+		maxBody = 16 << 20 // 16 MiB
+	}
+
+	return maxBody
+}
+
+// getCacheDir - directory of the on disk response cache
+func getCacheDir() string {
+	dir := os.Getenv("GPM_CACHE_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "gpm-cache")
+	}
+
+	return dir
+}
+
+// getCacheTTL - freshness lifetime overriding the one sent by destinations
+func getCacheTTL() time.Duration {
+	ttl, err := strconv.Atoi(os.Getenv("GPM_CACHE_TTL"))
+	if err != nil {
+		ttl = 0 // use the one sent by destination
+	}
+
+	return time.Duration(ttl) * time.Second
+}
+
+// getCacheMaxStale - how long an expired response can be served when all requests fail
+func getCacheMaxStale() time.Duration {
+	maxStale, err := strconv.Atoi(os.Getenv("GPM_CACHE_MAX_STALE"))
+	if err != nil {
+		maxStale = 3600 // seconds
+	}
+
+	return time.Duration(maxStale) * time.Second
+}
+
+// getBatchConcurrency - how many requests of a batch are processed at once
+func getBatchConcurrency() int {
+	concurrency, err := strconv.Atoi(os.Getenv("GPM_BATCH_CONCURRENCY"))
+	if err != nil || concurrency < 1 {
+		concurrency = 10
+	}
+
+	return concurrency
+}
+
+// getBatchMaxItems - maximum number of requests in a batch
+func getBatchMaxItems() int {
+	maxItems, err := strconv.Atoi(os.Getenv("GPM_BATCH_MAX_ITEMS"))
+	if err != nil {
+		maxItems = 1000
+	}
+
+	return maxItems
+}
+
+// getJobWorkers - number of workers processing jobs
+func getJobWorkers() int {
+	workers, err := strconv.Atoi(os.Getenv("GPM_JOB_WORKERS"))
+	if err != nil || workers < 1 {
+		workers = 4
+	}
+
+	return workers
+}
+
+// getJobQueueDepth - how many jobs may wait for a worker
+func getJobQueueDepth() int {
+	depth, err := strconv.Atoi(os.Getenv("GPM_JOB_QUEUE_DEPTH"))
+	if err != nil || depth < 0 {
+		depth = 100
+	}
+
+	return depth
+}
+
+// getJobTimeout - seconds a job waits for the first response unless the job sets its own timeout
+func getJobTimeout() int {
+	timeout, err := strconv.Atoi(os.Getenv("GPM_JOB_TIMEOUT"))
+	if err != nil {
+		timeout = 300 // seconds
+	}
+
+	return timeout
+}
+
+// getJobTTL - how long results of finished jobs are kept
+func getJobTTL() time.Duration {
+	ttl, err := strconv.Atoi(os.Getenv("GPM_JOB_TTL"))
+	if err != nil {
+		ttl = 3600 // seconds
+	}
+
+	return time.Duration(ttl) * time.Second
+}
+
+// getJobDir - directory results of finished jobs are kept in
+func getJobDir() string {
+	dir := os.Getenv("GPM_JOB_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "gpm-jobs")
+	}
+
+	return dir
+}
+
+// getCallbackAttempts - maximum number of attempts to post a result to the callback URL
+func getCallbackAttempts() int {
+	attempts, err := strconv.Atoi(os.Getenv("GPM_CALLBACK_ATTEMPTS"))
+	if err != nil || attempts < 1 {
+		attempts = 5
+	}
+
+	return attempts
+}
+
+// getCallbackBackoff - delay before the second attempt, doubled after every attempt
+func getCallbackBackoff() time.Duration {
+	backoff, err := strconv.Atoi(os.Getenv("GPM_CALLBACK_BACKOFF"))
+	if err != nil {
+		backoff = 1 // seconds
+	}
+
+	return time.Duration(backoff) * time.Second
+}
+
+// getCallbackMaxInlineBody - bigger bodies are referenced from the callback instead of being inlined
+func getCallbackMaxInlineBody() int {
+	maxBody, err := strconv.Atoi(os.Getenv("GPM_CALLBACK_MAX_INLINE_BODY"))
+	if err != nil {
+		maxBody = 1 << 20 // 1 MiB
+	}
+
+	return maxBody
+}
+
+// getCallbackDir - directory referenced callback bodies are kept in
+func getCallbackDir() string {
+	dir := os.Getenv("GPM_CALLBACK_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "gpm-callbacks")
+	}
+
+	return dir
+}
+
+// getCallbackTTL - how long delivery records and referenced bodies are kept
+func getCallbackTTL() time.Duration {
+	ttl, err := strconv.Atoi(os.Getenv("GPM_CALLBACK_TTL"))
+	if err != nil {
+		ttl = 3600 // seconds
+	}
+
+	return time.Duration(ttl) * time.Second
+}
+
+// getStreamIdleTimeout - how long a streamed response body may send nothing
+func getStreamIdleTimeout() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("GPM_STREAM_IDLE_TIMEOUT"))
+	if err != nil || seconds < 1 {
+		seconds = 10
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// getDownloadResumes - how many times a broken download is resumed
+func getDownloadResumes() int {
+	resumes, err := strconv.Atoi(os.Getenv("GPM_DOWNLOAD_RESUMES"))
+	if err != nil || resumes < 0 {
+		resumes = 5
+	}
+
+	return resumes
+}
+
+// getDownloadMaxChunks - maximum number of chunks a download is split into
+func getDownloadMaxChunks() int {
+	chunks, err := strconv.Atoi(os.Getenv("GPM_DOWNLOAD_MAX_CHUNKS"))
+	if err != nil || chunks < 1 {
+		chunks = 8
+	}
+
+	return chunks
+}
+
+// getHeaderProfilePin - whether header profiles are picked per attempt or kept per proxy
+func getHeaderProfilePin() string {
+	if os.Getenv("GPM_HEADER_PROFILE_PIN") == ProfilePinProxy {
+		return ProfilePinProxy
+	}
+
+	return ProfilePinAttempt
+}
+
+// getTLSProfile - ClientHello profile of TLS connections unless something else is configured
+func getTLSProfile() string {
+	return os.Getenv("GPM_TLS_PROFILE")
+}
+
+// getTLSDomains - ClientHello profiles of domains, e.g. `example.com=chrome,.shop.com=firefox`
+func getTLSDomains() string {
+	return os.Getenv("GPM_TLS_DOMAINS")
+}
+
+// getSessionTTL - how long idle sessions are kept
+func getSessionTTL() time.Duration {
+	ttl, err := strconv.Atoi(os.Getenv("GPM_SESSION_TTL"))
+	if err != nil || ttl < 1 {
+		ttl = 1800 // seconds
+	}
+
+	return time.Duration(ttl) * time.Second
+}
+
+// getMaxSessions - maximum number of sessions, least recently used ones are dropped beyond it
+func getMaxSessions() int {
+	sessions, err := strconv.Atoi(os.Getenv("GPM_MAX_SESSIONS"))
+	if err != nil || sessions < 1 {
+		sessions = 1000
+	}
+
+	return sessions
+}
+
+// getSessionMaxCookies - maximum number of cookies of a session, oldest ones are dropped beyond it
+func getSessionMaxCookies() int {
+	cookies, err := strconv.Atoi(os.Getenv("GPM_SESSION_MAX_COOKIES"))
+	if err != nil || cookies < 1 {
+		cookies = 300
+	}
+
+	return cookies
+}
+
+// http2Enabled - checks if HTTP/2 is negotiated with TLS destinations, it is by default
+func http2Enabled() bool {
+	enabled, err := strconv.ParseBool(os.Getenv("GPM_HTTP2"))
+	return err != nil || enabled
+}
+
+// getMaxTransports - maximum number of transports kept for reuse, least recently used ones are dropped beyond it
+func getMaxTransports() int {
+	transports, err := strconv.Atoi(os.Getenv("GPM_MAX_TRANSPORTS"))
+	if err != nil || transports < 1 {
+		transports = 512
+	}
+
+	return transports
+}
+
+// getProxyProviders - JSON file of the providers the proxies are fetched from
+func getProxyProviders() string {
+	return os.Getenv("GPM_PROXY_PROVIDERS")
+}
+
+// getProviderRefresh - how often the proxies of the providers are fetched unless a provider sets its own interval
+func getProviderRefresh() time.Duration {
+	refresh, err := strconv.Atoi(os.Getenv("GPM_PROVIDER_REFRESH"))
+	if err != nil || refresh < 1 {
+		refresh = 300 // seconds
+	}
+
+	return time.Duration(refresh) * time.Second
+}
+
+// getProviderStartTimeout - how long the first fetch of the providers may hold up the start
+func getProviderStartTimeout() time.Duration {
+	timeout, err := strconv.Atoi(os.Getenv("GPM_PROVIDER_START_TIMEOUT"))
+	if err != nil || timeout < 1 {
+		timeout = 10 // seconds
+	}
+
+	return time.Duration(timeout) * time.Second
+}
+
+// getLocalAddresses - local addresses and blocks direct requests go out from
+func getLocalAddresses() []string {
+	var addresses []string
+	for _, address := range strings.Split(os.Getenv("GPM_LOCAL_ADDRESSES"), ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+
+	return addresses
+}
+
+// getDNSServers - upstream DNS servers, the system resolver is used when there are none
+func getDNSServers() []string {
+	var servers []string
+	for _, server := range strings.Split(os.Getenv("GPM_DNS_SERVERS"), ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			servers = append(servers, server)
+		}
+	}
+
+	return servers
+}
+
+// getDNSHosts - hosts file with static overrides of DNS
+func getDNSHosts() string {
+	return os.Getenv("GPM_DNS_HOSTS")
+}
+
+// getDNSCacheTTL - how long answers of the system resolver are cached
+func getDNSCacheTTL() time.Duration {
+	ttl, err := strconv.Atoi(os.Getenv("GPM_DNS_CACHE_TTL"))
+	if err != nil || ttl < 0 {
+		ttl = 60 // seconds
+	}
+
+	return time.Duration(ttl) * time.Second
+}
+
+// mitmEnabled - checks if CONNECT tunnels should be intercepted
+func mitmEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("GPM_MITM"))
+	return enabled
+}
+
+// getCACertFile - certificate of the CA intercepting CONNECT tunnels
+func getCACertFile() string {
+	certFile := os.Getenv("GPM_MITM_CA_CERT")
+	if certFile == "" {
+		certFile = "gpm-ca.pem"
+	}
+
+	return certFile
+}
+
+// getCAKeyFile - private key of the CA intercepting CONNECT tunnels
+func getCAKeyFile() string {
+	keyFile := os.Getenv("GPM_MITM_CA_KEY")
+	if keyFile == "" {
+		keyFile = "gpm-ca-key.pem"
+	}
+
+	return keyFile
+}
+
 // GetMaxTimeout - get maximum timeout from env
 func GetMaxTimeout() int {
 	maxTimeout, err := strconv.Atoi(os.Getenv("GPM_MAX_TIMEOUT"))
@@ -86,12 +496,28 @@ func ParseURLParam(r *http.Request) (string, error) {
 		u = string(decoded)
 	}
 
+	tlsProfile, _ := ExtractQueryParam(r, "tls")
+
+	return normalizeURL(u, tlsProfile)
+}
+
+// NormalizeURL checks that the value is a valid destination URL
+func NormalizeURL(u string) (string, error) {
+	return normalizeURL(u, "")
+}
+
+// normalizeURL - https is kept only if the destination is reached with a ClientHello fingerprint
+func normalizeURL(u, tlsProfile string) (string, error) {
 	regx := regexp.MustCompile(`^(?:http(s)?:\/\/)?[\w.-]+(?:\.[\w\.-]+)+[\w\-\._~:/?#[\]@!\$&'\(\)\*\+,;=.]+$`)
 
 	if !regx.MatchString(u) {
 		return "", errors.New("passed url value does not match a valid url pattern")
 	}
 
+	if keepsHTTPS(u, tlsProfile) {
+		return u, nil
+	}
+
 	// for some reason crawlera does not like https
 	// or I'm doing something wrong
 	return strings.Replace(u, "https://", "http://", 1), nil